@@ -1,11 +1,12 @@
 package main
 
 import (
-	"database/sql"
+	"errors"
 	"fmt"
+	"image"
 	"io"
 	"net/http"
-	"os"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -13,38 +14,40 @@ import (
 )
 
 type adminHandler struct {
-	db        *sql.DB
-	app       *application
-	uploadDir string
+	store   Store
+	app     *application
+	uploads storage
 }
 
 func newAdminHandler(app *application) *adminHandler {
-	return &adminHandler{db: app.db, app: app, uploadDir: app.uploadDir}
+	return &adminHandler{store: app.store, app: app, uploads: app.uploads}
 }
 
 func (h *adminHandler) handleDashboard(w http.ResponseWriter, r *http.Request) {
-	reviews, err := dbGetFeed(h.db)
+	reviews, err := h.store.GetFeed()
 	if err != nil {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
-	h.app.render(w, "admin/dashboard.html", map[string]any{
+	h.app.render(w, r, "admin/dashboard.html", map[string]any{
 		"Reviews":      reviews,
 		"ContentTypes": contentTypeList,
 	})
 }
 
 func (h *adminHandler) handleNewForm(w http.ResponseWriter, r *http.Request) {
-	h.app.render(w, "admin/form.html", map[string]any{
+	h.app.render(w, r, "admin/form.html", map[string]any{
 		"IsNew":        true,
 		"IsArticle":    false,
 		"ContentTypes": contentTypeList,
 		"ArticleTypes": validArticleTypes,
+		"MaxImageSize": h.app.cfg.MaxImageSize,
 	})
 }
 
 func (h *adminHandler) handleCreate(w http.ResponseWriter, r *http.Request) {
-	if err := r.ParseMultipartForm(10 << 20); err != nil {
+	r.Body = http.MaxBytesReader(w, r.Body, int64(h.app.cfg.MaxRequestSize))
+	if err := r.ParseMultipartForm(int64(h.app.cfg.MaxRequestSize)); err != nil {
 		http.Error(w, "Request too large", http.StatusBadRequest)
 		return
 	}
@@ -78,9 +81,10 @@ func (h *adminHandler) handleCreate(w http.ResponseWriter, r *http.Request) {
 	}
 
 	renderErr := func(msg string) {
-		h.app.render(w, "admin/form.html", map[string]any{
+		h.app.render(w, r, "admin/form.html", map[string]any{
 			"IsNew": true, "IsArticle": isArticle, "Error": msg,
 			"Form": formData, "ContentTypes": contentTypeList, "ArticleTypes": validArticleTypes,
+			"MaxImageSize": h.app.cfg.MaxImageSize,
 		})
 	}
 
@@ -98,7 +102,7 @@ func (h *adminHandler) handleCreate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	slug, err := uniqueSlug(h.db, table, artist, title, 0)
+	slug, err := uniqueSlug(h.store, table, artist, title, 0)
 	if err != nil {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
@@ -111,6 +115,7 @@ func (h *adminHandler) handleCreate(w http.ResponseWriter, r *http.Request) {
 	}
 
 	review := &Review{
+		Type:        table,
 		Slug:        slug,
 		Artist:      artist,
 		Title:       title,
@@ -121,12 +126,14 @@ func (h *adminHandler) handleCreate(w http.ResponseWriter, r *http.Request) {
 		ArticleType: articleType,
 	}
 
-	if _, err := dbCreateReview(h.db, table, review); err != nil {
+	id, err := h.store.CreateReview(table, review)
+	if err != nil {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
+	h.app.audit(r, "review.create", table, strconv.FormatInt(id, 10), "", reviewSummary(review))
 
-	http.Redirect(w, r, "/admin/", http.StatusSeeOther)
+	h.app.redirect(w, r, "/admin/")
 }
 
 func (h *adminHandler) resolveType(r *http.Request) (*ContentType, bool) {
@@ -148,19 +155,20 @@ func (h *adminHandler) handleEditForm(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	review, err := dbGetByID(h.db, ct.Table, id)
+	review, err := h.store.GetByID(ct.Table, id)
 	if err != nil {
 		http.NotFound(w, r)
 		return
 	}
 
-	h.app.render(w, "admin/form.html", map[string]any{
+	h.app.render(w, r, "admin/form.html", map[string]any{
 		"IsNew":        false,
 		"IsArticle":    ct.Table == "articles",
 		"Review":       review,
 		"ContentType":  ct,
 		"ContentTypes": contentTypeList,
 		"ArticleTypes": validArticleTypes,
+		"MaxImageSize": h.app.cfg.MaxImageSize,
 	})
 }
 
@@ -177,13 +185,14 @@ func (h *adminHandler) handleUpdate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	existing, err := dbGetByID(h.db, ct.Table, id)
+	existing, err := h.store.GetByID(ct.Table, id)
 	if err != nil {
 		http.NotFound(w, r)
 		return
 	}
 
-	if err := r.ParseMultipartForm(10 << 20); err != nil {
+	r.Body = http.MaxBytesReader(w, r.Body, int64(h.app.cfg.MaxRequestSize))
+	if err := r.ParseMultipartForm(int64(h.app.cfg.MaxRequestSize)); err != nil {
 		http.Error(w, "Request too large", http.StatusBadRequest)
 		return
 	}
@@ -204,10 +213,10 @@ func (h *adminHandler) handleUpdate(w http.ResponseWriter, r *http.Request) {
 	}
 
 	renderErr := func(msg string) {
-		h.app.render(w, "admin/form.html", map[string]any{
+		h.app.render(w, r, "admin/form.html", map[string]any{
 			"IsNew": false, "IsArticle": isArticle, "Error": msg,
 			"Review": existing, "ContentType": ct, "ContentTypes": contentTypeList,
-			"ArticleTypes": validArticleTypes,
+			"ArticleTypes": validArticleTypes, "MaxImageSize": h.app.cfg.MaxImageSize,
 		})
 	}
 
@@ -225,7 +234,7 @@ func (h *adminHandler) handleUpdate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	slug, err := uniqueSlug(h.db, ct.Table, artist, title, id)
+	slug, err := uniqueSlug(h.store, ct.Table, artist, title, id)
 	if err != nil {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
@@ -240,6 +249,7 @@ func (h *adminHandler) handleUpdate(w http.ResponseWriter, r *http.Request) {
 		coverPath = existing.CoverPath
 	}
 
+	before := *existing
 	existing.Slug = slug
 	existing.Artist = artist
 	existing.Title = title
@@ -249,12 +259,15 @@ func (h *adminHandler) handleUpdate(w http.ResponseWriter, r *http.Request) {
 	existing.CoverPath = coverPath
 	existing.ArticleType = articleType
 
-	if err := dbUpdateReview(h.db, ct.Table, existing); err != nil {
+	if err := h.store.UpdateReview(ct.Table, existing); err != nil {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
+	if changedBefore, changedAfter := diffReviews(&before, existing); changedAfter != "" {
+		h.app.audit(r, "review.update", ct.Table, strconv.FormatInt(id, 10), changedBefore, changedAfter)
+	}
 
-	http.Redirect(w, r, "/admin/", http.StatusSeeOther)
+	h.app.redirect(w, r, "/admin/")
 }
 
 func (h *adminHandler) handleDelete(w http.ResponseWriter, r *http.Request) {
@@ -270,50 +283,102 @@ func (h *adminHandler) handleDelete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := dbDeleteReview(h.db, ct.Table, id); err != nil {
+	existing, err := h.store.GetByID(ct.Table, id)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if err := h.store.DeleteReview(ct.Table, id); err != nil {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
+	h.app.audit(r, "review.delete", ct.Table, strconv.FormatInt(id, 10), reviewSummary(existing), "")
+	h.app.cards.remove(ct.Table, id)
 
-	http.Redirect(w, r, "/admin/", http.StatusSeeOther)
+	h.app.redirect(w, r, "/admin/")
 }
 
 func (h *adminHandler) handleSettings(w http.ResponseWriter, r *http.Request) {
-	settings, err := dbGetAllSettings(h.db)
+	settings, err := h.store.GetAllSettings()
 	if err != nil {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
-	h.app.render(w, "admin/settings.html", map[string]any{
-		"Settings": settings,
-	})
+	h.app.render(w, r, "admin/settings.html", h.settingsData(settings))
+}
+
+// settingsData is what the settings page shows besides the settings.
+func (h *adminHandler) settingsData(settings map[string]string) map[string]any {
+	return map[string]any{
+		"Settings":     settings,
+		"FontPairings": fontPairings,
+		"Themes":       h.app.themes.list(),
+		"Theme":        h.app.theme(settings),
+	}
 }
 
 func (h *adminHandler) handleSettingsSave(w http.ResponseWriter, r *http.Request) {
-	if err := r.ParseForm(); err != nil {
-		http.Error(w, "Bad request", http.StatusBadRequest)
+	r.Body = http.MaxBytesReader(w, r.Body, int64(h.app.cfg.MaxRequestSize))
+	if err := r.ParseMultipartForm(int64(h.app.cfg.MaxRequestSize)); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		http.Error(w, "Request too large", http.StatusBadRequest)
+		return
+	}
+
+	previous, err := h.store.GetAllSettings()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
+	var invalid error
 	for key := range allowedSettingKeys {
 		val := r.FormValue(key)
-		if val != "" {
-			if err := dbUpdateSetting(h.db, key, val); err != nil {
+		if key == SettingFontPairing && !validFontPairing(val) {
+			continue
+		}
+		if key == SettingTheme && val != "" && !h.app.themes.exists(val) {
+			invalid = fmt.Errorf("there is no theme %q", val)
+			continue
+		}
+		if key == SettingEmbedOrigins {
+			origins, err := parseEmbedOrigins(val)
+			if err != nil {
+				invalid = fmt.Errorf("embed providers were not changed: %w", err)
+				continue
+			}
+			val = strings.Join(origins, "\n")
+		}
+		if val != "" || (optionalSettingKeys[key] && r.PostForm.Has(key)) {
+			if err := h.store.UpdateSetting(key, val); err != nil {
 				http.Error(w, "Internal server error", http.StatusInternalServerError)
 				return
 			}
 		}
 	}
 
-	settings, err := dbGetAllSettings(h.db)
+	if err := h.saveFontUploads(r, previous); err != nil {
+		invalid = err
+	}
+	// Saving also picks up changes to themes on disk.
+	h.app.themes.reload()
+
+	settings, err := h.store.GetAllSettings()
 	if err != nil {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
-	h.app.render(w, "admin/settings.html", map[string]any{
-		"Settings": settings,
-		"Success":  "Settings saved successfully.",
-	})
+	if before, after := diffSettings(previous, settings); after != "" {
+		h.app.audit(r, "settings.update", "settings", "", before, after)
+	}
+
+	data := h.settingsData(settings)
+	if invalid != nil {
+		data["Error"] = "Other settings were saved, but " + invalid.Error()
+	} else {
+		data["Success"] = "Settings saved successfully."
+	}
+	h.app.render(w, r, "admin/settings.html", data)
 }
 
 var allowedImageTypes = map[string]bool{
@@ -322,6 +387,14 @@ var allowedImageTypes = map[string]bool{
 	"image/webp": true,
 }
 
+// maxImagePixels bounds covers by their dimensions as well as their file
+// size, since a small, highly compressed file can decode to gigabytes.
+const maxImagePixels = 40_000_000
+
+func tooManyPixels(cfg image.Config) bool {
+	return int64(cfg.Width)*int64(cfg.Height) > maxImagePixels
+}
+
 func (h *adminHandler) handleUpload(r *http.Request) (string, error) {
 	file, header, err := r.FormFile("cover")
 	if err != nil {
@@ -329,38 +402,35 @@ func (h *adminHandler) handleUpload(r *http.Request) (string, error) {
 	}
 	defer file.Close()
 
-	if header.Size > 5<<20 {
-		return "", fmt.Errorf("image too large (max 5MB)")
+	if max := h.app.cfg.MaxImageSize; header.Size > int64(max) {
+		return "", fmt.Errorf("image too large (max %s)", max)
 	}
 
 	contentType := header.Header.Get("Content-Type")
 	if !allowedImageTypes[contentType] {
 		return "", fmt.Errorf("unsupported image type: %s (allowed: jpeg, png, webp)", contentType)
 	}
-
-	now := time.Now()
-	dir := filepath.Join(h.uploadDir, now.Format("2006"), now.Format("01"))
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return "", fmt.Errorf("create upload dir: %w", err)
+	cfg, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return "", errors.New("the file is not a readable jpeg, png or webp image")
+	}
+	if tooManyPixels(cfg) {
+		return "", fmt.Errorf("image too large (%d×%d; max %d megapixels)", cfg.Width, cfg.Height, maxImagePixels/1_000_000)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", errors.New("could not read the image, please try again")
 	}
 
+	now := time.Now()
 	ext := filepath.Ext(header.Filename)
 	if ext == "" {
 		ext = ".jpg"
 	}
-	filename := fmt.Sprintf("%d%s", now.UnixNano(), ext)
-	fullPath := filepath.Join(dir, filename)
-
-	dst, err := os.Create(fullPath)
-	if err != nil {
-		return "", fmt.Errorf("create file: %w", err)
+	key := path.Join(now.Format("2006"), now.Format("01"), fmt.Sprintf("%d%s", now.UnixNano(), ext))
+	if err := h.uploads.Put(r.Context(), key, file, contentType); err != nil {
+		requestLogger(r).Error("save upload", "key", key, "err", err)
+		return "", errors.New("could not save the image, please try again")
 	}
-	defer dst.Close()
-
-	if _, err := io.Copy(dst, file); err != nil {
-		return "", fmt.Errorf("save file: %w", err)
-	}
-
-	relPath := filepath.Join(now.Format("2006"), now.Format("01"), filename)
-	return relPath, nil
+	metrics.uploadBytes.add(float64(header.Size))
+	return key, nil
 }
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Static files are served under fingerprinted names like style.3f9a0c1e.css
+// that change whenever the content does, so browsers can keep them forever.
+// Templates link to them with {{asset "style.css"}}. The plain names still
+// work, but are revalidated on every use.
+
+type staticFile struct {
+	data      []byte
+	etag      string
+	immutable bool
+}
+
+type staticAssets struct {
+	files map[string]*staticFile // by served name, plain and fingerprinted
+	names map[string]string      // plain name → fingerprinted name
+}
+
+var assets = loadAssets(staticFS, "static")
+
+func loadAssets(fsys fs.FS, dir string) *staticAssets {
+	a := &staticAssets{files: make(map[string]*staticFile), names: make(map[string]string)}
+	sub, err := fs.Sub(fsys, dir)
+	if err != nil {
+		panic(err)
+	}
+	fs.WalkDir(sub, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(sub, name)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		hash := hex.EncodeToString(sum[:4])
+		etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+		ext := path.Ext(name)
+		fingerprinted := strings.TrimSuffix(name, ext) + "." + hash + ext
+
+		a.files[name] = &staticFile{data: data, etag: etag}
+		a.files[fingerprinted] = &staticFile{data: data, etag: etag, immutable: true}
+		a.names[name] = fingerprinted
+		return nil
+	})
+	return a
+}
+
+// path returns the URL path of a static file, fingerprinted if it exists.
+func (a *staticAssets) path(name string) string {
+	if f, ok := a.names[name]; ok {
+		name = f
+	}
+	return "/static/" + name
+}
+
+func (a *staticAssets) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("file")
+	f, ok := a.files[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if ct := fontContentTypes[path.Ext(name)]; ct != "" {
+		w.Header().Set("Content-Type", ct)
+	} else if ct := mime.TypeByExtension(path.Ext(name)); ct != "" {
+		w.Header().Set("Content-Type", ct)
+	}
+	w.Header().Set("ETag", f.etag)
+	if f.immutable {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(f.data))
+}
+
+// siteVersion changes whenever the embedded templates or static files do.
+// It goes into page ETags so an upgrade isn't answered with 304s for pages
+// rendered by the old version.
+var siteVersion = func() string {
+	h := sha256.New()
+	for _, fsys := range []fs.FS{templateFS, staticFS} {
+		fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				data, _ := fs.ReadFile(fsys, name)
+				h.Write([]byte(name))
+				h.Write(data)
+			}
+			return nil
+		})
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}()
+
+// pageETag builds a weak ETag for a rendered page from whatever it was
+// rendered from: the site version, the settings, and parts identifying the
+// theme and the content (ids and update times).
+func pageETag(settings map[string]string, parts ...string) string {
+	h := sha256.New()
+	h.Write([]byte(siteVersion))
+	keys := make([]string, 0, len(settings))
+	for k := range settings {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		h.Write([]byte("\x00" + k + "=" + settings[k]))
+	}
+	for _, p := range parts {
+		h.Write([]byte("\x00" + p))
+	}
+	return `W/"` + hex.EncodeToString(h.Sum(nil)[:12]) + `"`
+}
+
+// setValidators marks a page as revalidate-on-use and reports whether the
+// client's copy is still current, in which case it has answered 304.
+func setValidators(w http.ResponseWriter, r *http.Request, etag string, modTime time.Time) bool {
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("ETag", etag)
+	if !modTime.IsZero() {
+		w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+	if notModified(r, etag, modTime) {
+		writeNotModified(w)
+		return true
+	}
+	return false
+}
+
+// notModified evaluates If-None-Match, or If-Modified-Since when there is
+// none, for a GET or HEAD.
+func notModified(r *http.Request, etag string, modTime time.Time) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || weakETag(candidate) == weakETag(etag) {
+				return true
+			}
+		}
+		return false
+	}
+	if modTime.IsZero() {
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	return err == nil && !modTime.Truncate(time.Second).After(since)
+}
+
+// weakETag strips the weak marker, for the weak comparison If-None-Match
+// uses. Compressed responses also carry a marked version of the ETag.
+func weakETag(etag string) string {
+	return strings.TrimPrefix(etag, "W/")
+}
+
+// writeNotModified answers 304, dropping headers that describe a body.
+func writeNotModified(w http.ResponseWriter) {
+	h := w.Header()
+	delete(h, "Content-Type")
+	delete(h, "Content-Length")
+	// Browsers merge a 304's headers into their stored copy, whose inline
+	// styles carry the nonce of the policy it came with.
+	delete(h, "Content-Security-Policy")
+	w.WriteHeader(http.StatusNotModified)
+}
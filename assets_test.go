@@ -0,0 +1,141 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func (s *testSite) getWith(path string, header map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	return s.do(req)
+}
+
+func TestStaticAssets(t *testing.T) {
+	s := newTestSite(t).withAdmin("admin")
+
+	href := regexp.MustCompile(`href="(/static/style\.[0-9a-f]{8}\.css)"`).FindStringSubmatch(s.get("/").Body.String())
+	if href == nil {
+		t.Fatal("page does not link a fingerprinted stylesheet")
+	}
+	rec := s.get(href[1])
+	expectStatus(t, rec, http.StatusOK)
+	if cc := rec.Header().Get("Cache-Control"); !strings.Contains(cc, "immutable") {
+		t.Errorf("fingerprinted Cache-Control = %q", cc)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/css") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+
+	plain := s.get("/static/style.css")
+	expectStatus(t, plain, http.StatusOK)
+	if cc := plain.Header().Get("Cache-Control"); cc != "no-cache" {
+		t.Errorf("plain Cache-Control = %q", cc)
+	}
+	etag := plain.Header().Get("ETag")
+	expectStatus(t, s.getWith("/static/style.css", map[string]string{"If-None-Match": etag}), http.StatusNotModified)
+
+	expectStatus(t, s.get("/static/style.00000000.css"), http.StatusNotFound)
+	expectStatus(t, s.get("/static/"), http.StatusNotFound)
+}
+
+func TestReviewConditionalGet(t *testing.T) {
+	for _, pages := range []bool{false, true} {
+		t.Run("pages="+strconv.FormatBool(pages), func(t *testing.T) {
+			s := newTestSite(t, func(c *config) { c.Cache.Pages = pages }).withAdmin("admin")
+			hourAgo := time.Now().Add(-time.Hour)
+			s.store.ImportReview("albums", &Review{Slug: "boards-geogaddi", Artist: "Boards", Title: "Geogaddi",
+				Rating: 9.1, CreatedAt: hourAgo, UpdatedAt: hourAgo})
+			const path = "/music/albums/boards-geogaddi"
+
+			rec := s.get(path)
+			expectStatus(t, rec, http.StatusOK)
+			etag, lastModified := rec.Header().Get("ETag"), rec.Header().Get("Last-Modified")
+			if etag == "" || lastModified == "" {
+				t.Fatalf("ETag = %q, Last-Modified = %q", etag, lastModified)
+			}
+
+			rec = s.getWith(path, map[string]string{"If-None-Match": etag})
+			expectStatus(t, rec, http.StatusNotModified)
+			if rec.Body.Len() != 0 {
+				t.Error("304 has a body")
+			}
+			expectStatus(t, s.getWith(path, map[string]string{"If-Modified-Since": lastModified}), http.StatusNotModified)
+			expectStatus(t, s.getWith(path, map[string]string{"If-None-Match": `W/"stale"`}), http.StatusOK)
+
+			// Settings are part of the page, so changing them moves both on.
+			// Last-Modified counts whole seconds, so wait for the next one.
+			nextSecond()
+			s.login("admin")
+			s.postForm("/admin/settings", map[string][]string{SettingSiteTitle: {"Needle Drop"}})
+			expectStatus(t, s.getWith(path, map[string]string{"If-None-Match": etag}), http.StatusOK)
+			expectStatus(t, s.getWith(path, map[string]string{"If-Modified-Since": lastModified}), http.StatusOK)
+			lastModified = s.get(path).Header().Get("Last-Modified")
+			expectStatus(t, s.getWith(path, map[string]string{"If-Modified-Since": lastModified}), http.StatusNotModified)
+
+			// So does editing the review.
+			nextSecond()
+			r, _ := s.store.GetBySlug("albums", "boards-geogaddi")
+			expectRedirect(t, s.postMultipart("/admin/albums/"+strconv.FormatInt(r.ID, 10), map[string]string{
+				"artist": "Boards", "title": "Geogaddi", "rating": "9.1", "body": "Edited.",
+			}), "/admin/")
+			expectStatus(t, s.getWith(path, map[string]string{"If-Modified-Since": lastModified}), http.StatusOK)
+		})
+	}
+}
+
+// nextSecond sleeps until the wall clock reaches the next whole second.
+func nextSecond() {
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+}
+
+func TestCompression(t *testing.T) {
+	s := newTestSite(t).withAdmin("admin")
+	s.store.CreateReview("albums", &Review{Slug: "boards-geogaddi", Artist: "Boards", Title: "Geogaddi", Rating: 9.1})
+
+	rec := s.getWith("/", map[string]string{"Accept-Encoding": "gzip, br"})
+	expectStatus(t, rec, http.StatusOK)
+	if rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Content-Encoding = %q", rec.Header().Get("Content-Encoding"))
+	}
+	if !strings.Contains(rec.Header().Get("Vary"), "Accept-Encoding") {
+		t.Error("no Vary: Accept-Encoding")
+	}
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(zr)
+	if !strings.Contains(string(body), "Geogaddi") {
+		t.Errorf("decompressed body:\n%s", body)
+	}
+
+	// The ETag of the gzipped page still validates.
+	etag := rec.Header().Get("ETag")
+	expectStatus(t, s.getWith("/", map[string]string{"Accept-Encoding": "gzip", "If-None-Match": etag}), http.StatusNotModified)
+
+	// Static files keep working through a 304 too.
+	css := s.getWith("/static/style.css", map[string]string{"Accept-Encoding": "gzip"})
+	if css.Header().Get("Content-Encoding") != "gzip" || !strings.HasPrefix(css.Header().Get("ETag"), "W/") {
+		t.Errorf("stylesheet Content-Encoding = %q, ETag = %q", css.Header().Get("Content-Encoding"), css.Header().Get("ETag"))
+	}
+	expectStatus(t, s.getWith("/static/style.css", map[string]string{"Accept-Encoding": "gzip", "If-None-Match": css.Header().Get("ETag")}), http.StatusNotModified)
+
+	for _, ae := range []string{"", "identity", "gzip;q=0", "br"} {
+		if rec := s.getWith("/", map[string]string{"Accept-Encoding": ae}); rec.Header().Get("Content-Encoding") != "" {
+			t.Errorf("Accept-Encoding %q got Content-Encoding %q", ae, rec.Header().Get("Content-Encoding"))
+		}
+	}
+	if rec := s.getWith("/healthz", map[string]string{"Accept-Encoding": "gzip"}); rec.Header().Get("Content-Encoding") != "" {
+		t.Error("tiny response was compressed")
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const auditPageSize = 100
+
+// audit appends an entry to the audit log, attributed to the logged-in user
+// if there is one. A failed write is logged but never blocks the action.
+func (app *application) audit(r *http.Request, action, targetType, targetID, before, after string) {
+	e := &AuditEntry{
+		CreatedAt:  time.Now().UTC(),
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+		Before:     before,
+		After:      after,
+		IP:         clientIP(r),
+	}
+	if s := currentSession(r); s != nil {
+		e.UserID = s.UserID
+		e.Username = s.Username
+	}
+	if err := app.store.InsertAudit(e); err != nil {
+		requestLogger(r).Error("write audit entry", "action", action, "err", err)
+	}
+}
+
+// reviewFields flattens the audited fields of a review. The body is recorded
+// by length only; the full text would bloat the log.
+func reviewFields(r *Review) [][2]string {
+	fields := [][2]string{
+		{"slug", r.Slug},
+		{"artist", r.Artist},
+		{"title", r.Title},
+		{"subheader", r.Subheader},
+	}
+	if r.Type == "articles" {
+		fields = append(fields, [2]string{"article_type", r.ArticleType})
+	} else {
+		fields = append(fields, [2]string{"rating", fmt.Sprintf("%.1f", r.Rating)})
+	}
+	return append(fields,
+		[2]string{"cover", r.CoverPath},
+		[2]string{"body", fmt.Sprintf("%d chars", len(r.Body))},
+	)
+}
+
+func reviewSummary(r *Review) string {
+	var parts []string
+	for _, f := range reviewFields(r) {
+		if f[1] != "" {
+			parts = append(parts, fmt.Sprintf("%s=%q", f[0], f[1]))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// diffReviews summarises only the fields that changed between two versions
+// of the same review. Both results are empty if nothing did.
+func diffReviews(old, cur *Review) (before, after string) {
+	oldFields, curFields := reviewFields(old), reviewFields(cur)
+	var b, a []string
+	for i, f := range curFields {
+		if f == oldFields[i] {
+			continue
+		}
+		b = append(b, fmt.Sprintf("%s=%q", f[0], oldFields[i][1]))
+		a = append(a, fmt.Sprintf("%s=%q", f[0], f[1]))
+	}
+	// Edits that keep the length the same don't show up in the char count.
+	if old.Body != cur.Body && len(old.Body) == len(cur.Body) {
+		b = append(b, "body=edited")
+		a = append(a, "body=edited")
+	}
+	return strings.Join(b, " "), strings.Join(a, " ")
+}
+
+func diffSettings(old, cur map[string]string) (before, after string) {
+	keys := make([]string, 0, len(cur))
+	for k := range cur {
+		if old[k] != cur[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var b, a []string
+	for _, k := range keys {
+		b = append(b, fmt.Sprintf("%s=%q", k, old[k]))
+		a = append(a, fmt.Sprintf("%s=%q", k, cur[k]))
+	}
+	return strings.Join(b, " "), strings.Join(a, " ")
+}
+
+// auditFilter narrows audit log listings. Zero values match everything.
+type auditFilter struct {
+	Username   string
+	Action     string
+	TargetType string
+	From       time.Time // inclusive
+	To         time.Time // exclusive
+}
+
+// parseAuditFilter reads filters from the query string. Dates are whole days,
+// and the "to" day is inclusive.
+func parseAuditFilter(q url.Values) auditFilter {
+	f := auditFilter{
+		Username:   strings.TrimSpace(q.Get("user")),
+		Action:     q.Get("action"),
+		TargetType: q.Get("target_type"),
+	}
+	if t, err := time.Parse("2006-01-02", q.Get("from")); err == nil {
+		f.From = t
+	}
+	if t, err := time.Parse("2006-01-02", q.Get("to")); err == nil {
+		f.To = t.AddDate(0, 0, 1)
+	}
+	return f
+}
+
+func (f auditFilter) where() (string, []any) {
+	var conds []string
+	var args []any
+	if f.Username != "" {
+		conds = append(conds, "username = ?")
+		args = append(args, f.Username)
+	}
+	if f.Action != "" {
+		conds = append(conds, "action = ?")
+		args = append(args, f.Action)
+	}
+	if f.TargetType != "" {
+		conds = append(conds, "target_type = ?")
+		args = append(args, f.TargetType)
+	}
+	if !f.From.IsZero() {
+		conds = append(conds, "created_at >= ?")
+		args = append(args, f.From)
+	}
+	if !f.To.IsZero() {
+		conds = append(conds, "created_at < ?")
+		args = append(args, f.To)
+	}
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+func (h *adminHandler) handleAudit(w http.ResponseWriter, r *http.Request) {
+	filter := parseAuditFilter(r.URL.Query())
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+
+	entries, err := h.store.ListAudit(filter, auditPageSize+1, (page-1)*auditPageSize)
+	if err != nil {
+		requestLogger(r).Error("list audit log", "err", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	hasMore := len(entries) > auditPageSize
+	if hasMore {
+		entries = entries[:auditPageSize]
+	}
+
+	actions, err := h.store.ListAuditActions()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Query string without the page number, for building pager and export links.
+	q := r.URL.Query()
+	q.Del("page")
+
+	h.app.render(w, r, "admin/audit.html", map[string]any{
+		"Entries":  entries,
+		"Actions":  actions,
+		"Filter":   r.URL.Query(),
+		"Query":    q.Encode(),
+		"Page":     page,
+		"PrevPage": page - 1,
+		"NextPage": page + 1,
+		"HasMore":  hasMore,
+	})
+}
+
+func (h *adminHandler) handleAuditCSV(w http.ResponseWriter, r *http.Request) {
+	entries, err := h.store.ListAudit(parseAuditFilter(r.URL.Query()), 0, 0)
+	if err != nil {
+		requestLogger(r).Error("export audit log", "err", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf(`attachment; filename="ditchfork-audit-%s.csv"`, time.Now().Format("20060102")))
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"time", "user", "action", "target_type", "target_id", "before", "after", "ip"})
+	for _, e := range entries {
+		cw.Write([]string{
+			e.CreatedAt.UTC().Format(time.RFC3339), csvText(e.Username), e.Action, e.TargetType, csvText(e.TargetID),
+			csvText(e.Before), csvText(e.After), e.IP,
+		})
+	}
+	cw.Flush()
+}
+
+// csvText keeps a cell that a spreadsheet would take for a formula, such as a
+// review titled "=HYPERLINK(...)", as text by prefixing a quote.
+func csvText(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
@@ -1,223 +1,281 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
-	"database/sql"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
-	"strings"
-	"sync"
+	"strconv"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
-const sessionCookieName = "ditchfork_session"
+const (
+	sessionCookieName = "ditchfork_session"
 
-// ---------- rate limiter ----------
-
-type loginAttempt struct {
-	failures int
-	lastFail time.Time
-}
+	// last_seen_at is only rewritten when it is older than this, so browsing
+	// the admin doesn't turn every page view into a DB write.
+	sessionTouchInterval = time.Minute
+)
 
-type loginLimiter struct {
-	mu       sync.Mutex
-	attempts map[string]*loginAttempt
-}
+type contextKey string
 
-func newLoginLimiter() *loginLimiter {
-	ll := &loginLimiter{attempts: make(map[string]*loginAttempt)}
-	// clean up stale entries every 30 minutes
-	go func() {
-		for range time.Tick(30 * time.Minute) {
-			ll.mu.Lock()
-			for ip, a := range ll.attempts {
-				if time.Since(a.lastFail) > 30*time.Minute {
-					delete(ll.attempts, ip)
-				}
-			}
-			ll.mu.Unlock()
-		}
-	}()
-	return ll
-}
+const sessionContextKey contextKey = "session"
 
-// cooldown returns how long the IP must wait, or 0 if they can try now.
-func (ll *loginLimiter) cooldown(ip string) time.Duration {
-	ll.mu.Lock()
-	defer ll.mu.Unlock()
-	a, ok := ll.attempts[ip]
-	if !ok || a.failures < 3 {
-		return 0
-	}
-	// exponential: 1s, 2s, 4s, 8s … capped at 15 min
-	shift := a.failures - 3
-	if shift > 9 {
-		shift = 9
-	}
-	wait := time.Second * (1 << shift)
-	elapsed := time.Since(a.lastFail)
-	if elapsed >= wait {
-		return 0
-	}
-	return wait - elapsed
+// hashToken returns the form a session token is stored in. The cookie carries
+// the raw token; a leaked database alone can't be replayed as a login.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
 }
 
-func (ll *loginLimiter) recordFailure(ip string) {
-	ll.mu.Lock()
-	defer ll.mu.Unlock()
-	a, ok := ll.attempts[ip]
-	if !ok {
-		a = &loginAttempt{}
-		ll.attempts[ip] = a
-	}
-	a.failures++
-	a.lastFail = time.Now()
-}
-
-func (ll *loginLimiter) reset(ip string) {
-	ll.mu.Lock()
-	defer ll.mu.Unlock()
-	delete(ll.attempts, ip)
+// currentSession returns the session attached by requireAuth.
+func currentSession(r *http.Request) *Session {
+	s, _ := r.Context().Value(sessionContextKey).(*Session)
+	return s
 }
 
 type authHandler struct {
-	db      *sql.DB
+	store   Store
 	app     *application
 	limiter *loginLimiter
 }
 
 func newAuthHandler(app *application) *authHandler {
-	return &authHandler{db: app.db, app: app, limiter: newLoginLimiter()}
-}
-
-func clientIP(r *http.Request) string {
-	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
-		return strings.SplitN(fwd, ",", 2)[0]
-	}
-	// strip port
-	addr := r.RemoteAddr
-	if i := strings.LastIndex(addr, ":"); i != -1 {
-		return addr[:i]
-	}
-	return addr
+	return &authHandler{store: app.store, app: app, limiter: newLoginLimiter(app.store, app.cfg.loginPolicy())}
 }
 
 func (h *authHandler) handleLoginForm(w http.ResponseWriter, r *http.Request) {
-	h.app.render(w, "admin/login.html", nil)
+	data := map[string]any{}
+	if r.URL.Query().Get("reset") == "1" {
+		data["Success"] = "Password updated. Log in with your new password."
+	}
+	h.app.render(w, r, "admin/login.html", data)
 }
 
 func (h *authHandler) handleLogin(w http.ResponseWriter, r *http.Request) {
 	ip := clientIP(r)
+	username := r.FormValue("username")
+	password := r.FormValue("password")
 
-	if wait := h.limiter.cooldown(ip); wait > 0 {
-		secs := int(wait.Seconds()) + 1
-		msg := fmt.Sprintf("Too many attempts. Try again in %ds.", secs)
-		log.Printf("login rate-limited: ip=%s wait=%s", ip, wait)
-		h.app.render(w, "admin/login.html", map[string]any{"Error": msg})
+	if msg := h.throttled(r, ip, username); msg != "" {
+		h.app.render(w, r, "admin/login.html", map[string]any{"Error": msg})
 		return
 	}
 
-	username := r.FormValue("username")
-	password := r.FormValue("password")
-
-	user, err := dbGetUserByUsername(h.db, username)
+	user, err := h.store.GetUserByUsername(username)
 	if err != nil {
-		h.limiter.recordFailure(ip)
-		log.Printf("login failed: ip=%s user=%q (not found)", ip, username)
-		h.app.render(w, "admin/login.html", map[string]any{"Error": "Invalid credentials"})
+		h.loginFailed(r, ip, username, "not found")
+		h.app.render(w, r, "admin/login.html", map[string]any{"Error": "Invalid credentials"})
 		return
 	}
 
 	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
-		h.limiter.recordFailure(ip)
-		log.Printf("login failed: ip=%s user=%q (bad password)", ip, username)
-		h.app.render(w, "admin/login.html", map[string]any{"Error": "Invalid credentials"})
+		h.loginFailed(r, ip, username, "bad password")
+		h.app.render(w, r, "admin/login.html", map[string]any{"Error": "Invalid credentials"})
 		return
 	}
 
-	h.limiter.reset(ip)
-	log.Printf("login success: ip=%s user=%q", ip, username)
+	h.limiter.reset(ip, username)
+	requestLogger(r).Info("login success", "ip", ip, "user", username)
 
-	tokenBytes := make([]byte, 32)
-	if _, err := rand.Read(tokenBytes); err != nil {
+	if err := h.startSession(w, r, user); err != nil {
+		requestLogger(r).Error("create session", "err", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
+
+	h.app.redirect(w, r, "/admin/")
+}
+
+// throttled returns a user-facing message if ip is cooling down or username
+// is locked, so a password may not be checked yet, or "" if it may.
+func (h *authHandler) throttled(r *http.Request, ip, username string) string {
+	if wait := h.limiter.cooldown(ip); wait > 0 {
+		requestLogger(r).Warn("login rate-limited", "ip", ip, "wait", wait.Round(time.Millisecond))
+		return fmt.Sprintf("Too many attempts. Try again in %ds.", int(wait.Seconds())+1)
+	}
+	if wait := h.limiter.lockedFor(username); wait > 0 {
+		requestLogger(r).Warn("login refused, account locked", "ip", ip, "user", username, "wait", wait.Round(time.Second))
+		return fmt.Sprintf("This account is temporarily locked. Try again in %d min.", int(wait.Minutes())+1)
+	}
+	return ""
+}
+
+// loginFailed records a failed attempt and audits the account lockout it may
+// trigger. Unknown usernames are counted too, so lockouts don't reveal which
+// accounts exist.
+func (h *authHandler) loginFailed(r *http.Request, ip, username, reason string) {
+	requestLogger(r).Warn("login failed", "ip", ip, "user", username, "reason", reason)
+	locked, err := h.limiter.recordFailure(ip, username)
+	if err != nil {
+		requestLogger(r).Error("record login failure", "err", err)
+		return
+	}
+	if locked {
+		p := h.limiter.policy
+		requestLogger(r).Warn("account locked", "user", username, "for", p.LockoutDuration, "failures", p.LockoutThreshold)
+		h.app.audit(r, "user.lockout", "user", username, "",
+			fmt.Sprintf("locked for %s after %d failed logins", p.LockoutDuration, p.LockoutThreshold))
+	}
+}
+
+// startSession creates a new session for user and sets the session cookie.
+func (h *authHandler) startSession(w http.ResponseWriter, r *http.Request, user *User) error {
+	tokenBytes := make([]byte, 32)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return err
+	}
 	token := hex.EncodeToString(tokenBytes)
 
+	userAgent := r.UserAgent()
+	if len(userAgent) > 256 {
+		userAgent = userAgent[:256]
+	}
+	now := time.Now().UTC()
 	session := &Session{
-		Token:     token,
-		UserID:    user.ID,
-		ExpiresAt: time.Now().Add(24 * time.Hour),
+		TokenHash:  hashToken(token),
+		UserID:     user.ID,
+		IP:         clientIP(r),
+		UserAgent:  userAgent,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(h.app.cfg.SessionLifetime.Duration),
 	}
-	if err := dbCreateSession(h.db, session); err != nil {
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
+	if err := h.store.CreateSession(session); err != nil {
+		return err
 	}
 
 	http.SetCookie(w, &http.Cookie{
 		Name:     sessionCookieName,
 		Value:    token,
-		Path:     "/admin",
+		Path:     h.app.url("/admin"),
 		HttpOnly: true,
+		Secure:   isHTTPS(r),
 		SameSite: http.SameSiteStrictMode,
-		MaxAge:   86400,
+		MaxAge:   int(h.app.cfg.SessionLifetime.Seconds()),
 	})
-
-	http.Redirect(w, r, "/admin/", http.StatusSeeOther)
+	return nil
 }
 
-func (h *authHandler) handleLogout(w http.ResponseWriter, r *http.Request) {
-	cookie, err := r.Cookie(sessionCookieName)
-	if err == nil {
-		dbDeleteSession(h.db, cookie.Value)
-	}
-
+func (h *authHandler) clearSessionCookie(w http.ResponseWriter, r *http.Request) {
 	http.SetCookie(w, &http.Cookie{
 		Name:     sessionCookieName,
 		Value:    "",
-		Path:     "/admin",
+		Path:     h.app.url("/admin"),
 		HttpOnly: true,
+		Secure:   isHTTPS(r),
 		SameSite: http.SameSiteStrictMode,
 		MaxAge:   -1,
 	})
+}
+
+func (h *authHandler) handleLogout(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err == nil {
+		h.store.DeleteSession(hashToken(cookie.Value))
+	}
+
+	h.clearSessionCookie(w, r)
+	h.app.redirect(w, r, "/admin/login")
+}
+
+func (h *authHandler) handleSessions(w http.ResponseWriter, r *http.Request) {
+	sessions, err := h.store.ListSessions()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	h.app.render(w, r, "admin/sessions.html", map[string]any{
+		"Sessions":  sessions,
+		"CurrentID": currentSession(r).ID,
+	})
+}
 
-	http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
+func (h *authHandler) handleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if err := h.store.DeleteSessionByID(id); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	requestLogger(r).Info("session revoked", "session_id", id, "by", currentSession(r).Username)
+	h.app.audit(r, "session.revoke", "session", strconv.FormatInt(id, 10), "", "")
+
+	if id == currentSession(r).ID {
+		h.clearSessionCookie(w, r)
+		h.app.redirect(w, r, "/admin/login")
+		return
+	}
+	h.app.redirect(w, r, "/admin/sessions")
+}
+
+// handleRevokeAll logs the current user out on every device, this one included.
+func (h *authHandler) handleRevokeAll(w http.ResponseWriter, r *http.Request) {
+	session := currentSession(r)
+	if err := h.store.DeleteUserSessions(session.UserID); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	requestLogger(r).Info("all sessions revoked", "user", session.Username)
+	h.app.audit(r, "session.revoke_all", "user", session.Username, "", "")
+
+	h.clearSessionCookie(w, r)
+	h.app.redirect(w, r, "/admin/login")
 }
 
 func (h *authHandler) requireAuth(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		cookie, err := r.Cookie(sessionCookieName)
 		if err != nil {
-			http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
+			h.app.redirect(w, r, "/admin/login")
 			return
 		}
 
-		session, err := dbGetSession(h.db, cookie.Value)
+		tokenHash := hashToken(cookie.Value)
+		session, err := h.store.GetSession(tokenHash)
 		if err != nil || time.Now().After(session.ExpiresAt) {
 			if err == nil {
-				dbDeleteSession(h.db, cookie.Value)
+				h.store.DeleteSession(tokenHash)
 			}
-			http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
+			h.app.redirect(w, r, "/admin/login")
 			return
 		}
 
-		next(w, r)
+		if now := time.Now().UTC(); now.Sub(session.LastSeenAt) > sessionTouchInterval {
+			if err := h.store.TouchSession(session.ID, now); err != nil {
+				requestLogger(r).Error("touch session", "err", err)
+			}
+			session.LastSeenAt = now
+		}
+
+		setRequestUser(r, session.Username)
+		next(w, r.WithContext(context.WithValue(r.Context(), sessionContextKey, session)))
 	}
 }
 
-func startSessionCleanup(db *sql.DB) {
-	go func() {
-		ticker := time.NewTicker(1 * time.Hour)
-		defer ticker.Stop()
-		for range ticker.C {
-			if err := dbCleanExpiredSessions(db); err != nil {
-				log.Printf("session cleanup error: %v", err)
+func runSessionCleanup(ctx context.Context, store Store) {
+	ticker := time.NewTicker(1 * time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := store.CleanExpiredSessions(); err != nil {
+				slog.Error("session cleanup", "err", err)
+			}
+			if err := store.CleanExpiredPasswordResets(); err != nil {
+				slog.Error("password reset cleanup", "err", err)
 			}
 		}
-	}()
+	}
 }
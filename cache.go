@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"maps"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// cachedStore keeps the settings and whether setup is done in memory, since
+// every request needs both. Writes made through it take effect immediately;
+// the TTL bounds how long a change made by another process, such as the CLI,
+// goes unseen.
+type cachedStore struct {
+	Store
+	site     string
+	ttl      time.Duration
+	onChange func() // called after reviews or settings change
+
+	mu         sync.Mutex
+	gen        uint64 // bumped on every invalidation
+	settings   map[string]string
+	settingsAt time.Time
+	usersAt    time.Time // when users were last seen to exist; zero if unknown
+	changedAt  time.Time // last settings change, or when the process started
+}
+
+func newCachedStore(store Store, site string, ttl time.Duration) *cachedStore {
+	return &cachedStore{Store: store, site: site, ttl: ttl, changedAt: time.Now()}
+}
+
+// settingsChanged is when the settings, including the theme, last changed.
+// Changes from before the process started aren't known, so it is never
+// earlier than that.
+func (c *cachedStore) settingsChanged() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.changedAt
+}
+
+func (c *cachedStore) GetAllSettings() (map[string]string, error) {
+	c.mu.Lock()
+	if c.settings != nil && time.Since(c.settingsAt) < c.ttl {
+		settings := maps.Clone(c.settings)
+		c.mu.Unlock()
+		metrics.cacheHits.add(1, c.site, "settings")
+		return settings, nil
+	}
+	gen := c.gen
+	c.mu.Unlock()
+	metrics.cacheMisses.add(1, c.site, "settings")
+
+	settings, err := c.Store.GetAllSettings()
+	if err != nil {
+		return settings, err
+	}
+	c.mu.Lock()
+	if c.gen == gen {
+		c.settings, c.settingsAt = maps.Clone(settings), time.Now()
+	}
+	c.mu.Unlock()
+	return settings, nil
+}
+
+// HasUsers only caches a yes. Until setup is done every request asks the
+// database, so a user added with 'ditchfork user add' closes setup at once.
+func (c *cachedStore) HasUsers() (bool, error) {
+	c.mu.Lock()
+	known := !c.usersAt.IsZero() && time.Since(c.usersAt) < c.ttl
+	gen := c.gen
+	c.mu.Unlock()
+	if known {
+		metrics.cacheHits.add(1, c.site, "setup")
+		return true, nil
+	}
+	metrics.cacheMisses.add(1, c.site, "setup")
+
+	has, err := c.Store.HasUsers()
+	if err == nil && has {
+		c.mu.Lock()
+		if c.gen == gen {
+			c.usersAt = time.Now()
+		}
+		c.mu.Unlock()
+	}
+	return has, err
+}
+
+func (c *cachedStore) invalidate(content bool) {
+	c.mu.Lock()
+	c.gen++
+	c.settings = nil
+	c.usersAt = time.Time{}
+	c.mu.Unlock()
+	if content && c.onChange != nil {
+		c.onChange()
+	}
+}
+
+func (c *cachedStore) DeleteUser(id int64) error {
+	defer c.invalidate(false)
+	return c.Store.DeleteUser(id)
+}
+
+func (c *cachedStore) UpdateSetting(key, value string) error {
+	defer c.invalidate(true)
+	defer func() {
+		c.mu.Lock()
+		c.changedAt = time.Now()
+		c.mu.Unlock()
+	}()
+	return c.Store.UpdateSetting(key, value)
+}
+
+func (c *cachedStore) CreateReview(table string, r *Review) (int64, error) {
+	defer c.invalidate(true)
+	return c.Store.CreateReview(table, r)
+}
+
+func (c *cachedStore) UpdateReview(table string, r *Review) error {
+	defer c.invalidate(true)
+	return c.Store.UpdateReview(table, r)
+}
+
+func (c *cachedStore) ImportReview(table string, r *Review) error {
+	defer c.invalidate(true)
+	return c.Store.ImportReview(table, r)
+}
+
+func (c *cachedStore) DeleteReview(table string, id int64) error {
+	defer c.invalidate(true)
+	return c.Store.DeleteReview(table, id)
+}
+
+// pageCache holds rendered public pages by URL. It is emptied whenever a
+// review or setting changes, and entries expire after the TTL. When it is
+// full, expired pages make room first, then the least recently used one.
+type pageCache struct {
+	site   string
+	ttl    time.Duration
+	max    int
+	origin bool // pages carry absolute URLs built from the request's host
+
+	mu    sync.Mutex
+	gen   uint64
+	pages map[string]*cachedPage
+}
+
+type cachedPage struct {
+	header http.Header
+	body   []byte
+	nonce  string // the request's CSP nonce, which the body carries
+	at     time.Time
+	used   time.Time // last served, for eviction
+}
+
+func newPageCache(site string, ttl time.Duration, max int, origin bool) *pageCache {
+	return &pageCache{site: site, ttl: ttl, max: max, origin: origin, pages: make(map[string]*cachedPage)}
+}
+
+// key names the page a request is for. Only the path and the tab parameter
+// change what is rendered, so other query strings share an entry, and the
+// host only matters when there is no public URL to build links from.
+func (p *pageCache) key(r *http.Request) string {
+	key := r.URL.Path + "?tab=" + r.URL.Query().Get("tab")
+	if p.origin {
+		key = requestOrigin(r) + key
+	}
+	return key
+}
+
+// makeRoom evicts pages until there is space for one more. p.mu must be held.
+func (p *pageCache) makeRoom() {
+	for key, page := range p.pages {
+		if time.Since(page.at) >= p.ttl {
+			delete(p.pages, key)
+		}
+	}
+	for len(p.pages) >= p.max {
+		var oldest string
+		for key, page := range p.pages {
+			if oldest == "" || page.used.Before(p.pages[oldest].used) {
+				oldest = key
+			}
+		}
+		delete(p.pages, oldest)
+	}
+}
+
+func (p *pageCache) clear() {
+	p.mu.Lock()
+	p.gen++
+	clear(p.pages)
+	p.mu.Unlock()
+}
+
+// wrap serves next from the cache. Only successful GETs are stored.
+func (p *pageCache) wrap(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := p.key(r)
+		p.mu.Lock()
+		page, ok := p.pages[key]
+		if ok && time.Since(page.at) >= p.ttl {
+			delete(p.pages, key)
+			ok = false
+		}
+		if ok {
+			page.used = time.Now()
+		}
+		gen := p.gen
+		p.mu.Unlock()
+		if ok {
+			metrics.cacheHits.add(1, p.site, "pages")
+			lastModified, _ := http.ParseTime(page.header.Get("Last-Modified"))
+			if etag := page.header.Get("ETag"); etag != "" && notModified(r, etag, lastModified) {
+				page.writeHeader(w)
+				writeNotModified(w)
+				return
+			}
+			page.write(w, http.StatusOK, requestNonce(r))
+			return
+		}
+		metrics.cacheMisses.add(1, p.site, "pages")
+
+		rec := &pageRecorder{header: make(http.Header)}
+		next(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		now := time.Now()
+		page = &cachedPage{header: rec.header, body: rec.body.Bytes(), nonce: requestNonce(r), at: now, used: now}
+		if page.header.Get("Content-Type") == "" {
+			page.header.Set("Content-Type", http.DetectContentType(page.body))
+		}
+		page.write(w, rec.status, page.nonce)
+
+		if r.Method == http.MethodGet && rec.status == http.StatusOK {
+			p.mu.Lock()
+			if p.gen == gen {
+				if _, ok := p.pages[key]; !ok && len(p.pages) >= p.max {
+					p.makeRoom()
+				}
+				p.pages[key] = page
+			}
+			p.mu.Unlock()
+		}
+	}
+}
+
+func (page *cachedPage) writeHeader(w http.ResponseWriter) {
+	for k, v := range page.header {
+		w.Header()[k] = slices.Clone(v)
+	}
+}
+
+// write sends the page, with its nonce replaced by the one the current
+// request's Content-Security-Policy allows.
+func (page *cachedPage) write(w http.ResponseWriter, status int, nonce string) {
+	page.writeHeader(w)
+	w.WriteHeader(status)
+	body := page.body
+	if page.nonce != "" && nonce != page.nonce {
+		body = bytes.ReplaceAll(body, []byte(page.nonce), []byte(nonce))
+	}
+	w.Write(body)
+}
+
+// pageRecorder buffers a response so it can be both sent and cached.
+type pageRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *pageRecorder) Header() http.Header { return r.header }
+
+func (r *pageRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *pageRecorder) Write(b []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return r.body.Write(b)
+}
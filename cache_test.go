@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCachedStoreSettings(t *testing.T) {
+	mem := newMemStore()
+	c := newCachedStore(mem, "test", time.Hour)
+
+	settings, _ := c.GetAllSettings()
+	if settings[SettingSiteTitle] != settingDefaults[SettingSiteTitle] {
+		t.Fatalf("site title = %q", settings[SettingSiteTitle])
+	}
+	settings[SettingSiteTitle] = "mutated by caller"
+
+	// A write behind the cache's back isn't seen until the TTL runs out...
+	mem.UpdateSetting(SettingSiteTitle, "Elsewhere")
+	if settings, _ := c.GetAllSettings(); settings[SettingSiteTitle] != settingDefaults[SettingSiteTitle] {
+		t.Errorf("cached site title = %q, want the default", settings[SettingSiteTitle])
+	}
+
+	// ...but one through it is.
+	c.UpdateSetting(SettingSiteTitle, "Needle Drop")
+	if settings, _ := c.GetAllSettings(); settings[SettingSiteTitle] != "Needle Drop" {
+		t.Errorf("site title after update = %q", settings[SettingSiteTitle])
+	}
+
+	c.ttl = 0
+	mem.UpdateSetting(SettingSiteTitle, "Elsewhere")
+	if settings, _ := c.GetAllSettings(); settings[SettingSiteTitle] != "Elsewhere" {
+		t.Errorf("site title after expiry = %q", settings[SettingSiteTitle])
+	}
+}
+
+func TestCachedStoreHasUsers(t *testing.T) {
+	mem := newMemStore()
+	c := newCachedStore(mem, "test", time.Hour)
+
+	if has, _ := c.HasUsers(); has {
+		t.Fatal("empty store has users")
+	}
+	// "No users" is never cached, so a user added by the CLI counts at once.
+	mem.CreateUser("admin", "x")
+	if has, _ := c.HasUsers(); !has {
+		t.Fatal("new user not seen")
+	}
+
+	u, _ := mem.GetUserByUsername("admin")
+	c.DeleteUser(u.ID)
+	if has, _ := c.HasUsers(); has {
+		t.Error("deleted user still counted")
+	}
+}
+
+func TestPageCache(t *testing.T) {
+	s := newTestSite(t, func(c *config) { c.Cache.Pages = true }).withAdmin("admin")
+	s.store.CreateReview("albums", &Review{Slug: "boards-geogaddi", Artist: "Boards", Title: "Geogaddi", Rating: 9.1})
+
+	expectBody(t, s.get("/"), "Geogaddi")
+	expectBody(t, s.get("/music/albums/boards-geogaddi"), "Geogaddi")
+	if ct := s.get("/").Header().Get("Content-Type"); ct != "text/html; charset=utf-8" {
+		t.Errorf("cached Content-Type = %q", ct)
+	}
+
+	expectStatus(t, s.get("/music/albums/rival-hold"), http.StatusNotFound)
+
+	// Changes behind the cache's back are not seen, but a 404 is not cached.
+	s.store.CreateReview("albums", &Review{Slug: "rival-hold", Artist: "Rival", Title: "Hold", Rating: 6})
+	if strings.Contains(s.get("/").Body.String(), "Hold") {
+		t.Fatal("home page was not cached")
+	}
+	expectStatus(t, s.get("/music/albums/rival-hold"), http.StatusOK)
+
+	// Saving settings in the admin clears every page.
+	s.login("admin")
+	s.postForm("/admin/settings", url.Values{SettingSiteTitle: {"Needle Drop"}})
+	rec := s.get("/")
+	expectBody(t, rec, "Hold")
+	expectBody(t, rec, "Needle Drop")
+
+	// So does deleting a review.
+	r, _ := s.store.GetBySlug("albums", "boards-geogaddi")
+	s.postForm("/admin/albums/"+strconv.FormatInt(r.ID, 10)+"/delete", nil)
+	if strings.Contains(s.get("/").Body.String(), "Geogaddi") {
+		t.Error("deleted review still on the cached home page")
+	}
+	expectStatus(t, s.get("/music/albums/boards-geogaddi"), http.StatusNotFound)
+}
+
+func TestPageCacheFull(t *testing.T) {
+	s := newTestSite(t, func(c *config) { c.Cache.Pages = true; c.Cache.MaxPages = 3 }).withAdmin("admin")
+	s.store.CreateReview("albums", &Review{Slug: "boards-geogaddi", Artist: "Boards", Title: "Geogaddi", Rating: 9.1})
+	onHost := func(host, path string) string {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Host = host
+		return s.do(req).Body.String()
+	}
+
+	// Query strings other than tab don't make new entries, so junk ones can't
+	// fill the cache.
+	expectBody(t, s.get("/"), "Geogaddi")
+	for i := range 4 {
+		s.get("/?utm=" + strconv.Itoa(i))
+	}
+	s.store.CreateReview("albums", &Review{Slug: "rival-hold", Artist: "Rival", Title: "Hold", Rating: 6})
+	if strings.Contains(s.get("/?utm=x").Body.String(), "Hold") {
+		t.Fatal("home page fell out of the cache")
+	}
+
+	// Hosts do, without a public URL; when full, the least recently used page
+	// makes room.
+	onHost("a.test", "/")
+	onHost("b.test", "/")
+	onHost("a.test", "/")
+	s.store.CreateReview("albums", &Review{Slug: "dusk-ends", Artist: "Dusk", Title: "Ends", Rating: 7})
+	onHost("c.test", "/")
+	if strings.Contains(onHost("a.test", "/"), "Ends") {
+		t.Error("recently used page was evicted")
+	}
+	if !strings.Contains(onHost("example.com", "/"), "Ends") {
+		t.Error("least recently used page is still cached")
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+	_ "golang.org/x/image/webp"
+)
+
+// Cards are the 1200×630 images link previews show for a review: its cover,
+// artist, title and score in the site's colors. Each is drawn once and kept
+// in cache.card_dir under a name that hashes everything drawn on it, so
+// editing the review or the settings draws a new one.
+
+const (
+	cardWidth  = 1200
+	cardHeight = 630
+
+	// cardLayout changes whenever drawCard draws differently, so cards from
+	// an older release are replaced.
+	cardLayout = "1"
+)
+
+type cardCache struct {
+	dir string
+	mu  sync.Mutex // one card is drawn at a time
+}
+
+// get returns the file holding review's card, drawing it if needed, and a
+// hash of its contents.
+func (c *cardCache) get(ctx context.Context, review *Review, settings map[string]string, uploads storage) (string, string, error) {
+	h := sha256.New()
+	for _, part := range []string{cardLayout, review.Type, strconv.FormatInt(review.ID, 10), review.UpdatedAt.Format(time.RFC3339Nano),
+		settings[SettingSiteTitle], settings[SettingNavBgColor], settings[SettingAccentColor], settings[SettingBrandColor]} {
+		h.Write([]byte(part + "\x00"))
+	}
+	hash := hex.EncodeToString(h.Sum(nil)[:8])
+	path := filepath.Join(c.dir, fmt.Sprintf("%s-%d-%s.png", review.Type, review.ID, hash))
+	if _, err := os.Stat(path); err == nil {
+		return path, hash, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := os.Stat(path); err == nil {
+		return path, hash, nil
+	}
+	img, err := drawCard(review, settings, loadCover(ctx, uploads, review.CoverPath))
+	if err != nil {
+		return "", "", err
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return "", "", err
+	}
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return "", "", err
+	}
+	tmp, err := os.CreateTemp(c.dir, ".card-*")
+	if err != nil {
+		return "", "", err
+	}
+	_, err = tmp.Write(buf.Bytes())
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", "", err
+	}
+	c.removeExcept(review.Type, review.ID, path)
+	return path, hash, nil
+}
+
+// remove deletes every card drawn for a review.
+func (c *cardCache) remove(table string, id int64) {
+	c.removeExcept(table, id, "")
+}
+
+func (c *cardCache) removeExcept(table string, id int64, keep string) {
+	old, _ := filepath.Glob(filepath.Join(c.dir, fmt.Sprintf("%s-%d-*.png", table, id)))
+	for _, p := range old {
+		if p != keep {
+			os.Remove(p)
+		}
+	}
+}
+
+// loadCover decodes a cover image, or returns nil if there is none or it
+// can't be read; the card is then drawn without it.
+func loadCover(ctx context.Context, uploads storage, key string) image.Image {
+	if key == "" || !fs.ValidPath(key) {
+		return nil
+	}
+	rc, _, err := uploads.Open(ctx, key)
+	if err != nil {
+		return nil
+	}
+	defer rc.Close()
+	// Check the dimensions before decoding; covers stored before uploads
+	// were checked, or put in storage by hand, may be any size.
+	var header bytes.Buffer
+	cfg, _, err := image.DecodeConfig(io.TeeReader(rc, &header))
+	if err != nil || tooManyPixels(cfg) {
+		return nil
+	}
+	img, _, err := image.Decode(io.MultiReader(&header, rc))
+	if err != nil {
+		return nil
+	}
+	return img
+}
+
+type cardFontSet struct {
+	regular, bold *opentype.Font
+}
+
+// cardFonts are the Go fonts, which are compiled in.
+var cardFonts = sync.OnceValues(func() (cardFontSet, error) {
+	regular, err := opentype.Parse(goregular.TTF)
+	if err != nil {
+		return cardFontSet{}, err
+	}
+	bold, err := opentype.Parse(gobold.TTF)
+	return cardFontSet{regular: regular, bold: bold}, err
+})
+
+func cardFace(f *opentype.Font, size float64) font.Face {
+	face, _ := opentype.NewFace(f, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+	return face
+}
+
+// drawCard lays out a card over the nav bar color: the cover on the left and
+// the text beside it, or the text across the whole card without a cover.
+func drawCard(review *Review, settings map[string]string, cover image.Image) (*image.RGBA, error) {
+	fonts, err := cardFonts()
+	if err != nil {
+		return nil, err
+	}
+	bg := parseHexColor(settings[SettingNavBgColor], color.RGBA{0x11, 0x11, 0x11, 0xff})
+	fg := parseHexColor(settings[SettingBrandColor], color.RGBA{0xff, 0xff, 0xff, 0xff})
+	accent := parseHexColor(settings[SettingAccentColor], color.RGBA{0xd6, 0x28, 0x28, 0xff})
+	muted := mixColor(fg, bg, 0.6)
+
+	img := image.NewRGBA(image.Rect(0, 0, cardWidth, cardHeight))
+	draw.Draw(img, img.Bounds(), image.NewUniform(bg), image.Point{}, draw.Src)
+
+	const pad, side = 60, cardHeight - 2*60
+	x := pad
+	if cover != nil {
+		draw.CatmullRom.Scale(img, image.Rect(pad, pad, pad+side, pad+side), cover, squareCrop(cover.Bounds()), draw.Src, nil)
+		x += side + pad
+	}
+	// An accent strip along the bottom, as under the site's nav bar.
+	draw.Draw(img, image.Rect(0, cardHeight-12, cardWidth, cardHeight), image.NewUniform(accent), image.Point{}, draw.Src)
+
+	width := cardWidth - pad - x
+	y := pad
+
+	label := strings.ToUpper(contentTypeMap[review.Type].Singular)
+	if review.Type == "articles" && review.ArticleType != "" {
+		label += " — " + strings.ToUpper(review.ArticleType)
+	}
+	y = drawCardText(img, cardFace(fonts.bold, 26), accent, x, y, width, 1, label)
+	y += 24
+	if review.Artist != "" {
+		y = drawCardText(img, cardFace(fonts.bold, 50), fg, x, y, width, 2, review.Artist)
+		y += 8
+	}
+	drawCardText(img, cardFace(fonts.regular, 46), fg, x, y, width, 3, review.Title)
+
+	bottom := pad + side
+	siteFace := cardFace(fonts.bold, 26)
+	drawCardText(img, siteFace, muted, x, bottom-siteFace.Metrics().Height.Ceil(), width, 1, settings[SettingSiteTitle])
+
+	if ct := contentTypeMap[review.Type]; ct != nil && ct.MaxRating > 0 {
+		big := cardFace(fonts.bold, 120)
+		small := cardFace(fonts.regular, 44)
+		baseline := bottom - 64
+		d := &font.Drawer{Dst: img, Src: image.NewUniform(accent), Face: big, Dot: fixed.P(x, baseline)}
+		d.DrawString(fmt.Sprintf("%.1f", review.Rating))
+		d.Src, d.Face = image.NewUniform(muted), small
+		d.DrawString(fmt.Sprintf(" / %.0f", ct.MaxRating))
+	}
+	return img, nil
+}
+
+// drawCardText draws s wrapped to width in at most maxLines lines, the last
+// one cut short with an ellipsis if needed, and returns the y below it.
+func drawCardText(img *image.RGBA, face font.Face, c color.Color, x, y, width, maxLines int, s string) int {
+	lineHeight := face.Metrics().Height.Ceil()
+	d := &font.Drawer{Dst: img, Src: image.NewUniform(c), Face: face}
+	for _, line := range wrapText(face, s, width, maxLines) {
+		d.Dot = fixed.P(x, y+face.Metrics().Ascent.Ceil())
+		d.DrawString(line)
+		y += lineHeight
+	}
+	return y
+}
+
+// wrapText breaks s into lines no wider than width, breaking inside words
+// only when a single word is too long.
+func wrapText(face font.Face, s string, width, maxLines int) []string {
+	fits := func(s string) bool { return font.MeasureString(face, s).Ceil() <= width }
+	words := strings.Fields(s)
+	var lines []string
+	for len(words) > 0 {
+		if len(lines) == maxLines-1 {
+			return append(lines, ellipsize(face, strings.Join(words, " "), width))
+		}
+		n := 1
+		for n < len(words) && fits(strings.Join(words[:n+1], " ")) {
+			n++
+		}
+		if n == 1 && !fits(words[0]) {
+			// A word wider than the card: split it where it overflows.
+			runes := []rune(words[0])
+			k := len(runes) - 1
+			for k > 1 && !fits(string(runes[:k])) {
+				k--
+			}
+			lines = append(lines, string(runes[:k]))
+			words[0] = string(runes[k:])
+			continue
+		}
+		lines = append(lines, strings.Join(words[:n], " "))
+		words = words[n:]
+	}
+	return lines
+}
+
+// ellipsize shortens s to fit width, ending it with "…" if anything was cut.
+func ellipsize(face font.Face, s string, width int) string {
+	s = strings.TrimSpace(s)
+	if font.MeasureString(face, s).Ceil() <= width {
+		return s
+	}
+	runes := []rune(s)
+	for n := len(runes); n > 0; n-- {
+		candidate := strings.TrimRight(string(runes[:n]), " ,.;:-—") + "…"
+		if font.MeasureString(face, candidate).Ceil() <= width {
+			return candidate
+		}
+	}
+	return "…"
+}
+
+// squareCrop is the largest centered square within r.
+func squareCrop(r image.Rectangle) image.Rectangle {
+	if w, h := r.Dx(), r.Dy(); w > h {
+		r.Min.X += (w - h) / 2
+		r.Max.X = r.Min.X + h
+	} else {
+		r.Min.Y += (h - w) / 2
+		r.Max.Y = r.Min.Y + w
+	}
+	return r
+}
+
+// parseHexColor reads "#rrggbb", as the settings store colors.
+func parseHexColor(s string, fallback color.RGBA) color.RGBA {
+	s = strings.TrimPrefix(s, "#")
+	if len(s) != 6 {
+		return fallback
+	}
+	v, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return fallback
+	}
+	return color.RGBA{uint8(v >> 16), uint8(v >> 8), uint8(v), 0xff}
+}
+
+// mixColor blends a toward b by t, from 0 (a) to 1 (b).
+func mixColor(a, b color.RGBA, t float64) color.RGBA {
+	mix := func(x, y uint8) uint8 { return uint8(float64(x)*(1-t) + float64(y)*t + 0.5) }
+	return color.RGBA{mix(a.R, b.R), mix(a.G, b.G), mix(a.B, b.B), 0xff}
+}
+
+// handleCard serves the card for /cards/{category}/{slug}.png.
+func (h *publicHandler) handleCard(w http.ResponseWriter, r *http.Request) {
+	ct, ok := urlPathToContentType[r.PathValue("category")]
+	slug, isPNG := strings.CutSuffix(r.PathValue("file"), ".png")
+	if !ok || !isPNG {
+		http.NotFound(w, r)
+		return
+	}
+	review, err := h.store.GetBySlug(ct.Table, slug)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	settings, _ := h.store.GetAllSettings()
+	path, hash, err := h.app.cards.get(r.Context(), review, settings, h.app.uploads)
+	if err != nil {
+		requestLogger(r).Error("draw card", "review", ct.Table+"/"+slug, "err", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		// Replaced by a newer card between drawing and opening.
+		http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		requestLogger(r).Error("open card", "path", path, "err", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("ETag", `"`+hash+`"`)
+	// The URL stays the same when the card changes, so caches must come back
+	// now and then.
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	http.ServeContent(w, r, "", time.Time{}, f)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"golang.org/x/image/font"
+)
+
+func TestCards(t *testing.T) {
+	var dir, uploadDir string
+	s := newTestSite(t, func(c *config) { dir, uploadDir = c.Cache.CardDir, c.UploadDir }).withAdmin("admin")
+
+	// A solid green cover, so it can be found on the card.
+	cover := image.NewRGBA(image.Rect(0, 0, 300, 200))
+	for i := 0; i < len(cover.Pix); i += 4 {
+		copy(cover.Pix[i:], []byte{0, 0xff, 0, 0xff})
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, cover)
+	(&localStorage{dir: uploadDir}).Put(context.Background(), "2024/06/geogaddi.png", &buf, "image/png")
+	s.store.CreateReview("albums", &Review{Slug: "boards-geogaddi", Artist: "Boards", Title: "Geogaddi",
+		Rating: 9.1, CoverPath: "2024/06/geogaddi.png"})
+	const path = "/cards/albums/boards-geogaddi.png"
+
+	rec := s.get(path)
+	expectStatus(t, rec, http.StatusOK)
+	if ct := rec.Header().Get("Content-Type"); ct != "image/png" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	img, err := png.Decode(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != cardWidth || b.Dy() != cardHeight {
+		t.Errorf("card is %v", b)
+	}
+	if c := color.RGBAModel.Convert(img.At(300, 300)).(color.RGBA); c.G < 0xf0 || c.R > 0x10 {
+		t.Errorf("cover not drawn, pixel is %v", c)
+	}
+
+	etag := rec.Header().Get("ETag")
+	expectStatus(t, s.getWith(path, map[string]string{"If-None-Match": etag}), http.StatusNotModified)
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.png")); len(files) != 1 {
+		t.Fatalf("card files = %v", files)
+	}
+
+	// Changing the settings or the review draws a new card in place of the old.
+	s.login("admin")
+	s.postForm("/admin/settings", url.Values{SettingAccentColor: {"#0000ff"}})
+	rec = s.get(path)
+	if rec.Header().Get("ETag") == etag {
+		t.Error("card not redrawn after a settings change")
+	}
+	etag = rec.Header().Get("ETag")
+	r, _ := s.store.GetBySlug("albums", "boards-geogaddi")
+	id := strconv.FormatInt(r.ID, 10)
+	expectRedirect(t, s.postMultipart("/admin/albums/"+id, map[string]string{
+		"artist": "Boards", "title": "Geogaddi", "rating": "9.4", "body": "Edited.",
+	}), "/admin/")
+	if s.get(path).Header().Get("ETag") == etag {
+		t.Error("card not redrawn after an edit")
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.png")); len(files) != 1 {
+		t.Errorf("card files after redraws = %v", files)
+	}
+
+	s.postForm("/admin/albums/"+id+"/delete", nil)
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("cards left after delete: %v", entries)
+	}
+	for _, p := range []string{path, "/cards/albums/boards-geogaddi", "/cards/videos/boards-geogaddi.png"} {
+		expectStatus(t, s.get(p), http.StatusNotFound)
+	}
+}
+
+func TestWrapText(t *testing.T) {
+	fonts, err := cardFonts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	face := cardFace(fonts.regular, 40)
+	lines := wrapText(face, "Music Has the Right to Children and a title that goes on far too long to fit", 400, 3)
+	if len(lines) != 3 {
+		t.Fatalf("lines = %q", lines)
+	}
+	for _, l := range lines {
+		if w := measure(face, l); w > 400 {
+			t.Errorf("%q is %dpx wide", l, w)
+		}
+	}
+	if last := lines[2]; last[len(last)-len("…"):] != "…" {
+		t.Errorf("last line %q has no ellipsis", last)
+	}
+
+	// An unbreakable word is split rather than overflowing.
+	for _, l := range wrapText(face, "Supercalifragilisticexpialidocious", 200, 5) {
+		if w := measure(face, l); w > 200 {
+			t.Errorf("%q is %dpx wide", l, w)
+		}
+	}
+	if lines := wrapText(face, "Hold", 400, 2); len(lines) != 1 || lines[0] != "Hold" {
+		t.Errorf("short title = %q", lines)
+	}
+}
+
+func measure(face font.Face, s string) int {
+	return font.MeasureString(face, s).Ceil()
+}
+
+// pngHeader is the start of a PNG claiming to be w×h pixels; enough for
+// image.DecodeConfig, not for decoding.
+func pngHeader(w, h uint32) []byte {
+	ihdr := binary.BigEndian.AppendUint32([]byte("IHDR"), w)
+	ihdr = binary.BigEndian.AppendUint32(ihdr, h)
+	ihdr = append(ihdr, 8, 2, 0, 0, 0) // 8-bit RGB
+	b := []byte("\x89PNG\r\n\x1a\n")
+	b = binary.BigEndian.AppendUint32(b, uint32(len(ihdr)-4))
+	b = append(b, ihdr...)
+	return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(ihdr))
+}
+
+func TestCoverPixelLimit(t *testing.T) {
+	var uploadDir string
+	s := newTestSite(t, func(c *config) { uploadDir = c.UploadDir }).withAdmin("admin")
+	uploads := &localStorage{dir: uploadDir}
+	ctx := context.Background()
+
+	// Covers already in storage are skipped rather than decoded.
+	uploads.Put(ctx, "2024/06/huge.png", bytes.NewReader(pngHeader(50000, 50000)), "image/png")
+	if loadCover(ctx, uploads, "2024/06/huge.png") != nil {
+		t.Error("huge cover was loaded")
+	}
+	var small bytes.Buffer
+	png.Encode(&small, image.NewRGBA(image.Rect(0, 0, 30, 20)))
+	uploads.Put(ctx, "2024/06/small.png", &small, "image/png")
+	if img := loadCover(ctx, uploads, "2024/06/small.png"); img == nil || img.Bounds().Dx() != 30 {
+		t.Errorf("small cover = %v", img)
+	}
+
+	// New ones are refused on upload.
+	s.login("admin")
+	upload := func(data []byte) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		for k, v := range map[string]string{"type": "albums", "artist": "Boards", "title": "Geogaddi", "rating": "9"} {
+			mw.WriteField(k, v)
+		}
+		part, _ := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Disposition": {`form-data; name="cover"; filename="cover.png"`},
+			"Content-Type":        {"image/png"},
+		})
+		part.Write(data)
+		mw.Close()
+		req := httptest.NewRequest(http.MethodPost, "/admin/reviews", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		return s.do(req)
+	}
+	expectBody(t, upload(pngHeader(50000, 50000)), "image too large (50000×50000; max 40 megapixels)")
+	expectBody(t, upload([]byte("not a png")), "not a readable jpeg, png or webp image")
+	if _, err := s.store.GetBySlug("albums", "boards-geogaddi"); err == nil {
+		t.Error("review saved with a refused cover")
+	}
+	small.Reset()
+	png.Encode(&small, image.NewRGBA(image.Rect(0, 0, 30, 20)))
+	expectRedirect(t, upload(small.Bytes()), "/admin/")
+	if r, err := s.store.GetBySlug("albums", "boards-geogaddi"); err != nil || r.CoverPath == "" {
+		t.Errorf("review = %+v, %v", r, err)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// runTestCLI runs the command line, keeping the test's quiet logger.
+func runTestCLI(t *testing.T, args ...string) int {
+	t.Helper()
+	logger := slog.Default()
+	defer slog.SetDefault(logger)
+	return runCLI(args)
+}
+
+// newTestDB creates a migrated SQLite database at path.
+func newTestDB(t *testing.T, path string) *database {
+	t.Helper()
+	db, err := openDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrate(db); err != nil {
+		db.Close()
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestWritingCommandsNeedSite(t *testing.T) {
+	dir := t.TempDir()
+	backup := filepath.Join(dir, "backup.db")
+	newTestDB(t, backup).Close()
+	top, jazz := filepath.Join(dir, "main.db"), filepath.Join(dir, "jazz.db")
+	newTestDB(t, top).Close()
+	conf := filepath.Join(dir, "ditchfork.toml")
+	os.WriteFile(conf, []byte(fmt.Sprintf(`db_path = %q
+upload_dir = %q
+
+[[sites]]
+name = "jazz"
+hosts = ["jazz.example.com"]
+db_path = %q
+upload_dir = %q
+`, top, filepath.Join(dir, "uploads"), jazz, filepath.Join(dir, "jazz-uploads"))), 0o644)
+	before, _ := os.ReadFile(top)
+
+	for _, args := range [][]string{
+		{"restore", "--force", backup},
+		{"import", filepath.Join(dir, "site.json")},
+		{"user", "add", "miles"},
+	} {
+		if code := runTestCLI(t, append([]string{"--config", conf}, args...)...); code != exitUsage {
+			t.Errorf("%v without --site: exit code %d", args, code)
+		}
+	}
+	if after, _ := os.ReadFile(top); string(after) != string(before) {
+		t.Error("the top-level database was changed")
+	}
+	if _, err := os.Stat(jazz); err == nil {
+		t.Error("the site's database was created")
+	}
+
+	if code := runTestCLI(t, "--config", conf, "--site", "jazz", "restore", backup); code != exitOK {
+		t.Fatalf("restore --site jazz: exit code %d", code)
+	}
+	if _, err := os.Stat(jazz); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRestoreKeepsPendingWAL(t *testing.T) {
+	dir := t.TempDir()
+	backup := filepath.Join(dir, "backup.db")
+	newTestDB(t, backup).Close()
+
+	// Copy a database whose last write is still only in the WAL, as a
+	// server that was killed leaves it.
+	live, dst := filepath.Join(dir, "live.db"), filepath.Join(dir, "site.db")
+	db := newTestDB(t, live)
+	db.SetMaxOpenConns(1)
+	for _, pragma := range []string{`PRAGMA journal_mode = WAL`, `PRAGMA wal_autocheckpoint = 0`} {
+		if _, err := db.Exec(pragma); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := newSQLStore(db).CreateUser("miles", "hash"); err != nil {
+		t.Fatal(err)
+	}
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		if err := copyFile(live+suffix, dst+suffix); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+	if fi, err := os.Stat(dst + "-wal"); err != nil || fi.Size() == 0 {
+		t.Fatalf("no pending WAL: %v", err)
+	}
+
+	if code := runTestCLI(t, "--db", dst, "restore", "--force", backup); code != exitOK {
+		t.Fatalf("exit code %d", code)
+	}
+	old := newTestDB(t, dst+".before-restore")
+	defer old.Close()
+	if _, err := newSQLStore(old).GetUserByUsername("miles"); err != nil {
+		t.Errorf("the write in the WAL was lost: %v", err)
+	}
+	restored := newTestDB(t, dst)
+	defer restored.Close()
+	if ok, _ := newSQLStore(restored).HasUsers(); ok {
+		t.Error("the backup wasn't restored")
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Responses smaller than this aren't worth the gzip header and CPU.
+const minCompressSize = 1024
+
+var gzipWriters = sync.Pool{
+	New: func() any {
+		gz, _ := gzip.NewWriterLevel(io.Discard, gzip.DefaultCompression)
+		return gz
+	},
+}
+
+// compress gzips text responses for clients that accept it. Images are
+// already compressed and pass through untouched.
+func compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w}
+		defer cw.close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if strings.TrimSpace(coding) != "gzip" {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.ReplaceAll(params, " ", ""), "q="); ok {
+			v, err := strconv.ParseFloat(q, 64)
+			return err == nil && v > 0
+		}
+		return true
+	}
+	return false
+}
+
+// compressibleType reports whether a Content-Type is text-like.
+func compressibleType(ct string) bool {
+	ct, _, _ = strings.Cut(ct, ";")
+	ct = strings.TrimSpace(ct)
+	switch {
+	case strings.HasPrefix(ct, "text/"):
+		return true
+	case ct == "application/json", ct == "application/javascript", ct == "application/xml",
+		ct == "application/rss+xml", ct == "application/atom+xml", ct == "image/svg+xml",
+		ct == "font/ttf", ct == "font/otf": // WOFF and WOFF2 are compressed already
+
+		return true
+	}
+	return false
+}
+
+// compressWriter holds back the first minCompressSize bytes, so short
+// responses go out as they are and the handler's headers are final by the
+// time it decides.
+type compressWriter struct {
+	http.ResponseWriter
+	status      int
+	passthrough bool
+	buf         []byte
+	gz          *gzip.Writer
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.status != 0 {
+		return
+	}
+	cw.status = status
+	h := cw.Header()
+	if status != http.StatusOK || h.Get("Content-Encoding") != "" || !compressibleType(h.Get("Content-Type")) {
+		cw.passthrough = true
+	} else if n, err := strconv.Atoi(h.Get("Content-Length")); err == nil && n < minCompressSize {
+		cw.passthrough = true
+	}
+	if cw.passthrough {
+		cw.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if cw.status == 0 {
+		if h := cw.Header(); h.Get("Content-Type") == "" {
+			h.Set("Content-Type", http.DetectContentType(b))
+		}
+		cw.WriteHeader(http.StatusOK)
+	}
+	switch {
+	case cw.passthrough:
+		return cw.ResponseWriter.Write(b)
+	case cw.gz != nil:
+		return cw.gz.Write(b)
+	}
+	cw.buf = append(cw.buf, b...)
+	if len(cw.buf) >= minCompressSize {
+		if err := cw.startGzip(); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+func (cw *compressWriter) startGzip() error {
+	h := cw.Header()
+	h.Set("Content-Encoding", "gzip")
+	h.Del("Content-Length")
+	// The bytes differ from the uncompressed response, so a strong validator
+	// must become weak.
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("ETag", "W/"+etag)
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+	cw.gz = gzipWriters.Get().(*gzip.Writer)
+	cw.gz.Reset(cw.ResponseWriter)
+	_, err := cw.gz.Write(cw.buf)
+	cw.buf = nil
+	return err
+}
+
+// close finishes the gzip stream, or sends a response that stayed too short
+// to compress.
+func (cw *compressWriter) close() {
+	switch {
+	case cw.gz != nil:
+		cw.gz.Close()
+		gzipWriters.Put(cw.gz)
+	case cw.status != 0 && !cw.passthrough:
+		cw.ResponseWriter.WriteHeader(cw.status)
+		cw.ResponseWriter.Write(cw.buf)
+	}
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
@@ -0,0 +1,606 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// config holds every runtime setting. Values are layered, lowest precedence
+// first: built-in defaults, the config file, DITCHFORK_* environment
+// variables, then command-line flags. See ditchfork.example.toml.
+type config struct {
+	Listen          string          `toml:"listen"`
+	BasePath        string          `toml:"base_path"`
+	PublicURL       string          `toml:"public_url"`
+	DBPath          string          `toml:"db_path"`
+	UploadDir       string          `toml:"upload_dir"`
+	ThemesDir       string          `toml:"themes_dir"`
+	SessionLifetime duration        `toml:"session_lifetime"`
+	MaxRequestSize  byteSize        `toml:"max_request_size"`
+	MaxImageSize    byteSize        `toml:"max_image_size"`
+	TrustedProxies  []string        `toml:"trusted_proxies"`
+	LogFormat       string          `toml:"log_format"`
+	LogLevel        string          `toml:"log_level"`
+	ShutdownTimeout duration        `toml:"shutdown_timeout"`
+	Login           loginConfig     `toml:"login"`
+	TLS             tlsConfig       `toml:"tls"`
+	AccessLog       accessLogConfig `toml:"access_log"`
+	Metrics         metricsConfig   `toml:"metrics"`
+	Storage         storageConfig   `toml:"storage"`
+	Cache           cacheConfig     `toml:"cache"`
+
+	Sites []siteConfig `toml:"sites"`
+
+	path    string            // config file that was loaded, if any
+	sources map[string]string // setting key → "default", "file", "env" or "flag"
+
+	// Set on per-site copies; see siteConfigs.
+	siteName  string
+	siteHosts []string
+}
+
+type loginConfig struct {
+	BackoffAfter     int      `toml:"backoff_after"`
+	LockoutThreshold int      `toml:"lockout_threshold"`
+	LockoutDuration  duration `toml:"lockout_duration"`
+}
+
+// tlsConfig turns on HTTPS when both files are set.
+type tlsConfig struct {
+	CertFile     string   `toml:"cert_file"`
+	KeyFile      string   `toml:"key_file"`
+	RedirectFrom string   `toml:"redirect_from"` // plain HTTP address that redirects to HTTPS
+	HSTSMaxAge   duration `toml:"hsts_max_age"`
+}
+
+func (t tlsConfig) enabled() bool { return t.CertFile != "" }
+
+type accessLogConfig struct {
+	Path       string   `toml:"path"` // "" is off, "stderr" goes with the main log
+	MaxSize    byteSize `toml:"max_size"`
+	MaxBackups int      `toml:"max_backups"`
+}
+
+// metricsConfig controls /metrics, which is off unless one of these is set.
+type metricsConfig struct {
+	Listen string `toml:"listen"` // separate address for /metrics only
+	Token  string `toml:"token"`  // bearer token scrapers must send
+}
+
+// storageConfig picks where uploads are kept; see storage.go.
+type storageConfig struct {
+	Backend   string   `toml:"backend"` // "local" (upload_dir) or "s3"
+	Serve     string   `toml:"serve"`   // "proxy", or "redirect" to a signed URL (s3 only)
+	URLExpiry duration `toml:"url_expiry"`
+	S3        s3Config `toml:"s3"`
+}
+
+// cacheConfig controls the in-memory caches; see cache.go.
+type cacheConfig struct {
+	TTL      duration `toml:"ttl"`       // longest a cached value is trusted
+	Pages    bool     `toml:"pages"`     // also cache rendered public pages
+	MaxPages int      `toml:"max_pages"` // pages kept at most
+	CardDir  string   `toml:"card_dir"`  // rendered share images; see cards.go
+}
+
+type s3Config struct {
+	Endpoint  string `toml:"endpoint"` // e.g. https://s3.eu-west-1.amazonaws.com or http://localhost:9000
+	Region    string `toml:"region"`
+	Bucket    string `toml:"bucket"`
+	Prefix    string `toml:"prefix"` // prepended to every key, e.g. "covers/"
+	AccessKey string `toml:"access_key"`
+	SecretKey string `toml:"secret_key"`
+	PathStyle bool   `toml:"path_style"` // bucket in the URL path, as MinIO expects
+}
+
+func defaultConfig() *config {
+	return &config{
+		Listen:          ":8080",
+		DBPath:          "./ditchfork.db",
+		UploadDir:       "./uploads",
+		ThemesDir:       "./themes",
+		SessionLifetime: duration{24 * time.Hour},
+		MaxRequestSize:  10 << 20,
+		MaxImageSize:    5 << 20,
+		TrustedProxies:  strings.Split(defaultTrustedProxies, ","),
+		LogFormat:       "text",
+		LogLevel:        "info",
+		ShutdownTimeout: duration{30 * time.Second},
+		Login: loginConfig{
+			BackoffAfter:     defaultLoginPolicy.BackoffAfter,
+			LockoutThreshold: defaultLoginPolicy.LockoutThreshold,
+			LockoutDuration:  duration{defaultLoginPolicy.LockoutDuration},
+		},
+		TLS: tlsConfig{
+			HSTSMaxAge: duration{365 * 24 * time.Hour},
+		},
+		AccessLog: accessLogConfig{
+			MaxSize:    10 << 20,
+			MaxBackups: 5,
+		},
+		Storage: storageConfig{
+			Backend:   "local",
+			Serve:     "proxy",
+			URLExpiry: duration{time.Hour},
+			S3:        s3Config{Region: "us-east-1"},
+		},
+		Cache: cacheConfig{
+			TTL:      duration{time.Minute},
+			MaxPages: 500,
+			CardDir:  "./cards",
+		},
+	}
+}
+
+func (c *config) loginPolicy() loginPolicy {
+	p := defaultLoginPolicy
+	p.BackoffAfter = c.Login.BackoffAfter
+	p.LockoutThreshold = c.Login.LockoutThreshold
+	p.LockoutDuration = c.Login.LockoutDuration.Duration
+	return p
+}
+
+// configSetting describes one setting: where it lives in the file, which env
+// var and flag override it, and how to read and write it as a string.
+type configSetting struct {
+	key  string // dotted TOML key
+	env  string
+	flag string
+	help string
+	get  func(c *config) any
+	set  func(c *config, v string) error
+}
+
+var configSettings = []configSetting{
+	{"listen", "DITCHFORK_LISTEN", "listen", "address to listen on, e.g. :8080 or 127.0.0.1:8080",
+		func(c *config) any { return c.Listen },
+		func(c *config, v string) error { c.Listen = v; return nil }},
+	{"base_path", "DITCHFORK_BASE_PATH", "base-path", "URL prefix the site is served under, e.g. /reviews",
+		func(c *config) any { return c.BasePath },
+		func(c *config, v string) error { c.BasePath = v; return nil }},
+	{"public_url", "DITCHFORK_PUBLIC_URL", "public-url", "address readers reach the site at, e.g. https://example.com/reviews, for canonical links and the sitemap",
+		func(c *config) any { return c.PublicURL },
+		func(c *config, v string) error { c.PublicURL = v; return nil }},
+	{"db_path", "DITCHFORK_DB_PATH", "db", "SQLite database file, or a postgres:// URL",
+		func(c *config) any { return c.DBPath },
+		func(c *config, v string) error { c.DBPath = v; return nil }},
+	{"upload_dir", "DITCHFORK_UPLOAD_DIR", "upload-dir", "directory for uploaded images",
+		func(c *config) any { return c.UploadDir },
+		func(c *config, v string) error { c.UploadDir = v; return nil }},
+	{"themes_dir", "DITCHFORK_THEMES_DIR", "themes-dir", "directory of themes to offer in Settings besides the bundled ones; empty for none",
+		func(c *config) any { return c.ThemesDir },
+		func(c *config, v string) error { c.ThemesDir = v; return nil }},
+	{"session_lifetime", "DITCHFORK_SESSION_LIFETIME", "session-lifetime", "how long an admin login lasts, e.g. 24h",
+		func(c *config) any { return c.SessionLifetime.String() },
+		func(c *config, v string) error { return c.SessionLifetime.UnmarshalText([]byte(v)) }},
+	{"max_request_size", "DITCHFORK_MAX_REQUEST_SIZE", "max-request-size", "largest accepted admin form submission, e.g. 10MB",
+		func(c *config) any { return c.MaxRequestSize.String() },
+		func(c *config, v string) error { return c.MaxRequestSize.UnmarshalText([]byte(v)) }},
+	{"max_image_size", "DITCHFORK_MAX_IMAGE_SIZE", "max-image-size", "largest accepted cover image, e.g. 5MB",
+		func(c *config) any { return c.MaxImageSize.String() },
+		func(c *config, v string) error { return c.MaxImageSize.UnmarshalText([]byte(v)) }},
+	{"trusted_proxies", "DITCHFORK_TRUSTED_PROXIES", "trusted-proxies", "comma-separated proxy CIDRs allowed to set the client IP, or none",
+		func(c *config) any { return c.TrustedProxies },
+		func(c *config, v string) error { c.TrustedProxies = splitList(v); return nil }},
+	{"log_format", "DITCHFORK_LOG_FORMAT", "log-format", "log output format: text or json",
+		func(c *config) any { return c.LogFormat },
+		func(c *config, v string) error { c.LogFormat = v; return nil }},
+	{"log_level", "DITCHFORK_LOG_LEVEL", "log-level", "minimum log level: debug, info, warn or error",
+		func(c *config) any { return c.LogLevel },
+		func(c *config, v string) error { c.LogLevel = v; return nil }},
+	{"shutdown_timeout", "DITCHFORK_SHUTDOWN_TIMEOUT", "shutdown-timeout", "how long to let in-flight requests finish on shutdown",
+		func(c *config) any { return c.ShutdownTimeout.String() },
+		func(c *config, v string) error { return c.ShutdownTimeout.UnmarshalText([]byte(v)) }},
+	{"login.backoff_after", "DITCHFORK_LOGIN_BACKOFF_AFTER", "login-backoff-after", "failed logins from one IP before it must wait",
+		func(c *config) any { return c.Login.BackoffAfter },
+		func(c *config, v string) error { return setInt(&c.Login.BackoffAfter, v) }},
+	{"login.lockout_threshold", "DITCHFORK_LOCKOUT_THRESHOLD", "lockout-threshold", "failed logins for one username before it locks (0 disables)",
+		func(c *config) any { return c.Login.LockoutThreshold },
+		func(c *config, v string) error { return setInt(&c.Login.LockoutThreshold, v) }},
+	{"login.lockout_duration", "DITCHFORK_LOCKOUT_DURATION", "lockout-duration", "how long a locked account stays locked",
+		func(c *config) any { return c.Login.LockoutDuration.String() },
+		func(c *config, v string) error { return c.Login.LockoutDuration.UnmarshalText([]byte(v)) }},
+	{"tls.cert_file", "DITCHFORK_TLS_CERT", "tls-cert", "TLS certificate file (PEM, full chain); enables HTTPS",
+		func(c *config) any { return c.TLS.CertFile },
+		func(c *config, v string) error { c.TLS.CertFile = v; return nil }},
+	{"tls.key_file", "DITCHFORK_TLS_KEY", "tls-key", "TLS private key file (PEM)",
+		func(c *config) any { return c.TLS.KeyFile },
+		func(c *config, v string) error { c.TLS.KeyFile = v; return nil }},
+	{"tls.redirect_from", "DITCHFORK_TLS_REDIRECT_FROM", "tls-redirect-from", "plain HTTP address that redirects to HTTPS, e.g. :80",
+		func(c *config) any { return c.TLS.RedirectFrom },
+		func(c *config, v string) error { c.TLS.RedirectFrom = v; return nil }},
+	{"tls.hsts_max_age", "DITCHFORK_HSTS_MAX_AGE", "hsts-max-age", "Strict-Transport-Security max-age over HTTPS (0 disables)",
+		func(c *config) any { return c.TLS.HSTSMaxAge.String() },
+		func(c *config, v string) error { return c.TLS.HSTSMaxAge.UnmarshalText([]byte(v)) }},
+	{"access_log.path", "DITCHFORK_ACCESS_LOG", "access-log", "access log file, or stderr; empty turns it off",
+		func(c *config) any { return c.AccessLog.Path },
+		func(c *config, v string) error { c.AccessLog.Path = v; return nil }},
+	{"access_log.max_size", "DITCHFORK_ACCESS_LOG_MAX_SIZE", "access-log-max-size", "rotate the access log file at this size (0 never rotates)",
+		func(c *config) any { return c.AccessLog.MaxSize.String() },
+		func(c *config, v string) error { return c.AccessLog.MaxSize.UnmarshalText([]byte(v)) }},
+	{"access_log.max_backups", "DITCHFORK_ACCESS_LOG_MAX_BACKUPS", "access-log-max-backups", "rotated access log files to keep",
+		func(c *config) any { return c.AccessLog.MaxBackups },
+		func(c *config, v string) error { return setInt(&c.AccessLog.MaxBackups, v) }},
+	{"metrics.listen", "DITCHFORK_METRICS_LISTEN", "metrics-listen", "serve /metrics on this separate address, e.g. 127.0.0.1:9090",
+		func(c *config) any { return c.Metrics.Listen },
+		func(c *config, v string) error { c.Metrics.Listen = v; return nil }},
+	{"metrics.token", "DITCHFORK_METRICS_TOKEN", "metrics-token", "bearer token required for /metrics; also enables it on the main listener",
+		func(c *config) any { return c.Metrics.Token },
+		func(c *config, v string) error { c.Metrics.Token = v; return nil }},
+	{"storage.backend", "DITCHFORK_STORAGE", "storage", "where uploads are kept: local (upload_dir) or s3",
+		func(c *config) any { return c.Storage.Backend },
+		func(c *config, v string) error { c.Storage.Backend = v; return nil }},
+	{"storage.serve", "DITCHFORK_STORAGE_SERVE", "storage-serve", "how /uploads/ is served: proxy, or redirect to a signed URL (s3 only)",
+		func(c *config) any { return c.Storage.Serve },
+		func(c *config, v string) error { c.Storage.Serve = v; return nil }},
+	{"storage.url_expiry", "DITCHFORK_STORAGE_URL_EXPIRY", "storage-url-expiry", "how long signed upload URLs stay valid",
+		func(c *config) any { return c.Storage.URLExpiry.String() },
+		func(c *config, v string) error { return c.Storage.URLExpiry.UnmarshalText([]byte(v)) }},
+	{"storage.s3.endpoint", "DITCHFORK_S3_ENDPOINT", "s3-endpoint", "S3 API endpoint URL, e.g. http://localhost:9000",
+		func(c *config) any { return c.Storage.S3.Endpoint },
+		func(c *config, v string) error { c.Storage.S3.Endpoint = v; return nil }},
+	{"storage.s3.region", "DITCHFORK_S3_REGION", "s3-region", "S3 region",
+		func(c *config) any { return c.Storage.S3.Region },
+		func(c *config, v string) error { c.Storage.S3.Region = v; return nil }},
+	{"storage.s3.bucket", "DITCHFORK_S3_BUCKET", "s3-bucket", "S3 bucket for uploads",
+		func(c *config) any { return c.Storage.S3.Bucket },
+		func(c *config, v string) error { c.Storage.S3.Bucket = v; return nil }},
+	{"storage.s3.prefix", "DITCHFORK_S3_PREFIX", "s3-prefix", "key prefix inside the bucket, e.g. covers/",
+		func(c *config) any { return c.Storage.S3.Prefix },
+		func(c *config, v string) error { c.Storage.S3.Prefix = v; return nil }},
+	{"storage.s3.access_key", "DITCHFORK_S3_ACCESS_KEY", "s3-access-key", "S3 access key ID",
+		func(c *config) any { return c.Storage.S3.AccessKey },
+		func(c *config, v string) error { c.Storage.S3.AccessKey = v; return nil }},
+	{"storage.s3.secret_key", "DITCHFORK_S3_SECRET_KEY", "s3-secret-key", "S3 secret access key",
+		func(c *config) any { return c.Storage.S3.SecretKey },
+		func(c *config, v string) error { c.Storage.S3.SecretKey = v; return nil }},
+	{"storage.s3.path_style", "DITCHFORK_S3_PATH_STYLE", "s3-path-style", "put the bucket in the URL path instead of the host (MinIO)",
+		func(c *config) any { return c.Storage.S3.PathStyle },
+		func(c *config, v string) error { return setBool(&c.Storage.S3.PathStyle, v) }},
+	{"cache.ttl", "DITCHFORK_CACHE_TTL", "cache-ttl", "how long cached settings and pages are used before being re-read",
+		func(c *config) any { return c.Cache.TTL.String() },
+		func(c *config, v string) error { return c.Cache.TTL.UnmarshalText([]byte(v)) }},
+	{"cache.pages", "DITCHFORK_CACHE_PAGES", "cache-pages", "keep rendered public pages in memory",
+		func(c *config) any { return c.Cache.Pages },
+		func(c *config, v string) error { return setBool(&c.Cache.Pages, v) }},
+	{"cache.max_pages", "DITCHFORK_CACHE_MAX_PAGES", "cache-max-pages", "most rendered pages to keep",
+		func(c *config) any { return c.Cache.MaxPages },
+		func(c *config, v string) error { return setInt(&c.Cache.MaxPages, v) }},
+	{"cache.card_dir", "DITCHFORK_CARD_DIR", "card-dir", "directory for generated link preview images",
+		func(c *config) any { return c.Cache.CardDir },
+		func(c *config, v string) error { c.Cache.CardDir = v; return nil }},
+}
+
+// registerConfigFlags defines a flag for every setting. Flag values are kept as
+// strings and applied by loadConfig, so only flags the user actually passed
+// override lower layers.
+func registerConfigFlags(fs *flag.FlagSet) (configPath *string) {
+	for _, s := range configSettings {
+		fs.String(s.flag, "", s.help)
+	}
+	return fs.String("config", "", "path to a TOML config file (default ./ditchfork.toml if present; env DITCHFORK_CONFIG)")
+}
+
+// loadConfig builds the effective configuration from defaults, file, env and
+// the flags that were set on fs.
+func loadConfig(fs *flag.FlagSet, configPath string) (*config, error) {
+	c := defaultConfig()
+	c.sources = make(map[string]string)
+	for _, s := range configSettings {
+		c.sources[s.key] = "default"
+	}
+
+	path, explicit := configPath, configPath != ""
+	if !explicit {
+		path, explicit = os.Getenv("DITCHFORK_CONFIG"), os.Getenv("DITCHFORK_CONFIG") != ""
+	}
+	if !explicit {
+		path = "ditchfork.toml"
+	}
+	if _, err := os.Stat(path); err == nil || explicit {
+		md, err := toml.DecodeFile(path, c)
+		if err != nil {
+			return nil, fmt.Errorf("config file %s: %w", path, err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return nil, fmt.Errorf("config file %s: unknown setting %q", path, undecoded[0].String())
+		}
+		for _, s := range configSettings {
+			if md.IsDefined(strings.Split(s.key, ".")...) {
+				c.sources[s.key] = "file"
+			}
+		}
+		c.path = path
+	}
+
+	// Older installs set only the port.
+	if port := os.Getenv("DITCHFORK_PORT"); port != "" && os.Getenv("DITCHFORK_LISTEN") == "" {
+		c.Listen = ":" + port
+		c.sources["listen"] = "env"
+	}
+	for _, s := range configSettings {
+		if v := os.Getenv(s.env); v != "" {
+			if err := s.set(c, v); err != nil {
+				return nil, fmt.Errorf("%s: %w", s.env, err)
+			}
+			c.sources[s.key] = "env"
+		}
+	}
+
+	var flagErr error
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range configSettings {
+			if s.flag == f.Name && flagErr == nil {
+				if err := s.set(c, f.Value.String()); err != nil {
+					flagErr = fmt.Errorf("--%s: %w", s.flag, err)
+				}
+				c.sources[s.key] = "flag"
+			}
+		}
+	})
+	if flagErr != nil {
+		return nil, flagErr
+	}
+
+	return c, c.validate()
+}
+
+func (c *config) validate() error {
+	var errs []error
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		errs = append(errs, fmt.Errorf("listen: %w", err))
+	}
+	if err := validateBasePath(c.BasePath); err != nil {
+		errs = append(errs, err)
+	}
+	if err := validatePublicURL(c.PublicURL); err != nil {
+		errs = append(errs, err)
+	}
+	if c.DBPath == "" {
+		errs = append(errs, errors.New("db_path: must not be empty"))
+	}
+	if c.UploadDir == "" && c.Storage.Backend == "local" {
+		errs = append(errs, errors.New("upload_dir: must not be empty"))
+	}
+	if c.SessionLifetime.Duration < time.Minute {
+		errs = append(errs, errors.New("session_lifetime: must be at least 1m"))
+	}
+	if c.MaxRequestSize <= 0 || c.MaxImageSize <= 0 {
+		errs = append(errs, errors.New("max_request_size and max_image_size must be positive"))
+	}
+	if c.MaxImageSize > c.MaxRequestSize {
+		errs = append(errs, errors.New("max_image_size must not exceed max_request_size"))
+	}
+	if _, err := parseTrustedProxies(strings.Join(c.TrustedProxies, ",")); err != nil {
+		errs = append(errs, fmt.Errorf("trusted_proxies: %w", err))
+	}
+	if c.LogFormat != "text" && c.LogFormat != "json" {
+		errs = append(errs, fmt.Errorf("log_format: %q is not text or json", c.LogFormat))
+	}
+	if _, err := parseLogLevel(c.LogLevel); err != nil {
+		errs = append(errs, fmt.Errorf("log_level: %w", err))
+	}
+	if c.ShutdownTimeout.Duration <= 0 {
+		errs = append(errs, errors.New("shutdown_timeout: must be positive"))
+	}
+	if c.Login.BackoffAfter < 1 {
+		errs = append(errs, errors.New("login.backoff_after: must be at least 1"))
+	}
+	if c.Login.LockoutThreshold < 0 {
+		errs = append(errs, errors.New("login.lockout_threshold: must not be negative"))
+	}
+	if c.Login.LockoutDuration.Duration <= 0 {
+		errs = append(errs, errors.New("login.lockout_duration: must be positive"))
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		errs = append(errs, errors.New("tls: cert_file and key_file must be set together"))
+	} else if c.TLS.enabled() {
+		if _, err := tls.LoadX509KeyPair(c.TLS.CertFile, c.TLS.KeyFile); err != nil {
+			errs = append(errs, fmt.Errorf("tls: %w", err))
+		}
+	}
+	if c.TLS.RedirectFrom != "" {
+		if !c.TLS.enabled() {
+			errs = append(errs, errors.New("tls.redirect_from: needs cert_file and key_file"))
+		} else if _, _, err := net.SplitHostPort(c.TLS.RedirectFrom); err != nil {
+			errs = append(errs, fmt.Errorf("tls.redirect_from: %w", err))
+		}
+	}
+	if c.TLS.HSTSMaxAge.Duration < 0 {
+		errs = append(errs, errors.New("tls.hsts_max_age: must not be negative"))
+	}
+	errs = append(errs, c.validateStorage()...)
+	errs = append(errs, c.validateSites()...)
+	if c.Metrics.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.Metrics.Listen); err != nil {
+			errs = append(errs, fmt.Errorf("metrics.listen: %w", err))
+		}
+	}
+	if c.Cache.TTL.Duration <= 0 {
+		errs = append(errs, errors.New("cache.ttl: must be positive"))
+	}
+	if c.Cache.MaxPages < 1 {
+		errs = append(errs, errors.New("cache.max_pages: must be at least 1"))
+	}
+	if c.Cache.CardDir == "" {
+		errs = append(errs, errors.New("cache.card_dir: must not be empty"))
+	}
+	if c.AccessLog.MaxSize < 0 || c.AccessLog.MaxBackups < 0 {
+		errs = append(errs, errors.New("access_log: max_size and max_backups must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+// setupLogging routes the standard logger through slog with the configured
+// format and level.
+func (c *config) setupLogging() {
+	level, _ := parseLogLevel(c.LogLevel)
+	slog.SetDefault(slog.New(c.logHandler(os.Stderr, level)))
+	log.SetFlags(0)
+}
+
+// logHandler writes records at or above level to w in the configured format.
+func (c *config) logHandler(w io.Writer, level slog.Leveler) slog.Handler {
+	opts := &slog.HandlerOptions{Level: level}
+	if c.LogFormat == "json" {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+func parseLogLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(s))
+	return level, err
+}
+
+// secretSettings are masked when the config is printed.
+var secretSettings = map[string]bool{
+	"metrics.token":         true,
+	"storage.s3.secret_key": true,
+}
+
+// writeConfig prints the effective configuration as TOML, noting where each
+// value came from.
+func (c *config) writeConfig(w io.Writer) {
+	if c.path != "" {
+		fmt.Fprintf(w, "# config file: %s\n", c.path)
+	} else {
+		fmt.Fprintln(w, "# config file: none")
+	}
+	section := ""
+	for _, s := range configSettings {
+		name := s.key
+		if i := strings.LastIndex(s.key, "."); i != -1 {
+			if sec := s.key[:i]; sec != section {
+				section = sec
+				fmt.Fprintf(w, "\n[%s]\n", section)
+			}
+			name = s.key[i+1:]
+		}
+		v := tomlValue(s.get(c))
+		if secretSettings[s.key] && v != `""` {
+			v = `"********"`
+		}
+		if s.key == "db_path" {
+			v = tomlValue(redactDSN(c.DBPath))
+		}
+		fmt.Fprintf(w, "%s = %s  # %s\n", name, v, c.sources[s.key])
+	}
+	for _, site := range c.Sites {
+		fmt.Fprintf(w, "\n[[sites]]\n")
+		fmt.Fprintf(w, "name = %s\n", tomlValue(site.Name))
+		fmt.Fprintf(w, "hosts = %s\n", tomlValue(site.Hosts))
+		fmt.Fprintf(w, "db_path = %s\n", tomlValue(redactDSN(site.DBPath)))
+		fmt.Fprintf(w, "upload_dir = %s\n", tomlValue(site.UploadDir))
+		fmt.Fprintf(w, "base_path = %s\n", tomlValue(site.BasePath))
+		fmt.Fprintf(w, "public_url = %s\n", tomlValue(site.PublicURL))
+	}
+}
+
+func tomlValue(v any) string {
+	switch v := v.(type) {
+	case string:
+		return strconv.Quote(v)
+	case []string:
+		quoted := make([]string, len(v))
+		for i, s := range v {
+			quoted[i] = strconv.Quote(s)
+		}
+		return "[" + strings.Join(quoted, ", ") + "]"
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+func setInt(dst *int, v string) error {
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return err
+	}
+	*dst = n
+	return nil
+}
+
+func setBool(dst *bool, v string) error {
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return err
+	}
+	*dst = b
+	return nil
+}
+
+// duration is a time.Duration written as a string ("15m") in config files.
+type duration struct{ time.Duration }
+
+func (d *duration) UnmarshalText(b []byte) error {
+	v, err := time.ParseDuration(string(b))
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func (d duration) MarshalText() ([]byte, error) { return []byte(d.String()), nil }
+
+// byteSize is a size in bytes written as "5MB", "512KB" or a plain number.
+// Units are binary (1KB = 1024 bytes).
+type byteSize int64
+
+func (b *byteSize) UnmarshalText(text []byte) error {
+	s := strings.ToUpper(strings.TrimSpace(string(text)))
+	mult := int64(1)
+	for _, u := range []struct {
+		suffix string
+		mult   int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(s, u.suffix) {
+			s, mult = strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid size %q", text)
+	}
+	*b = byteSize(n * mult)
+	return nil
+}
+
+func (b byteSize) MarshalText() ([]byte, error) { return []byte(b.String()), nil }
+
+func (b byteSize) String() string {
+	switch {
+	case b >= 1<<30 && b%(1<<30) == 0:
+		return fmt.Sprintf("%dGB", b>>30)
+	case b >= 1<<20 && b%(1<<20) == 0:
+		return fmt.Sprintf("%dMB", b>>20)
+	case b >= 1<<10 && b%(1<<10) == 0:
+		return fmt.Sprintf("%dKB", b>>10)
+	}
+	return fmt.Sprintf("%dB", int64(b))
+}
@@ -3,79 +3,180 @@ package main
 import (
 	"database/sql"
 	"fmt"
-	"log"
+	"log/slog"
+	"time"
 
-	_ "modernc.org/sqlite"
+	"github.com/lib/pq"
+	"modernc.org/sqlite"
 )
 
-func openDB(path string) (*sql.DB, error) {
-	db, err := sql.Open("sqlite", path+"?_journal_mode=WAL&_busy_timeout=5000&_time_format=sqlite")
+// The database drivers, with query timing for /metrics.
+const (
+	sqliteDriver   = "sqlite-timed"
+	postgresDriver = "postgres-timed"
+)
+
+func init() {
+	sql.Register(sqliteDriver, timedDriver{&sqlite.Driver{}})
+	sql.Register(postgresDriver, timedDriver{&pq.Driver{}})
+}
+
+// openDB opens an SQLite file, or a PostgreSQL database if dsn is a
+// postgres:// URL.
+func openDB(dsn string) (*database, error) {
+	d, source := sqliteDialect, dsn+"?_journal_mode=WAL&_busy_timeout=5000&_time_format=sqlite"
+	if isPostgresDSN(dsn) {
+		d, source = postgresDialect, postgresSource(dsn)
+	}
+	sqlDB, err := sql.Open(d.driver, source)
 	if err != nil {
 		return nil, fmt.Errorf("open db: %w", err)
 	}
+	db := &database{sqlDB, d}
 	if err := db.Ping(); err != nil {
+		db.Close()
 		return nil, fmt.Errorf("ping db: %w", err)
 	}
-	if _, err := db.Exec("PRAGMA foreign_keys = ON"); err != nil {
-		return nil, fmt.Errorf("enable foreign keys: %w", err)
+	if d == sqliteDialect {
+		if _, err := db.Exec("PRAGMA foreign_keys = ON"); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("enable foreign keys: %w", err)
+		}
 	}
 	return db, nil
 }
 
+// dbTables lists every table, parents first, for copying between databases.
+var dbTables = []string{
+	"albums", "songs", "articles", "users", "sessions", "password_resets",
+	"login_failures", "audit_log", "settings",
+}
+
 const tableSchema = `(
-	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	id {id},
 	slug TEXT NOT NULL UNIQUE,
 	artist TEXT NOT NULL DEFAULT '',
 	title TEXT NOT NULL,
 	subheader TEXT NOT NULL DEFAULT '',
-	rating REAL NOT NULL DEFAULT 0,
+	rating {real} NOT NULL DEFAULT 0,
 	body TEXT NOT NULL DEFAULT '',
 	cover_path TEXT NOT NULL DEFAULT '',
 	article_type TEXT NOT NULL DEFAULT '',
-	created_at DATETIME NOT NULL DEFAULT (datetime('now')),
-	updated_at DATETIME NOT NULL DEFAULT (datetime('now'))
+	created_at {time} NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	updated_at {time} NOT NULL DEFAULT CURRENT_TIMESTAMP
 )`
 
-func migrate(db *sql.DB) error {
+// auditTriggers keep audit_log append-only.
+var auditTriggers = map[*dialect][]string{
+	sqliteDialect: {
+		`CREATE TRIGGER IF NOT EXISTS audit_log_no_update BEFORE UPDATE ON audit_log
+			BEGIN SELECT RAISE(ABORT, 'audit_log is append-only'); END`,
+		`CREATE TRIGGER IF NOT EXISTS audit_log_no_delete BEFORE DELETE ON audit_log
+			BEGIN SELECT RAISE(ABORT, 'audit_log is append-only'); END`,
+	},
+	postgresDialect: {
+		`CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+			BEGIN RAISE EXCEPTION 'audit_log is append-only'; END
+		$$ LANGUAGE plpgsql`,
+		`DO $$ BEGIN
+			IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = 'audit_log_append_only'
+					AND tgrelid = 'audit_log'::regclass) THEN
+				CREATE TRIGGER audit_log_append_only BEFORE UPDATE OR DELETE ON audit_log
+					FOR EACH ROW EXECUTE FUNCTION audit_log_append_only();
+			END IF;
+		END $$`,
+	},
+}
+
+func migrate(db *database) error {
+	if db.dialect == sqliteDialect {
+		// Sessions used to store the raw token as the primary key. Tokens are
+		// now stored hashed, so old rows are useless — drop the table and let
+		// it be recreated below (everyone has to log in again once).
+		var legacySessions int
+		db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('sessions') WHERE name = 'token'`).Scan(&legacySessions)
+		if legacySessions > 0 {
+			db.Exec(`DROP TABLE sessions`)
+			slog.Info("dropped legacy sessions table (tokens are now hashed)")
+		}
+	}
+
 	migrations := []string{
 		`CREATE TABLE IF NOT EXISTS albums ` + tableSchema,
 		`CREATE TABLE IF NOT EXISTS songs ` + tableSchema,
 		`CREATE TABLE IF NOT EXISTS articles ` + tableSchema,
 		`CREATE TABLE IF NOT EXISTS users (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			id {id},
 			username TEXT NOT NULL UNIQUE,
 			password_hash TEXT NOT NULL
 		)`,
 		`CREATE TABLE IF NOT EXISTS sessions (
-			token TEXT PRIMARY KEY,
+			id {id},
+			token_hash TEXT NOT NULL UNIQUE,
+			user_id INTEGER NOT NULL,
+			ip TEXT NOT NULL DEFAULT '',
+			user_agent TEXT NOT NULL DEFAULT '',
+			created_at {time} NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			last_seen_at {time} NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			expires_at {time} NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS password_resets (
+			token_hash TEXT PRIMARY KEY,
 			user_id INTEGER NOT NULL,
-			expires_at DATETIME NOT NULL
+			created_at {time} NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			expires_at {time} NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS login_failures (
+			scope TEXT NOT NULL,
+			key TEXT NOT NULL,
+			failures INTEGER NOT NULL DEFAULT 0,
+			last_failure {time} NOT NULL,
+			locked_until {time},
+			PRIMARY KEY (scope, key)
+		)`,
+		`CREATE TABLE IF NOT EXISTS audit_log (
+			id {id},
+			created_at {time} NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			user_id INTEGER NOT NULL DEFAULT 0,
+			username TEXT NOT NULL DEFAULT '',
+			action TEXT NOT NULL,
+			target_type TEXT NOT NULL DEFAULT '',
+			target_id TEXT NOT NULL DEFAULT '',
+			before_summary TEXT NOT NULL DEFAULT '',
+			after_summary TEXT NOT NULL DEFAULT '',
+			ip TEXT NOT NULL DEFAULT ''
 		)`,
+		`CREATE INDEX IF NOT EXISTS audit_log_created_at ON audit_log (created_at)`,
 		`CREATE TABLE IF NOT EXISTS settings (
 			key TEXT PRIMARY KEY,
 			value TEXT NOT NULL DEFAULT ''
 		)`,
 	}
+	migrations = append(migrations, auditTriggers[db.dialect]...)
 	for _, m := range migrations {
+		m = db.dialect.ddl(m)
 		if _, err := db.Exec(m); err != nil {
 			return fmt.Errorf("migration: %w\nSQL: %s", err, m)
 		}
 	}
 
-	// Migrate data from old reviews table if it exists
-	var hasOld int
-	db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name='reviews'`).Scan(&hasOld)
-	if hasOld > 0 {
-		db.Exec(`INSERT OR IGNORE INTO albums (id, slug, artist, title, subheader, rating, body, cover_path, created_at, updated_at)
-			SELECT id, slug, artist, title, subheader, rating, body, cover_path, created_at, updated_at
-			FROM reviews WHERE type = 'album'`)
-		db.Exec(`DROP TABLE reviews`)
-		log.Println("migrated reviews table to albums")
-	}
+	// Older SQLite schemas; PostgreSQL databases always start out current.
+	if db.dialect == sqliteDialect {
+		// Migrate data from old reviews table if it exists
+		var hasOld int
+		db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name='reviews'`).Scan(&hasOld)
+		if hasOld > 0 {
+			db.Exec(`INSERT OR IGNORE INTO albums (id, slug, artist, title, subheader, rating, body, cover_path, created_at, updated_at)
+				SELECT id, slug, artist, title, subheader, rating, body, cover_path, created_at, updated_at
+				FROM reviews WHERE type = 'album'`)
+			db.Exec(`DROP TABLE reviews`)
+			slog.Info("migrated reviews table to albums")
+		}
 
-	// Add article_type column to existing tables (idempotent — ignore if already exists)
-	for _, t := range []string{"albums", "songs"} {
-		db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN article_type TEXT NOT NULL DEFAULT ''`, t))
+		// Add article_type column to existing tables (idempotent — ignore if already exists)
+		for _, t := range []string{"albums", "songs"} {
+			db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN article_type TEXT NOT NULL DEFAULT ''`, t))
+		}
 	}
 
 	// Seed default settings if table is empty
@@ -83,11 +184,11 @@ func migrate(db *sql.DB) error {
 	db.QueryRow(`SELECT COUNT(*) FROM settings`).Scan(&settingCount)
 	if settingCount == 0 {
 		for k, v := range settingDefaults {
-			db.Exec(`INSERT OR IGNORE INTO settings (key, value) VALUES (?, ?)`, k, v)
+			db.Exec(`INSERT INTO settings (key, value) VALUES (?, ?) ON CONFLICT DO NOTHING`, k, v)
 		}
 	}
 
-	log.Println("database migrations complete")
+	slog.Info("database migrations complete")
 	return nil
 }
 
@@ -99,11 +200,11 @@ func validTable(table string) bool {
 
 // Reviews — all queries are parameterized by table name
 
-func dbGetByTable(db *sql.DB, table string) ([]Review, error) {
+func (st *sqlStore) GetByTable(table string) ([]Review, error) {
 	if !validTable(table) {
 		return nil, fmt.Errorf("invalid table: %s", table)
 	}
-	rows, err := db.Query(fmt.Sprintf(
+	rows, err := st.db.Query(fmt.Sprintf(
 		`SELECT id, '%s' as type, slug, artist, title, subheader, rating, body, cover_path, article_type, created_at, updated_at
 		 FROM %s ORDER BY created_at DESC`, table, table))
 	if err != nil {
@@ -113,8 +214,8 @@ func dbGetByTable(db *sql.DB, table string) ([]Review, error) {
 	return scanReviews(rows)
 }
 
-func dbGetFeed(db *sql.DB) ([]Review, error) {
-	rows, err := db.Query(`
+func (st *sqlStore) GetFeed() ([]Review, error) {
+	rows, err := st.db.Query(`
 		SELECT id, 'albums' as type, slug, artist, title, subheader, rating, body, cover_path, article_type, created_at, updated_at FROM albums
 		UNION ALL
 		SELECT id, 'songs' as type, slug, artist, title, subheader, rating, body, cover_path, article_type, created_at, updated_at FROM songs
@@ -128,12 +229,12 @@ func dbGetFeed(db *sql.DB) ([]Review, error) {
 	return scanReviews(rows)
 }
 
-func dbGetBySlug(db *sql.DB, table, slug string) (*Review, error) {
+func (st *sqlStore) GetBySlug(table, slug string) (*Review, error) {
 	if !validTable(table) {
 		return nil, fmt.Errorf("invalid table: %s", table)
 	}
 	r := &Review{}
-	err := db.QueryRow(fmt.Sprintf(
+	err := st.db.QueryRow(fmt.Sprintf(
 		`SELECT id, '%s' as type, slug, artist, title, subheader, rating, body, cover_path, article_type, created_at, updated_at
 		 FROM %s WHERE slug = ?`, table, table), slug).Scan(
 		&r.ID, &r.Type, &r.Slug, &r.Artist, &r.Title, &r.Subheader,
@@ -144,12 +245,12 @@ func dbGetBySlug(db *sql.DB, table, slug string) (*Review, error) {
 	return r, nil
 }
 
-func dbGetByID(db *sql.DB, table string, id int64) (*Review, error) {
+func (st *sqlStore) GetByID(table string, id int64) (*Review, error) {
 	if !validTable(table) {
 		return nil, fmt.Errorf("invalid table: %s", table)
 	}
 	r := &Review{}
-	err := db.QueryRow(fmt.Sprintf(
+	err := st.db.QueryRow(fmt.Sprintf(
 		`SELECT id, '%s' as type, slug, artist, title, subheader, rating, body, cover_path, article_type, created_at, updated_at
 		 FROM %s WHERE id = ?`, table, table), id).Scan(
 		&r.ID, &r.Type, &r.Slug, &r.Artist, &r.Title, &r.Subheader,
@@ -160,63 +261,84 @@ func dbGetByID(db *sql.DB, table string, id int64) (*Review, error) {
 	return r, nil
 }
 
-func dbCreateReview(db *sql.DB, table string, r *Review) (int64, error) {
+func (st *sqlStore) CreateReview(table string, r *Review) (int64, error) {
 	if !validTable(table) {
 		return 0, fmt.Errorf("invalid table: %s", table)
 	}
-	res, err := db.Exec(fmt.Sprintf(
+	var id int64
+	err := st.db.QueryRow(fmt.Sprintf(
 		`INSERT INTO %s (slug, artist, title, subheader, rating, body, cover_path, article_type)
-		 VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, table),
-		r.Slug, r.Artist, r.Title, r.Subheader, r.Rating, r.Body, r.CoverPath, r.ArticleType)
-	if err != nil {
-		return 0, err
-	}
-	return res.LastInsertId()
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?) RETURNING id`, table),
+		r.Slug, r.Artist, r.Title, r.Subheader, r.Rating, r.Body, r.CoverPath, r.ArticleType).Scan(&id)
+	return id, err
 }
 
-func dbUpdateReview(db *sql.DB, table string, r *Review) error {
+func (st *sqlStore) UpdateReview(table string, r *Review) error {
 	if !validTable(table) {
 		return fmt.Errorf("invalid table: %s", table)
 	}
-	_, err := db.Exec(fmt.Sprintf(
+	_, err := st.db.Exec(fmt.Sprintf(
 		`UPDATE %s SET slug = ?, artist = ?, title = ?, subheader = ?, rating = ?, body = ?,
-		 cover_path = ?, article_type = ?, updated_at = datetime('now') WHERE id = ?`, table),
+		 cover_path = ?, article_type = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`, table),
 		r.Slug, r.Artist, r.Title, r.Subheader, r.Rating, r.Body, r.CoverPath, r.ArticleType, r.ID)
 	return err
 }
 
-func dbDeleteReview(db *sql.DB, table string, id int64) error {
+// ImportReview inserts a review keeping its original timestamps, written the
+// same way as CURRENT_TIMESTAMP so ordering stays consistent.
+func (st *sqlStore) ImportReview(table string, r *Review) error {
 	if !validTable(table) {
 		return fmt.Errorf("invalid table: %s", table)
 	}
-	_, err := db.Exec(fmt.Sprintf(`DELETE FROM %s WHERE id = ?`, table), id)
+	_, err := st.db.Exec(fmt.Sprintf(
+		`INSERT INTO %s (slug, artist, title, subheader, rating, body, cover_path, article_type, created_at, updated_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, table),
+		r.Slug, r.Artist, r.Title, r.Subheader, r.Rating, r.Body, r.CoverPath, r.ArticleType,
+		st.db.timestamp(r.CreatedAt), st.db.timestamp(r.UpdatedAt))
 	return err
 }
 
-func dbSlugExists(db *sql.DB, table, slug string) (bool, error) {
+func (st *sqlStore) DeleteReview(table string, id int64) error {
+	if !validTable(table) {
+		return fmt.Errorf("invalid table: %s", table)
+	}
+	_, err := st.db.Exec(fmt.Sprintf(`DELETE FROM %s WHERE id = ?`, table), id)
+	return err
+}
+
+func (st *sqlStore) CountContent(table string) (int, error) {
+	if !validTable(table) {
+		return 0, fmt.Errorf("invalid table: %s", table)
+	}
+	var n int
+	err := st.db.QueryRow(fmt.Sprintf(`SELECT COUNT(*) FROM %s`, table)).Scan(&n)
+	return n, err
+}
+
+func (st *sqlStore) SlugExists(table, slug string) (bool, error) {
 	if !validTable(table) {
 		return false, fmt.Errorf("invalid table: %s", table)
 	}
 	var count int
-	err := db.QueryRow(fmt.Sprintf(`SELECT COUNT(*) FROM %s WHERE slug = ?`, table), slug).Scan(&count)
+	err := st.db.QueryRow(fmt.Sprintf(`SELECT COUNT(*) FROM %s WHERE slug = ?`, table), slug).Scan(&count)
 	return count > 0, err
 }
 
-func dbSlugExistsExcluding(db *sql.DB, table, slug string, excludeID int64) (bool, error) {
+func (st *sqlStore) SlugExistsExcluding(table, slug string, excludeID int64) (bool, error) {
 	if !validTable(table) {
 		return false, fmt.Errorf("invalid table: %s", table)
 	}
 	var count int
-	err := db.QueryRow(fmt.Sprintf(`SELECT COUNT(*) FROM %s WHERE slug = ? AND id != ?`, table),
+	err := st.db.QueryRow(fmt.Sprintf(`SELECT COUNT(*) FROM %s WHERE slug = ? AND id != ?`, table),
 		slug, excludeID).Scan(&count)
 	return count > 0, err
 }
 
 // Users
 
-func dbGetUserByUsername(db *sql.DB, username string) (*User, error) {
+func (st *sqlStore) GetUserByUsername(username string) (*User, error) {
 	u := &User{}
-	err := db.QueryRow(`SELECT id, username, password_hash FROM users WHERE username = ?`, username).
+	err := st.db.QueryRow(`SELECT id, username, password_hash FROM users WHERE username = ?`, username).
 		Scan(&u.ID, &u.Username, &u.PasswordHash)
 	if err != nil {
 		return nil, err
@@ -224,47 +346,340 @@ func dbGetUserByUsername(db *sql.DB, username string) (*User, error) {
 	return u, nil
 }
 
-func dbCreateUser(db *sql.DB, username, passwordHash string) error {
-	_, err := db.Exec(`INSERT INTO users (username, password_hash) VALUES (?, ?)`, username, passwordHash)
+func (st *sqlStore) GetUserByID(id int64) (*User, error) {
+	u := &User{}
+	err := st.db.QueryRow(`SELECT id, username, password_hash FROM users WHERE id = ?`, id).
+		Scan(&u.ID, &u.Username, &u.PasswordHash)
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (st *sqlStore) ListUsers() ([]User, error) {
+	rows, err := st.db.Query(`SELECT id, username, password_hash FROM users ORDER BY username`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var users []User
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.ID, &u.Username, &u.PasswordHash); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+func (st *sqlStore) CreateUser(username, passwordHash string) error {
+	_, err := st.db.Exec(`INSERT INTO users (username, password_hash) VALUES (?, ?)`, username, passwordHash)
 	return err
 }
 
+// DeleteUser removes a user along with their sessions and reset links.
+func (st *sqlStore) DeleteUser(id int64) error {
+	tx, err := st.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, q := range []string{
+		`DELETE FROM sessions WHERE user_id = ?`,
+		`DELETE FROM password_resets WHERE user_id = ?`,
+		`DELETE FROM users WHERE id = ?`,
+	} {
+		if _, err := tx.Exec(q, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// SetUserPassword replaces a user's password hash and revokes every session
+// they hold, so a password change always logs out other devices.
+func (st *sqlStore) SetUserPassword(userID int64, passwordHash string) error {
+	tx, err := st.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`UPDATE users SET password_hash = ? WHERE id = ?`, passwordHash, userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM sessions WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
 // Sessions
 
-func dbCreateSession(db *sql.DB, s *Session) error {
-	_, err := db.Exec(`INSERT INTO sessions (token, user_id, expires_at) VALUES (?, ?, ?)`,
-		s.Token, s.UserID, s.ExpiresAt)
-	return err
+func (st *sqlStore) CreateSession(s *Session) error {
+	return st.db.QueryRow(`INSERT INTO sessions (token_hash, user_id, ip, user_agent, created_at, last_seen_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?) RETURNING id`,
+		s.TokenHash, s.UserID, s.IP, s.UserAgent, s.CreatedAt, s.LastSeenAt, s.ExpiresAt).Scan(&s.ID)
 }
 
-func dbGetSession(db *sql.DB, token string) (*Session, error) {
+func (st *sqlStore) GetSession(tokenHash string) (*Session, error) {
 	s := &Session{}
-	err := db.QueryRow(`SELECT token, user_id, expires_at FROM sessions WHERE token = ?`, token).
-		Scan(&s.Token, &s.UserID, &s.ExpiresAt)
+	err := st.db.QueryRow(`SELECT s.id, s.token_hash, s.user_id, u.username, s.ip, s.user_agent,
+		s.created_at, s.last_seen_at, s.expires_at
+		FROM sessions s JOIN users u ON u.id = s.user_id WHERE s.token_hash = ?`, tokenHash).
+		Scan(&s.ID, &s.TokenHash, &s.UserID, &s.Username, &s.IP, &s.UserAgent,
+			&s.CreatedAt, &s.LastSeenAt, &s.ExpiresAt)
 	if err != nil {
 		return nil, err
 	}
 	return s, nil
 }
 
-func dbDeleteSession(db *sql.DB, token string) error {
-	_, err := db.Exec(`DELETE FROM sessions WHERE token = ?`, token)
+func (st *sqlStore) ListSessions() ([]Session, error) {
+	rows, err := st.db.Query(`SELECT s.id, s.token_hash, s.user_id, u.username, s.ip, s.user_agent,
+		s.created_at, s.last_seen_at, s.expires_at
+		FROM sessions s JOIN users u ON u.id = s.user_id
+		WHERE s.expires_at > ? ORDER BY s.last_seen_at DESC`, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var sessions []Session
+	for rows.Next() {
+		var s Session
+		if err := rows.Scan(&s.ID, &s.TokenHash, &s.UserID, &s.Username, &s.IP, &s.UserAgent,
+			&s.CreatedAt, &s.LastSeenAt, &s.ExpiresAt); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+func (st *sqlStore) TouchSession(id int64, seen time.Time) error {
+	_, err := st.db.Exec(`UPDATE sessions SET last_seen_at = ? WHERE id = ?`, seen, id)
+	return err
+}
+
+func (st *sqlStore) DeleteSession(tokenHash string) error {
+	_, err := st.db.Exec(`DELETE FROM sessions WHERE token_hash = ?`, tokenHash)
 	return err
 }
 
-func dbCleanExpiredSessions(db *sql.DB) error {
-	_, err := db.Exec(`DELETE FROM sessions WHERE expires_at < datetime('now')`)
+func (st *sqlStore) DeleteSessionByID(id int64) error {
+	_, err := st.db.Exec(`DELETE FROM sessions WHERE id = ?`, id)
 	return err
 }
 
+func (st *sqlStore) DeleteUserSessions(userID int64) error {
+	_, err := st.db.Exec(`DELETE FROM sessions WHERE user_id = ?`, userID)
+	return err
+}
+
+func (st *sqlStore) CountActiveSessions() (int, error) {
+	var n int
+	err := st.db.QueryRow(`SELECT COUNT(*) FROM sessions WHERE expires_at > ?`, time.Now().UTC()).Scan(&n)
+	return n, err
+}
+
+func (st *sqlStore) CleanExpiredSessions() error {
+	_, err := st.db.Exec(`DELETE FROM sessions WHERE expires_at < ?`, time.Now().UTC())
+	return err
+}
+
+// Password resets
+
+// CreatePasswordReset stores a reset token for a user, replacing any
+// earlier link that hasn't been used yet.
+func (st *sqlStore) CreatePasswordReset(userID int64, tokenHash string, expiresAt time.Time) error {
+	tx, err := st.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM password_resets WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO password_resets (token_hash, user_id, created_at, expires_at) VALUES (?, ?, ?, ?)`,
+		tokenHash, userID, time.Now().UTC(), expiresAt); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetPasswordResetUser returns the user an unexpired reset token belongs to.
+func (st *sqlStore) GetPasswordResetUser(tokenHash string) (*User, error) {
+	u := &User{}
+	err := st.db.QueryRow(`SELECT u.id, u.username, u.password_hash
+		FROM password_resets r JOIN users u ON u.id = r.user_id
+		WHERE r.token_hash = ? AND r.expires_at > ?`, tokenHash, time.Now().UTC()).
+		Scan(&u.ID, &u.Username, &u.PasswordHash)
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// UsePasswordReset consumes a reset token and sets the new password in one
+// transaction, so a link can never be used twice.
+func (st *sqlStore) UsePasswordReset(tokenHash, passwordHash string) (*User, error) {
+	tx, err := st.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	u := &User{}
+	err = tx.QueryRow(`SELECT u.id, u.username FROM password_resets r JOIN users u ON u.id = r.user_id
+		WHERE r.token_hash = ? AND r.expires_at > ?`, tokenHash, time.Now().UTC()).Scan(&u.ID, &u.Username)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`DELETE FROM password_resets WHERE user_id = ?`, u.ID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`UPDATE users SET password_hash = ? WHERE id = ?`, passwordHash, u.ID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`DELETE FROM sessions WHERE user_id = ?`, u.ID); err != nil {
+		return nil, err
+	}
+	u.PasswordHash = passwordHash
+	return u, tx.Commit()
+}
+
+func (st *sqlStore) CleanExpiredPasswordResets() error {
+	_, err := st.db.Exec(`DELETE FROM password_resets WHERE expires_at < ?`, time.Now().UTC())
+	return err
+}
+
+// Login throttling
+
+func (st *sqlStore) GetLoginFailure(scope, key string) (*LoginFailure, error) {
+	f := &LoginFailure{Scope: scope, Key: key}
+	var lockedUntil sql.NullTime
+	err := st.db.QueryRow(`SELECT failures, last_failure, locked_until FROM login_failures WHERE scope = ? AND key = ?`,
+		scope, key).Scan(&f.Failures, &f.LastFailure, &lockedUntil)
+	if err != nil {
+		return nil, err
+	}
+	f.LockedUntil = lockedUntil.Time
+	return f, nil
+}
+
+// RecordLoginFailure bumps the failure counter for a key, starting over if
+// the previous failure is older than windowStart, and returns the new count.
+func (st *sqlStore) RecordLoginFailure(scope, key string, now, windowStart time.Time) (int, error) {
+	var failures int
+	err := st.db.QueryRow(`INSERT INTO login_failures (scope, key, failures, last_failure) VALUES (?, ?, 1, ?)
+		ON CONFLICT(scope, key) DO UPDATE SET
+			failures = CASE WHEN login_failures.last_failure < ? THEN 1 ELSE login_failures.failures + 1 END,
+			last_failure = excluded.last_failure
+		RETURNING failures`, scope, key, now, windowStart).Scan(&failures)
+	return failures, err
+}
+
+// LockLogin locks a key until the given time and starts its count over, so
+// the lock ending gives a full set of attempts rather than one.
+func (st *sqlStore) LockLogin(scope, key string, until time.Time) error {
+	_, err := st.db.Exec(`UPDATE login_failures SET locked_until = ?, failures = 0 WHERE scope = ? AND key = ?`, until, scope, key)
+	return err
+}
+
+func (st *sqlStore) ClearLoginFailures(scope, key string) error {
+	_, err := st.db.Exec(`DELETE FROM login_failures WHERE scope = ? AND key = ?`, scope, key)
+	return err
+}
+
+// GetLockedUsers returns the usernames that are currently locked out.
+func (st *sqlStore) GetLockedUsers() (map[string]time.Time, error) {
+	rows, err := st.db.Query(`SELECT key, locked_until FROM login_failures WHERE scope = ? AND locked_until > ?`,
+		limitScopeUser, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	locked := make(map[string]time.Time)
+	for rows.Next() {
+		var key string
+		var until time.Time
+		if err := rows.Scan(&key, &until); err != nil {
+			return nil, err
+		}
+		locked[key] = until
+	}
+	return locked, rows.Err()
+}
+
+// CleanLoginFailures removes counters whose last failure is older than
+// before and which aren't holding an active lock.
+func (st *sqlStore) CleanLoginFailures(before time.Time) error {
+	_, err := st.db.Exec(`DELETE FROM login_failures WHERE last_failure < ? AND (locked_until IS NULL OR locked_until < ?)`,
+		before, time.Now().UTC())
+	return err
+}
+
+// Audit log
+
+func (st *sqlStore) InsertAudit(e *AuditEntry) error {
+	_, err := st.db.Exec(`INSERT INTO audit_log (created_at, user_id, username, action, target_type, target_id,
+		before_summary, after_summary, ip) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		e.CreatedAt, e.UserID, e.Username, e.Action, e.TargetType, e.TargetID, e.Before, e.After, e.IP)
+	return err
+}
+
+// ListAudit returns matching audit entries, newest first. A limit of 0
+// returns every match.
+func (st *sqlStore) ListAudit(f auditFilter, limit, offset int) ([]AuditEntry, error) {
+	where, args := f.where()
+	query := `SELECT id, created_at, user_id, username, action, target_type, target_id,
+		before_summary, after_summary, ip FROM audit_log` + where + ` ORDER BY id DESC`
+	if limit > 0 {
+		query += ` LIMIT ? OFFSET ?`
+		args = append(args, limit, offset)
+	}
+	rows, err := st.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []AuditEntry
+	for rows.Next() {
+		var e AuditEntry
+		if err := rows.Scan(&e.ID, &e.CreatedAt, &e.UserID, &e.Username, &e.Action, &e.TargetType,
+			&e.TargetID, &e.Before, &e.After, &e.IP); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func (st *sqlStore) ListAuditActions() ([]string, error) {
+	rows, err := st.db.Query(`SELECT DISTINCT action FROM audit_log ORDER BY action`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var actions []string
+	for rows.Next() {
+		var a string
+		if err := rows.Scan(&a); err != nil {
+			return nil, err
+		}
+		actions = append(actions, a)
+	}
+	return actions, rows.Err()
+}
+
 // Settings
 
-func dbGetAllSettings(db *sql.DB) (map[string]string, error) {
+func (st *sqlStore) GetAllSettings() (map[string]string, error) {
 	settings := make(map[string]string)
 	for k, v := range settingDefaults {
 		settings[k] = v
 	}
-	rows, err := db.Query(`SELECT key, value FROM settings`)
+	rows, err := st.db.Query(`SELECT key, value FROM settings`)
 	if err != nil {
 		return settings, err
 	}
@@ -279,17 +694,26 @@ func dbGetAllSettings(db *sql.DB) (map[string]string, error) {
 	return settings, rows.Err()
 }
 
-func dbUpdateSetting(db *sql.DB, key, value string) error {
-	_, err := db.Exec(`INSERT INTO settings (key, value) VALUES (?, ?) ON CONFLICT(key) DO UPDATE SET value = ?`, key, value, value)
+func (st *sqlStore) UpdateSetting(key, value string) error {
+	_, err := st.db.Exec(`INSERT INTO settings (key, value) VALUES (?, ?) ON CONFLICT(key) DO UPDATE SET value = ?`, key, value, value)
 	return err
 }
 
-func dbHasUsers(db *sql.DB) (bool, error) {
+func (st *sqlStore) HasUsers() (bool, error) {
 	var count int
-	err := db.QueryRow(`SELECT COUNT(*) FROM users`).Scan(&count)
+	err := st.db.QueryRow(`SELECT COUNT(*) FROM users`).Scan(&count)
 	return count > 0, err
 }
 
+// Maintenance
+
+// dbBackup writes a consistent, compacted copy of an SQLite database to path.
+// It is safe to run while the server is writing.
+func dbBackup(db *database, path string) error {
+	_, err := db.Exec(`VACUUM INTO ?`, path)
+	return err
+}
+
 // Helpers
 
 func scanReviews(rows *sql.Rows) ([]Review, error) {
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// database is a *sql.DB plus the SQL dialect it speaks. Queries everywhere are
+// written with ? placeholders and portable SQL; the few things that differ
+// between SQLite and PostgreSQL (placeholders, column types, maintenance
+// statements) go through the dialect.
+type database struct {
+	*sql.DB
+	dialect *dialect
+}
+
+type dialect struct {
+	name     string // "sqlite" or "postgres"
+	driver   string
+	numbered bool // placeholders are $1, $2, ... rather than ?
+
+	// Schema types, substituted for {id}, {time} and {real} in migrations.
+	autoID    string
+	timestamp string
+	real      string
+}
+
+var (
+	sqliteDialect = &dialect{
+		name:      "sqlite",
+		driver:    sqliteDriver,
+		autoID:    "INTEGER PRIMARY KEY AUTOINCREMENT",
+		timestamp: "DATETIME",
+		real:      "REAL",
+	}
+	postgresDialect = &dialect{
+		name:      "postgres",
+		driver:    postgresDriver,
+		numbered:  true,
+		autoID:    "BIGSERIAL PRIMARY KEY",
+		timestamp: "TIMESTAMPTZ",
+		real:      "DOUBLE PRECISION",
+	}
+)
+
+// isPostgresDSN reports whether db_path names a PostgreSQL database rather
+// than an SQLite file.
+func isPostgresDSN(dsn string) bool {
+	return strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://")
+}
+
+// postgresSource makes sessions use UTC unless the DSN says otherwise, so
+// timestamps come back the same way they do from SQLite.
+func postgresSource(dsn string) string {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return dsn
+	}
+	q := u.Query()
+	if q.Get("timezone") == "" {
+		q.Set("timezone", "UTC")
+		u.RawQuery = q.Encode()
+	}
+	return u.String()
+}
+
+// redactDSN hides the password in a PostgreSQL URL for logs and config output.
+func redactDSN(dsn string) string {
+	if !isPostgresDSN(dsn) {
+		return dsn
+	}
+	if u, err := url.Parse(dsn); err == nil {
+		return u.Redacted()
+	}
+	return dsn
+}
+
+// ddl fills in the dialect's column types.
+func (d *dialect) ddl(stmt string) string {
+	return strings.NewReplacer("{id}", d.autoID, "{time}", d.timestamp, "{real}", d.real).Replace(stmt)
+}
+
+// rebind rewrites ? placeholders as $1, $2, ... for PostgreSQL, leaving
+// quoted strings, identifiers and dollar-quoted bodies ($$...$$) alone.
+func (d *dialect) rebind(query string) string {
+	if !d.numbered || !strings.Contains(query, "?") {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	var quote byte
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '$':
+			if tag := dollarTag(query[i:]); tag != "" && (i == 0 || !isIdentByte(query[i-1])) {
+				end := strings.Index(query[i+len(tag):], tag)
+				if end < 0 {
+					end = len(query) - i - len(tag)
+				} else {
+					end += len(tag)
+				}
+				b.WriteString(query[i : i+len(tag)+end])
+				i += len(tag) + end - 1
+				continue
+			}
+		case c == '?':
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// dollarTag returns the $tag$ that s starts with, or "" if it doesn't open a
+// dollar-quoted string. Tags can't start with a digit, which keeps $1 apart.
+func dollarTag(s string) string {
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '$':
+			return s[:i+1]
+		case !isIdentByte(c) || (i == 1 && c >= '0' && c <= '9'):
+			return ""
+		}
+	}
+	return ""
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c >= 0x80
+}
+
+// timestamp formats a time for a column that is also filled by
+// CURRENT_TIMESTAMP. SQLite compares those as text, so they must match its
+// format exactly.
+func (db *database) timestamp(t time.Time) any {
+	if db.dialect == sqliteDialect {
+		return t.UTC().Format(time.DateTime)
+	}
+	return t
+}
+
+func (db *database) Exec(query string, args ...any) (sql.Result, error) {
+	return db.ExecContext(context.Background(), query, args...)
+}
+
+func (db *database) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return db.DB.ExecContext(ctx, db.dialect.rebind(query), args...)
+}
+
+func (db *database) Query(query string, args ...any) (*sql.Rows, error) {
+	return db.QueryContext(context.Background(), query, args...)
+}
+
+func (db *database) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	return db.DB.QueryContext(ctx, db.dialect.rebind(query), args...)
+}
+
+func (db *database) QueryRow(query string, args ...any) *sql.Row {
+	return db.QueryRowContext(context.Background(), query, args...)
+}
+
+func (db *database) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	return db.DB.QueryRowContext(ctx, db.dialect.rebind(query), args...)
+}
+
+func (db *database) Begin() (*dbTx, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &dbTx{tx, db.dialect}, nil
+}
+
+// dbTx is a transaction that rebinds placeholders like database does.
+type dbTx struct {
+	*sql.Tx
+	dialect *dialect
+}
+
+func (tx *dbTx) Exec(query string, args ...any) (sql.Result, error) {
+	return tx.Tx.Exec(tx.dialect.rebind(query), args...)
+}
+
+func (tx *dbTx) Query(query string, args ...any) (*sql.Rows, error) {
+	return tx.Tx.Query(tx.dialect.rebind(query), args...)
+}
+
+func (tx *dbTx) QueryRow(query string, args ...any) *sql.Row {
+	return tx.Tx.QueryRow(tx.dialect.rebind(query), args...)
+}
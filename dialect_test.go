@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestRebind(t *testing.T) {
+	for _, tc := range []struct{ in, want string }{
+		{`SELECT * FROM albums WHERE id = ?`, `SELECT * FROM albums WHERE id = $1`},
+		{`INSERT INTO t (a, b) VALUES (?, ?)`, `INSERT INTO t (a, b) VALUES ($1, $2)`},
+		{`SELECT '?' FROM t WHERE a = ?`, `SELECT '?' FROM t WHERE a = $1`},
+		{`SELECT "odd?col" FROM t WHERE a = ?`, `SELECT "odd?col" FROM t WHERE a = $1`},
+		{`SELECT 'it''s ?' FROM t WHERE a = ? AND b = 'x'`, `SELECT 'it''s ?' FROM t WHERE a = $1 AND b = 'x'`},
+		{`DO $$ BEGIN RAISE NOTICE '?'; PERFORM ?; END $$; SELECT ?`, `DO $$ BEGIN RAISE NOTICE '?'; PERFORM ?; END $$; SELECT $1`},
+		{`SELECT $fn$ a ? b $fn$, ?`, `SELECT $fn$ a ? b $fn$, $1`},
+		{`SELECT $$ unterminated ?`, `SELECT $$ unterminated ?`},
+		{`SELECT a$b$, ?`, `SELECT a$b$, $1`},
+		{`SELECT 1`, `SELECT 1`},
+	} {
+		if got := postgresDialect.rebind(tc.in); got != tc.want {
+			t.Errorf("rebind(%s)\n = %s\nwant %s", tc.in, got, tc.want)
+		}
+	}
+	if q := `SELECT ? FROM t`; sqliteDialect.rebind(q) != q {
+		t.Error("sqlite query was rewritten")
+	}
+}
+
+func TestDDL(t *testing.T) {
+	stmt := `CREATE TABLE t (id {id}, created_at {time} NOT NULL, rating {real}, note TEXT DEFAULT '{x}')`
+	for d, want := range map[*dialect]string{
+		sqliteDialect:   `CREATE TABLE t (id INTEGER PRIMARY KEY AUTOINCREMENT, created_at DATETIME NOT NULL, rating REAL, note TEXT DEFAULT '{x}')`,
+		postgresDialect: `CREATE TABLE t (id BIGSERIAL PRIMARY KEY, created_at TIMESTAMPTZ NOT NULL, rating DOUBLE PRECISION, note TEXT DEFAULT '{x}')`,
+	} {
+		if got := d.ddl(stmt); got != want {
+			t.Errorf("%s ddl =\n%s\nwant\n%s", d.name, got, want)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+)
+
+// runDoctor prints one line per check and returns the number of problems.
+// Orphaned uploads are reported but don't count as problems.
+func runDoctor(env *cliEnv) int {
+	problems := 0
+	ok := func(format string, a ...any) { fmt.Printf("ok    "+format+"\n", a...) }
+	bad := func(format string, a ...any) {
+		problems++
+		fmt.Printf("FAIL  "+format+"\n", a...)
+	}
+	warn := func(format string, a ...any) { fmt.Printf("warn  "+format+"\n", a...) }
+
+	if err := env.cfg.validate(); err != nil {
+		bad("config: %v", err)
+	} else {
+		ok("config")
+	}
+
+	if env.db.dialect == sqliteDialect {
+		checkSQLite(env.db, ok, bad)
+	} else {
+		var version string
+		if err := env.db.QueryRow(`SHOW server_version`).Scan(&version); err != nil {
+			bad("postgres: %v", err)
+		} else {
+			ok("postgres %s", version)
+		}
+	}
+
+	if has, err := env.store.HasUsers(); err != nil {
+		bad("users: %v", err)
+	} else if !has {
+		bad("no admin users (run 'ditchfork user add' or finish setup in the browser)")
+	} else {
+		ok("admin users exist")
+	}
+
+	uploads, err := env.cfg.newStorage()
+	if err != nil {
+		bad("upload storage: %v", err)
+		return problems
+	}
+	ctx := context.Background()
+	if err := uploads.Check(ctx); err != nil {
+		bad("upload storage %v is not writable: %v", uploads, err)
+	} else {
+		ok("upload storage %v is writable", uploads)
+	}
+	keys, err := uploads.List(ctx)
+	if err != nil {
+		bad("list uploads: %v", err)
+		return problems
+	}
+	stored := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		stored[k] = true
+	}
+
+	reviews, err := env.store.GetFeed()
+	if err != nil {
+		bad("read content: %v", err)
+		return problems
+	}
+	referenced := make(map[string]bool)
+	missing := 0
+	for _, r := range reviews {
+		if r.CoverPath == "" {
+			continue
+		}
+		key := filepath.ToSlash(r.CoverPath)
+		referenced[key] = true
+		if !stored[key] {
+			bad("%s/%s: cover image %s is missing", r.Type, r.Slug, r.CoverPath)
+			missing++
+		}
+	}
+	if missing == 0 {
+		ok("all %d cover images present", len(referenced))
+	}
+
+	// Custom fonts uploaded in Settings are referenced there.
+	if settings, err := env.store.GetAllSettings(); err == nil {
+		for _, key := range []string{settings[SettingFontBrandFile], settings[SettingFontSansFile]} {
+			if key == "" {
+				continue
+			}
+			referenced[key] = true
+			if !stored[key] {
+				bad("custom font %s is missing", key)
+			}
+		}
+	}
+
+	orphans := 0
+	for _, k := range keys {
+		if !referenced[k] {
+			orphans++
+			warn("unreferenced upload %s", k)
+		}
+	}
+	if orphans == 0 {
+		ok("no unreferenced uploads")
+	}
+
+	return problems
+}
+
+// checkSQLite runs SQLite's own consistency checks.
+func checkSQLite(db *database, ok, bad func(string, ...any)) {
+	var integrity string
+	if err := db.QueryRow(`PRAGMA integrity_check`).Scan(&integrity); err != nil {
+		bad("integrity check: %v", err)
+	} else if integrity != "ok" {
+		bad("integrity check: %s", integrity)
+	} else {
+		ok("database integrity")
+	}
+
+	rows, err := db.Query(`PRAGMA foreign_key_check`)
+	if err != nil {
+		bad("foreign key check: %v", err)
+	} else {
+		violations := 0
+		for rows.Next() {
+			violations++
+		}
+		rows.Close()
+		if violations > 0 {
+			bad("foreign key check: %d violation(s)", violations)
+		} else {
+			ok("foreign keys")
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// exportVersion is bumped whenever the export format changes incompatibly.
+const exportVersion = 1
+
+type exportFile struct {
+	Version    int               `json:"version"`
+	ExportedAt time.Time         `json:"exported_at"`
+	Settings   map[string]string `json:"settings"`
+	Reviews    []exportReview    `json:"reviews"`
+}
+
+type exportReview struct {
+	Type        string    `json:"type"`
+	Slug        string    `json:"slug"`
+	Artist      string    `json:"artist,omitempty"`
+	Title       string    `json:"title"`
+	Subheader   string    `json:"subheader,omitempty"`
+	Rating      float64   `json:"rating,omitempty"`
+	Body        string    `json:"body"`
+	CoverPath   string    `json:"cover_path,omitempty"`
+	ArticleType string    `json:"article_type,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// cmdExport writes all content and settings as JSON. Users are left out on
+// purpose: an export is meant to be shareable.
+func cmdExport(env *cliEnv, args []string) int {
+	if len(args) > 1 {
+		return usageError("usage: ditchfork export [file]")
+	}
+
+	reviews, err := env.store.GetFeed()
+	if err != nil {
+		return fail("read content: %v", err)
+	}
+	settings, err := env.store.GetAllSettings()
+	if err != nil {
+		return fail("read settings: %v", err)
+	}
+
+	out := exportFile{
+		Version:    exportVersion,
+		ExportedAt: time.Now().UTC(),
+		Settings:   settings,
+		Reviews:    make([]exportReview, 0, len(reviews)),
+	}
+	for _, r := range reviews {
+		out.Reviews = append(out.Reviews, exportReview{
+			Type: r.Type, Slug: r.Slug, Artist: r.Artist, Title: r.Title, Subheader: r.Subheader,
+			Rating: r.Rating, Body: r.Body, CoverPath: r.CoverPath, ArticleType: r.ArticleType,
+			CreatedAt: r.CreatedAt, UpdatedAt: r.UpdatedAt,
+		})
+	}
+
+	var w io.Writer = os.Stdout
+	if len(args) == 1 {
+		f, err := os.OpenFile(args[0], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return fail("create %s: %v", args[0], err)
+		}
+		defer f.Close()
+		w = f
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(out); err != nil {
+		return fail("write export: %v", err)
+	}
+	if len(args) == 1 {
+		fmt.Fprintf(os.Stderr, "exported %d entries to %s\n", len(out.Reviews), args[0])
+	}
+	return exitOK
+}
+
+func cmdImport(env *cliEnv, args []string) int {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	replace := fs.Bool("replace", false, "overwrite entries whose slug already exists")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() != 1 {
+		return usageError("usage: ditchfork import [--replace] <file>")
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return fail("open %s: %v", fs.Arg(0), err)
+	}
+	defer f.Close()
+	var in exportFile
+	if err := json.NewDecoder(f).Decode(&in); err != nil {
+		return fail("read %s: %v", fs.Arg(0), err)
+	}
+	if in.Version != exportVersion {
+		return fail("unsupported export version %d (expected %d)", in.Version, exportVersion)
+	}
+
+	for k, v := range in.Settings {
+		if allowedSettingKeys[k] {
+			if err := env.store.UpdateSetting(k, v); err != nil {
+				return fail("import setting %s: %v", k, err)
+			}
+		}
+	}
+
+	var created, replaced, skipped int
+	for _, e := range in.Reviews {
+		if !validTable(e.Type) || e.Slug == "" || e.Title == "" {
+			return fail("invalid entry %q (type %q)", e.Slug, e.Type)
+		}
+		r := &Review{
+			Type: e.Type, Slug: e.Slug, Artist: e.Artist, Title: e.Title, Subheader: e.Subheader,
+			Rating: e.Rating, Body: e.Body, CoverPath: e.CoverPath, ArticleType: e.ArticleType,
+			CreatedAt: e.CreatedAt, UpdatedAt: e.UpdatedAt,
+		}
+		existing, err := env.store.GetBySlug(e.Type, e.Slug)
+		switch {
+		case err == nil && !*replace:
+			skipped++
+		case err == nil:
+			r.ID = existing.ID
+			if err := env.store.UpdateReview(e.Type, r); err != nil {
+				return fail("replace %s/%s: %v", e.Type, e.Slug, err)
+			}
+			replaced++
+		default:
+			if err := env.store.ImportReview(e.Type, r); err != nil {
+				return fail("import %s/%s: %v", e.Type, e.Slug, err)
+			}
+			created++
+		}
+	}
+
+	fmt.Printf("imported %d new, %d replaced, %d skipped\n", created, replaced, skipped)
+	if skipped > 0 && !*replace {
+		fmt.Println("(pass --replace to overwrite existing entries)")
+	}
+	return exitOK
+}
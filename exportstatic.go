@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// exportMarker is left in every static export so a later run knows it may
+// replace what's there.
+const exportMarker = ".ditchfork-static"
+
+// exportRoot stands for the site root in links while a page renders. It is
+// then replaced with as many "../" as the page is deep, so the export works
+// from any directory, or straight from disk.
+const exportRoot = "__ditchfork_root__/"
+
+// cmdExportStatic renders the public site through the normal templates into
+// plain files that any static host can serve.
+func cmdExportStatic(env *cliEnv, args []string) int {
+	fs := flag.NewFlagSet("export-static", flag.ContinueOnError)
+	baseURL := fs.String("base-url", "", "absolute URL the export will be published at, e.g. https://example.com/blog (default: relative links)")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() != 1 {
+		return usageError("usage: ditchfork export-static [--base-url URL] <dir>")
+	}
+	dir := fs.Arg(0)
+	base := strings.TrimSuffix(*baseURL, "/")
+	if base != "" {
+		if u, err := url.Parse(base); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return usageError("--base-url must be an http:// or https:// URL")
+		}
+	}
+
+	uploads, err := env.cfg.newStorage()
+	if err != nil {
+		return fail("upload storage: %v", err)
+	}
+	reviews, err := env.store.GetFeed()
+	if err != nil {
+		return fail("read content: %v", err)
+	}
+	if err := prepareExportDir(dir); err != nil {
+		return fail("%v", err)
+	}
+
+	app := &application{
+		store:   env.store,
+		cfg:     env.cfg,
+		uploads: uploads,
+		cards:   &cardCache{dir: env.cfg.Cache.CardDir},
+		themes:  newThemeSet(env.cfg.ThemesDir, func(path string) string { return exportLink(base, path) }),
+	}
+	if base != "" {
+		app.canonical = func(path string) string { return exportLink(base, path) }
+	}
+	pub := newPublicHandler(app)
+
+	pages := []string{"/"}
+	for _, ct := range contentTypeList {
+		pages = append(pages, "/?tab="+ct.Table)
+	}
+	for _, r := range reviews {
+		pages = append(pages, "/music/"+contentTypeMap[r.Type].URLPath+"/"+r.Slug)
+	}
+	for _, page := range pages {
+		req, _ := http.NewRequest(http.MethodGet, page, nil)
+		handler := pub.handleHome
+		if rest, ok := strings.CutPrefix(page, "/music/"); ok {
+			category, slug, _ := strings.Cut(rest, "/")
+			req.SetPathValue("category", category)
+			req.SetPathValue("slug", slug)
+			handler = pub.handleReview
+		}
+		rec := &pageRecorder{header: make(http.Header)}
+		handler(rec, req)
+		if rec.status != http.StatusOK {
+			return fail("render %s: status %d", page, rec.status)
+		}
+		file := strings.TrimPrefix(exportLink("", page), exportRoot)
+		html := strings.ReplaceAll(rec.body.String(), exportRoot, strings.Repeat("../", strings.Count(file, "/")))
+		if err := writeExportFile(dir, file, strings.NewReader(html)); err != nil {
+			return fail("%v", err)
+		}
+	}
+
+	// Sitemaps and link previews need absolute URLs, so they come only with
+	// --base-url.
+	if base != "" {
+		if err := writeExportSitemap(env.store, dir, base, reviews); err != nil {
+			return fail("%v", err)
+		}
+		if err := writeExportCards(app, dir, reviews); err != nil {
+			return fail("%v", err)
+		}
+	}
+
+	settings, err := env.store.GetAllSettings()
+	if err != nil {
+		return fail("read settings: %v", err)
+	}
+	for name, f := range app.theme(settings).assets.files {
+		if err := writeExportFile(dir, "static/"+name, bytes.NewReader(f.data)); err != nil {
+			return fail("%v", err)
+		}
+	}
+
+	copied, missing := 0, 0
+	seen := make(map[string]bool)
+	for _, r := range reviews {
+		key := filepath.ToSlash(r.CoverPath)
+		if key == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		if err := exportUpload(uploads, dir, key); err != nil {
+			fmt.Fprintf(os.Stderr, "ditchfork: %s/%s: cover %s: %v\n", r.Type, r.Slug, key, err)
+			missing++
+			continue
+		}
+		copied++
+	}
+	if settings[SettingFontPairing] == customFontPairing {
+		for _, key := range []string{settings[SettingFontBrandFile], settings[SettingFontSansFile]} {
+			if !validFontKey(key) {
+				continue
+			}
+			if err := exportUpload(uploads, dir, key); err != nil {
+				fmt.Fprintf(os.Stderr, "ditchfork: custom font %s: %v\n", key, err)
+				missing++
+			}
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, exportMarker), nil, 0644); err != nil {
+		return fail("%v", err)
+	}
+	fmt.Printf("exported %d pages and %d cover images to %s\n", len(pages), copied, dir)
+	if missing > 0 {
+		return fail("%d upload(s) could not be copied", missing)
+	}
+	return exitOK
+}
+
+// exportLink maps a site path to where it lives in the export: pages become
+// directories with an index.html, and ?tab= pages get a directory of their
+// own. Relative links name the index.html files so they also work from disk.
+func exportLink(base, path string) string {
+	target, query, _ := strings.Cut(path, "?")
+	file := strings.TrimPrefix(target, "/")
+	switch {
+	case strings.HasPrefix(query, "tab="):
+		table := strings.TrimPrefix(query, "tab=")
+		if ct, ok := contentTypeMap[table]; ok {
+			file = ct.URLPath + "/"
+		}
+	case strings.HasPrefix(file, "static/"), strings.HasPrefix(file, "uploads/"), strings.HasPrefix(file, "cards/"),
+		strings.HasPrefix(file, "sitemaps/"), file == "sitemap.xml", file == "robots.txt":
+	case file != "" && !strings.HasSuffix(file, "/"):
+		file += "/"
+	}
+	if base != "" {
+		return base + "/" + file
+	}
+	if file == "" || strings.HasSuffix(file, "/") {
+		file += "index.html"
+	}
+	return exportRoot + file
+}
+
+// prepareExportDir creates dir, or empties one left by an earlier export.
+// Dotfiles such as .git are kept, so the export can live in a repository.
+func prepareExportDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return os.MkdirAll(dir, 0755)
+	}
+	if err != nil {
+		return err
+	}
+	var visible []string
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), ".") {
+			visible = append(visible, e.Name())
+		}
+	}
+	if len(visible) == 0 {
+		return nil
+	}
+	if _, err := os.Stat(filepath.Join(dir, exportMarker)); err != nil {
+		return fmt.Errorf("%s is not empty and was not written by export-static", dir)
+	}
+	for _, name := range visible {
+		if err := os.RemoveAll(filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeExportSitemap writes sitemap.xml, split as the server would split it,
+// and a robots.txt pointing to it.
+func writeExportSitemap(store Store, dir, base string, reviews []Review) error {
+	link := func(path string) string { return exportLink(base, path) }
+	urls := sitemapURLs(reviews, link)
+	var buf bytes.Buffer
+	if pages := sitemapPages(urls); pages > 1 {
+		for n := 1; n <= pages; n++ {
+			buf.Reset()
+			if err := writeSitemap(&buf, sitemapPage(urls, n)); err != nil {
+				return err
+			}
+			if err := writeExportFile(dir, strings.TrimPrefix(sitemapFile(n), "/"), &buf); err != nil {
+				return err
+			}
+		}
+		buf.Reset()
+		if err := writeSitemapIndex(&buf, urls, link); err != nil {
+			return err
+		}
+	} else if err := writeSitemap(&buf, urls); err != nil {
+		return err
+	}
+	if err := writeExportFile(dir, "sitemap.xml", &buf); err != nil {
+		return err
+	}
+
+	settings, err := store.GetAllSettings()
+	if err != nil {
+		return err
+	}
+	u, _ := url.Parse(base)
+	robots := robotsTxt(settings, u.Path+"/admin/", link("/sitemap.xml"))
+	return writeExportFile(dir, "robots.txt", strings.NewReader(robots))
+}
+
+// writeExportCards copies each review's link preview card, drawing those
+// the server hasn't yet.
+func writeExportCards(app *application, dir string, reviews []Review) error {
+	settings, err := app.store.GetAllSettings()
+	if err != nil {
+		return err
+	}
+	for i := range reviews {
+		r := &reviews[i]
+		path, _, err := app.cards.get(context.Background(), r, settings, app.uploads)
+		if err != nil {
+			return fmt.Errorf("card for %s/%s: %w", r.Type, r.Slug, err)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		err = writeExportFile(dir, "cards/"+contentTypeMap[r.Type].URLPath+"/"+r.Slug+".png", f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeExportFile(dir, name string, r io.Reader) error {
+	path := filepath.Join(dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func exportUpload(uploads storage, dir, key string) error {
+	if !fs.ValidPath(key) {
+		return errors.New("invalid path")
+	}
+	rc, _, err := uploads.Open(context.Background(), key)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return writeExportFile(dir, "uploads/"+key, rc)
+}
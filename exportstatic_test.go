@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExportStatic(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.UploadDir = t.TempDir()
+	cfg.Cache.CardDir = t.TempDir()
+	cfg.ThemesDir = t.TempDir()
+	store := newMemStore()
+	uploads := &localStorage{dir: cfg.UploadDir}
+	if err := uploads.Put(context.Background(), "2024/06/cover.png", strings.NewReader("png"), "image/png"); err != nil {
+		t.Fatal(err)
+	}
+	store.CreateReview("albums", &Review{Slug: "boards-geogaddi", Artist: "Boards", Title: "Geogaddi", Rating: 9.1,
+		CoverPath: "2024/06/cover.png"})
+	env := &cliEnv{cfg: cfg, store: store}
+
+	dir := t.TempDir()
+	if code := cmdExportStatic(env, []string{dir}); code != exitOK {
+		t.Fatalf("exit code %d", code)
+	}
+	read := func(name string) string {
+		t.Helper()
+		data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	home := read("index.html")
+	for _, want := range []string{`href="music/albums/boards-geogaddi/index.html"`, `href="albums/index.html"`,
+		`src="uploads/2024/06/cover.png"`, `href="` + strings.TrimPrefix(assets.path("style.css"), "/")} {
+		if !strings.Contains(home, want) {
+			t.Errorf("home page has no %s", want)
+		}
+	}
+	review := read("music/albums/boards-geogaddi/index.html")
+	if !strings.Contains(review, `src="../../../uploads/2024/06/cover.png"`) {
+		t.Error("review page doesn't link its cover relative to itself")
+	}
+	read("albums/index.html")
+	read("uploads/2024/06/cover.png")
+	read(strings.TrimPrefix(assets.path("style.css"), "/"))
+
+	// A second run replaces the export, this time with absolute links.
+	if code := cmdExportStatic(env, []string{"--base-url", "https://example.com/blog/", dir}); code != exitOK {
+		t.Fatalf("second run exit code %d", code)
+	}
+	if !strings.Contains(read("index.html"), `href="https://example.com/blog/music/albums/boards-geogaddi/"`) {
+		t.Error("--base-url not used in links")
+	}
+	if !strings.Contains(read("sitemap.xml"), "<loc>https://example.com/blog/music/albums/boards-geogaddi/</loc>") {
+		t.Error("sitemap doesn't list the review")
+	}
+	read("cards/albums/boards-geogaddi.png")
+	if !strings.Contains(read("robots.txt"), "Sitemap: https://example.com/blog/sitemap.xml") {
+		t.Error("robots.txt doesn't point to the sitemap")
+	}
+
+	// A directory with someone else's files in it is left alone.
+	other := t.TempDir()
+	os.WriteFile(filepath.Join(other, "notes.txt"), []byte("mine"), 0644)
+	if code := cmdExportStatic(env, []string{other}); code == exitOK {
+		t.Error("exported over a foreign directory")
+	}
+	if _, err := os.Stat(filepath.Join(other, "notes.txt")); err != nil {
+		t.Error("foreign file removed")
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// Fonts are served from /static/ with the rest of the site, so pages make no
+// requests to other origins. A pairing sets the brand face (site title and
+// section headings) and the sans face (navigation, labels, forms); body text
+// stays in the reader's serif.
+
+type fontFace struct {
+	file   string // under static/fonts/
+	weight string // CSS font-weight, a single weight or a range
+}
+
+type fontPairing struct {
+	Name      string
+	Label     string
+	Brand     []fontFace
+	Sans      []fontFace
+	BrandFont string // CSS family names for --font-brand and --font-sans
+	SansFont  string
+}
+
+const (
+	brandFallback = "Georgia, serif"
+	sansFallback  = "-apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, sans-serif"
+
+	// customFontPairing uses the files uploaded in Settings.
+	customFontPairing = "custom"
+)
+
+// fontPairings are the bundled choices, in the order Settings lists them.
+var fontPairings = []fontPairing{
+	{
+		Name:      "grotesk-lora",
+		Label:     "Space Grotesk and Lora",
+		Brand:     []fontFace{{"Lora.ttf", "400 700"}},
+		Sans:      []fontFace{{"SpaceGrotesk.ttf", "300 700"}},
+		BrandFont: "'Lora'",
+		SansFont:  "'Space Grotesk'",
+	},
+	{
+		Name:  "system",
+		Label: "System fonts (no downloads)",
+	},
+}
+
+func findFontPairing(name string) *fontPairing {
+	for i := range fontPairings {
+		if fontPairings[i].Name == name {
+			return &fontPairings[i]
+		}
+	}
+	return nil
+}
+
+func validFontPairing(name string) bool {
+	return name == customFontPairing || findFontPairing(name) != nil
+}
+
+// fontCSS declares the faces of the chosen pairing and points --font-brand
+// and --font-sans at them, with asset giving a static file's URL and link
+// turning site paths into URLs. It goes inside the page's <style>.
+func fontCSS(settings map[string]string, asset, link func(string) string) template.CSS {
+	var b strings.Builder
+	face := func(family, url, weight string) {
+		fmt.Fprintf(&b, "@font-face { font-family: %s; src: url(%q); font-weight: %s; font-display: swap; }\n", family, url, weight)
+	}
+	brand, sans := brandFallback, sansFallback
+
+	if settings[SettingFontPairing] == customFontPairing {
+		if key := settings[SettingFontBrandFile]; validFontKey(key) {
+			face("'Site Brand'", link("/uploads/"+key), "100 900")
+			brand = "'Site Brand', " + brand
+		}
+		if key := settings[SettingFontSansFile]; validFontKey(key) {
+			face("'Site Sans'", link("/uploads/"+key), "100 900")
+			sans = "'Site Sans', " + sans
+		}
+	} else {
+		p := findFontPairing(settings[SettingFontPairing])
+		if p == nil {
+			p = findFontPairing(settingDefaults[SettingFontPairing])
+		}
+		// A build without the font files (see make fonts) declares no faces
+		// rather than ones that 404; readers who have the family installed
+		// still get it.
+		for _, f := range p.Brand {
+			if assets.has("fonts/" + f.file) {
+				face(p.BrandFont, asset("fonts/"+f.file), f.weight)
+			}
+		}
+		for _, f := range p.Sans {
+			if assets.has("fonts/" + f.file) {
+				face(p.SansFont, asset("fonts/"+f.file), f.weight)
+			}
+		}
+		if p.BrandFont != "" {
+			brand = p.BrandFont + ", " + brand
+		}
+		if p.SansFont != "" {
+			sans = p.SansFont + ", " + sans
+		}
+	}
+	fmt.Fprintf(&b, ":root { --font-brand: %s; --font-sans: %s; }", brand, sans)
+	return template.CSS(b.String())
+}
+
+// fontContentTypes are the font formats the site serves, which the mime
+// package doesn't know about.
+var fontContentTypes = map[string]string{
+	".woff2": "font/woff2",
+	".woff":  "font/woff",
+	".ttf":   "font/ttf",
+	".otf":   "font/otf",
+}
+
+// maxFontSize bounds a custom font upload; web fonts are rarely over 500 KB.
+const maxFontSize = 2 << 20
+
+// fontSignatures are the first bytes of each font format, which must match
+// the file's extension.
+var fontSignatures = map[string][][]byte{
+	".woff2": {[]byte("wOF2")},
+	".woff":  {[]byte("wOFF")},
+	".ttf":   {{0x00, 0x01, 0x00, 0x00}, []byte("true")},
+	".otf":   {[]byte("OTTO")},
+}
+
+// validFontKey accepts only the keys saveFontUpload makes, since they end
+// up in CSS.
+func validFontKey(key string) bool {
+	name, ok := strings.CutPrefix(key, "fonts/")
+	if !ok || name == "" || fontContentTypes[path.Ext(name)] == "" {
+		return false
+	}
+	for _, c := range strings.TrimSuffix(name, path.Ext(name)) {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// readFontUpload checks an uploaded font and returns its contents and storage
+// key.
+func readFontUpload(file multipart.File, header *multipart.FileHeader) ([]byte, string, error) {
+	ext := strings.ToLower(path.Ext(header.Filename))
+	signatures, ok := fontSignatures[ext]
+	if !ok {
+		return nil, "", fmt.Errorf("%s: unsupported font type (allowed: woff2, woff, ttf, otf)", header.Filename)
+	}
+	if header.Size > maxFontSize {
+		return nil, "", fmt.Errorf("%s: font too large (max 2 MB)", header.Filename)
+	}
+	data, err := io.ReadAll(io.LimitReader(file, maxFontSize+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(data) > maxFontSize {
+		return nil, "", fmt.Errorf("%s: font too large (max 2 MB)", header.Filename)
+	}
+	for _, sig := range signatures {
+		if bytes.HasPrefix(data, sig) {
+			return data, fmt.Sprintf("fonts/%d%s", time.Now().UnixNano(), ext), nil
+		}
+	}
+	return nil, "", fmt.Errorf("%s: not a %s font file", header.Filename, strings.TrimPrefix(ext, "."))
+}
+
+// saveFontUploads stores the font files posted with the settings form and
+// records them in the settings, deleting the files they replace.
+func (h *adminHandler) saveFontUploads(r *http.Request, previous map[string]string) error {
+	for field, setting := range map[string]string{"font_brand_upload": SettingFontBrandFile, "font_sans_upload": SettingFontSansFile} {
+		file, header, err := r.FormFile(field)
+		if err != nil {
+			continue // nothing uploaded
+		}
+		data, key, err := readFontUpload(file, header)
+		file.Close()
+		if err != nil {
+			return err
+		}
+		if err := h.uploads.Put(r.Context(), key, bytes.NewReader(data), fontContentTypes[path.Ext(key)]); err != nil {
+			requestLogger(r).Error("save font", "key", key, "err", err)
+			return errors.New("could not save the font, please try again")
+		}
+		if err := h.store.UpdateSetting(setting, key); err != nil {
+			return err
+		}
+		if old := previous[setting]; validFontKey(old) {
+			if err := h.uploads.Delete(r.Context(), old); err != nil {
+				requestLogger(r).Warn("delete replaced font", "key", old, "err", err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// postFont uploads a font file with the settings form.
+func (s *testSite) postFont(field, filename string, data []byte, form map[string]string) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for k, v := range form {
+		mw.WriteField(k, v)
+	}
+	fw, _ := mw.CreateFormFile(field, filename)
+	fw.Write(data)
+	mw.Close()
+	req := httptest.NewRequest(http.MethodPost, "/admin/settings", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return s.do(req)
+}
+
+func TestBundledFonts(t *testing.T) {
+	s := newTestSite(t).withAdmin("admin")
+
+	rec := s.get("/")
+	body := rec.Body.String()
+	if strings.Contains(body, "googleapis") || strings.Contains(body, "gstatic") {
+		t.Error("page still loads fonts from Google")
+	}
+	expectBody(t, rec, "--font-brand: 'Lora', ")
+	expectBody(t, rec, "--font-sans: 'Space Grotesk', ")
+	if assets.has("fonts/SpaceGrotesk.ttf") {
+		m := regexp.MustCompile(`url\("(/static/fonts/SpaceGrotesk\.[0-9a-f]+\.ttf)"\)`).FindStringSubmatch(body)
+		if m == nil {
+			t.Fatalf("default pairing not declared:\n%s", body)
+		}
+		font := s.get(m[1])
+		expectStatus(t, font, http.StatusOK)
+		if ct := font.Header().Get("Content-Type"); ct != "font/ttf" {
+			t.Errorf("font Content-Type = %q", ct)
+		}
+		if !strings.Contains(font.Header().Get("Cache-Control"), "immutable") {
+			t.Errorf("font Cache-Control = %q", font.Header().Get("Cache-Control"))
+		}
+	} else if strings.Contains(body, "@font-face") {
+		t.Error("fonts declared that aren't bundled")
+	}
+
+	s.login("admin")
+	s.postForm("/admin/settings", url.Values{SettingFontPairing: {"system"}})
+	if body := s.get("/").Body.String(); strings.Contains(body, "@font-face") {
+		t.Error("system pairing declares fonts")
+	}
+
+	// Unknown pairings aren't saved.
+	s.postForm("/admin/settings", url.Values{SettingFontPairing: {"comic-sans"}})
+	if settings, _ := s.store.GetAllSettings(); settings[SettingFontPairing] != "system" {
+		t.Errorf("font_pairing = %q", settings[SettingFontPairing])
+	}
+}
+
+func TestCustomFontUpload(t *testing.T) {
+	s := newTestSite(t).withAdmin("admin")
+	s.login("admin")
+
+	rec := s.postFont("font_sans_upload", "Inter.woff2", []byte("wOF2 not really a font"), map[string]string{SettingFontPairing: "custom"})
+	expectBody(t, rec, "Settings saved successfully.")
+	settings, _ := s.store.GetAllSettings()
+	key := settings[SettingFontSansFile]
+	if !validFontKey(key) || settings[SettingFontPairing] != "custom" {
+		t.Fatalf("settings = %v", settings)
+	}
+	rec = s.get("/")
+	expectBody(t, rec, `url("/uploads/`+key+`")`)
+	expectBody(t, rec, "--font-sans: 'Site Sans', ")
+	expectBody(t, rec, "--font-brand: Georgia, serif")
+	if ct := s.get("/uploads/" + key).Header().Get("Content-Type"); ct != "font/woff2" {
+		t.Errorf("uploaded font Content-Type = %q", ct)
+	}
+
+	// A replacement deletes the old file.
+	s.postFont("font_sans_upload", "Inter.ttf", []byte{0, 1, 0, 0, 'x'}, nil)
+	settings, _ = s.store.GetAllSettings()
+	if settings[SettingFontSansFile] == key {
+		t.Fatal("font not replaced")
+	}
+	expectStatus(t, s.get("/uploads/"+key), http.StatusNotFound)
+
+	for name, data := range map[string][]byte{
+		"evil.svg":    []byte("<svg/>"),
+		"fake.woff2":  []byte("<html>"),
+		"big.otf":     append([]byte("OTTO"), make([]byte, maxFontSize)...),
+		"swapped.otf": []byte("wOF2"),
+	} {
+		rec := s.postFont("font_brand_upload", name, data, nil)
+		expectBody(t, rec, "alert-error")
+		if settings, _ := s.store.GetAllSettings(); settings[SettingFontBrandFile] != "" {
+			t.Errorf("%s was accepted", name)
+		}
+	}
+}
@@ -3,7 +3,10 @@ module ditchfork
 go 1.22.0
 
 require (
+	github.com/BurntSushi/toml v1.6.0
+	github.com/lib/pq v1.9.0
 	golang.org/x/crypto v0.31.0
+	golang.org/x/image v0.18.0
 	modernc.org/sqlite v1.34.5
 )
 
@@ -14,6 +17,7 @@ require (
 	github.com/ncruces/go-strftime v0.1.9 // indirect
 	github.com/remyoudompheng/bigfft v0.0.0-20230129092748-24d4a6f8daec // indirect
 	golang.org/x/sys v0.28.0 // indirect
+	golang.org/x/text v0.21.0 // indirect
 	modernc.org/libc v1.55.3 // indirect
 	modernc.org/mathutil v1.6.0 // indirect
 	modernc.org/memory v1.8.0 // indirect
@@ -1,19 +1,19 @@
 package main
 
 import (
-	"database/sql"
 	"html/template"
-	"log"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 type publicHandler struct {
-	db  *sql.DB
-	app *application
+	store Store
+	app   *application
 }
 
 func newPublicHandler(app *application) *publicHandler {
-	return &publicHandler{db: app.db, app: app}
+	return &publicHandler{store: app.store, app: app}
 }
 
 func (h *publicHandler) handleHome(w http.ResponseWriter, r *http.Request) {
@@ -27,24 +27,40 @@ func (h *publicHandler) handleHome(w http.ResponseWriter, r *http.Request) {
 			http.NotFound(w, r)
 			return
 		}
-		reviews, err = dbGetByTable(h.db, tab)
+		reviews, err = h.store.GetByTable(tab)
 	} else {
 		tab = "all"
-		reviews, err = dbGetFeed(h.db)
+		reviews, err = h.store.GetFeed()
 	}
 
 	if err != nil {
-		log.Printf("home: get reviews: %v", err)
+		requestLogger(r).Error("home: get reviews", "err", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
+	// Deleting a review doesn't move the newest update time, so the home page
+	// is validated by ETag alone.
+	settings, _ := h.store.GetAllSettings()
+	parts := []string{h.app.theme(settings).version, tab}
+	for _, rv := range reviews {
+		parts = append(parts, rv.Type, strconv.FormatInt(rv.ID, 10), rv.UpdatedAt.Format(time.RFC3339Nano))
+	}
+	if setValidators(w, r, pageETag(settings, parts...), time.Time{}) {
+		return
+	}
+
 	sectionTitle := "Feed"
+	canonical := "/"
 	if ct, ok := contentTypeMap[tab]; ok {
 		sectionTitle = ct.Plural
+		canonical = "/?tab=" + tab
 	}
 
-	h.app.render(w, "home.html", map[string]any{
+	h.app.render(w, r, "home.html", map[string]any{
+		"Settings":     settings,
+		"Canonical":    h.app.canonicalURL(canonical),
+		"PageURL":      h.app.absoluteURL(r, canonical),
 		"Reviews":      reviews,
 		"ActiveTab":    tab,
 		"SectionTitle": sectionTitle,
@@ -62,13 +78,39 @@ func (h *publicHandler) handleReview(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	review, err := dbGetBySlug(h.db, ct.Table, slug)
+	review, err := h.store.GetBySlug(ct.Table, slug)
 	if err != nil {
 		http.NotFound(w, r)
 		return
 	}
 
-	h.app.render(w, "review.html", map[string]any{
+	settings, _ := h.store.GetAllSettings()
+	etag := pageETag(settings, h.app.theme(settings).version, review.Type, strconv.FormatInt(review.ID, 10), review.UpdatedAt.Format(time.RFC3339Nano))
+	// The page also changes with the settings and theme.
+	modTime := review.UpdatedAt
+	if c, ok := h.store.(*cachedStore); ok {
+		if changed := c.settingsChanged(); changed.After(modTime) {
+			modTime = changed
+		}
+	}
+	if setValidators(w, r, etag, modTime) {
+		return
+	}
+
+	path := "/music/" + ct.URLPath + "/" + review.Slug
+	pageURL := h.app.absoluteURL(r, path)
+	cardURL := h.app.absoluteURL(r, "/cards/"+ct.URLPath+"/"+review.Slug+".png")
+	imageURL := cardURL
+	if review.CoverPath != "" {
+		imageURL = h.app.absoluteURL(r, "/uploads/"+review.CoverPath)
+	}
+
+	h.app.render(w, r, "review.html", map[string]any{
+		"Settings":       settings,
+		"Canonical":      h.app.canonicalURL(path),
+		"PageURL":        pageURL,
+		"CardURL":        cardURL,
+		"StructuredData": reviewStructuredData(review, ct, settings[SettingSiteTitle], pageURL, imageURL),
 		"Review":         review,
 		"ReviewBodyHTML": template.HTML(review.Body),
 		"MaxRating":      ct.MaxRating,
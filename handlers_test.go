@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestMain(m *testing.M) {
+	// Failed logins and the like log at warn; keep test output readable.
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// testSite is one site served from a memStore, with a cookie jar so tests
+// can log in and stay logged in.
+type testSite struct {
+	t       *testing.T
+	store   *memStore
+	handler http.Handler
+	cookies map[string]*http.Cookie
+}
+
+func newTestSite(t *testing.T, configure ...func(*config)) *testSite {
+	t.Helper()
+	cfg := defaultConfig()
+	cfg.UploadDir = t.TempDir()
+	cfg.Cache.CardDir = t.TempDir()
+	cfg.ThemesDir = t.TempDir()
+	for _, f := range configure {
+		f(cfg)
+	}
+	store := newMemStore()
+	uploads, err := cfg.newStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := newApplication(cfg, store, uploads)
+	return &testSite{
+		t:       t,
+		store:   store,
+		handler: app.routes(),
+		cookies: make(map[string]*http.Cookie),
+	}
+}
+
+// withAdmin creates a user that can log in with password "password123".
+func (s *testSite) withAdmin(username string) *testSite {
+	s.t.Helper()
+	hash, err := hashPassword("password123")
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	if err := s.store.CreateUser(username, hash); err != nil {
+		s.t.Fatal(err)
+	}
+	return s
+}
+
+func (s *testSite) do(req *http.Request) *httptest.ResponseRecorder {
+	for _, c := range s.cookies {
+		req.AddCookie(c)
+	}
+	rec := httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, req)
+	for _, c := range rec.Result().Cookies() {
+		if c.MaxAge < 0 {
+			delete(s.cookies, c.Name)
+		} else {
+			s.cookies[c.Name] = c
+		}
+	}
+	return rec
+}
+
+func (s *testSite) get(path string) *httptest.ResponseRecorder {
+	return s.do(httptest.NewRequest(http.MethodGet, path, nil))
+}
+
+func (s *testSite) postForm(path string, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return s.do(req)
+}
+
+// postMultipart sends form the way the review editor does.
+func (s *testSite) postMultipart(path string, form map[string]string) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for k, v := range form {
+		mw.WriteField(k, v)
+	}
+	mw.Close()
+	req := httptest.NewRequest(http.MethodPost, path, &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return s.do(req)
+}
+
+func (s *testSite) login(username string) {
+	s.t.Helper()
+	rec := s.postForm("/admin/login", url.Values{"username": {username}, "password": {"password123"}})
+	expectRedirect(s.t, rec, "/admin/")
+}
+
+func expectStatus(t *testing.T, rec *httptest.ResponseRecorder, code int) {
+	t.Helper()
+	if rec.Code != code {
+		t.Fatalf("status = %d, want %d; body:\n%s", rec.Code, code, rec.Body)
+	}
+}
+
+func expectRedirect(t *testing.T, rec *httptest.ResponseRecorder, location string) {
+	t.Helper()
+	expectStatus(t, rec, http.StatusSeeOther)
+	if got := rec.Header().Get("Location"); got != location {
+		t.Fatalf("Location = %q, want %q", got, location)
+	}
+}
+
+func expectBody(t *testing.T, rec *httptest.ResponseRecorder, substr string) {
+	t.Helper()
+	if !strings.Contains(rec.Body.String(), substr) {
+		t.Fatalf("body does not contain %q:\n%s", substr, rec.Body)
+	}
+}
+
+func TestSetup(t *testing.T) {
+	s := newTestSite(t)
+
+	expectRedirect(t, s.get("/"), "/setup")
+	expectRedirect(t, s.get("/admin/login"), "/setup")
+	expectStatus(t, s.get("/setup"), http.StatusOK)
+	expectStatus(t, s.get("/healthz"), http.StatusOK)
+
+	rec := s.postForm("/setup", url.Values{"username": {"admin"}, "password": {"short"}})
+	expectStatus(t, rec, http.StatusOK)
+	expectBody(t, rec, "at least 8 characters")
+	if has, _ := s.store.HasUsers(); has {
+		t.Fatal("user created with a short password")
+	}
+
+	rec = s.postForm("/setup", url.Values{
+		"username":   {"admin"},
+		"password":   {"password123"},
+		"site_title": {"Needle Drop"},
+	})
+	expectRedirect(t, rec, "/admin/login")
+	if _, err := s.store.GetUserByUsername("admin"); err != nil {
+		t.Fatalf("admin user not created: %v", err)
+	}
+	if entries, _ := s.store.ListAudit(auditFilter{Action: "user.create"}, 0, 0); len(entries) != 1 || entries[0].TargetID != "admin" {
+		t.Errorf("setup audit entries = %+v", entries)
+	}
+
+	// Setup is closed once a user exists.
+	expectRedirect(t, s.get("/setup"), "/")
+	expectRedirect(t, s.postForm("/setup", url.Values{"username": {"other"}, "password": {"password123"}}), "/")
+	if _, err := s.store.GetUserByUsername("other"); err == nil {
+		t.Fatal("second setup created a user")
+	}
+
+	expectBody(t, s.get("/"), "Needle Drop")
+}
+
+func TestPublicPages(t *testing.T) {
+	s := newTestSite(t).withAdmin("admin")
+	s.store.CreateReview("albums", &Review{Slug: "boards-geogaddi", Artist: "Boards", Title: "Geogaddi", Rating: 9.1, Body: "<p>Eerie.</p>"})
+	s.store.CreateReview("songs", &Review{Slug: "rival-hold", Artist: "Rival", Title: "Hold", Rating: 6})
+
+	tests := []struct {
+		path string
+		code int
+		want string
+	}{
+		{"/", http.StatusOK, "Geogaddi"},
+		{"/?tab=songs", http.StatusOK, "Hold"},
+		{"/?tab=users", http.StatusNotFound, ""},
+		{"/music/albums/boards-geogaddi", http.StatusOK, "<p>Eerie.</p>"},
+		{"/music/albums/rival-hold", http.StatusNotFound, ""},
+		{"/music/films/boards-geogaddi", http.StatusNotFound, ""},
+		{"/nope", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			rec := s.get(tt.path)
+			expectStatus(t, rec, tt.code)
+			expectBody(t, rec, tt.want)
+		})
+	}
+
+	if body := s.get("/?tab=songs").Body.String(); strings.Contains(body, "Geogaddi") {
+		t.Error("songs tab lists an album")
+	}
+}
+
+func TestLogin(t *testing.T) {
+	s := newTestSite(t).withAdmin("admin")
+
+	expectRedirect(t, s.get("/admin/"), "/admin/login")
+	expectStatus(t, s.get("/admin/login"), http.StatusOK)
+
+	rec := s.postForm("/admin/login", url.Values{"username": {"admin"}, "password": {"wrong-password"}})
+	expectStatus(t, rec, http.StatusOK)
+	expectBody(t, rec, "Invalid credentials")
+	if _, ok := s.cookies[sessionCookieName]; ok {
+		t.Fatal("failed login set a session cookie")
+	}
+	if f, err := s.store.GetLoginFailure(limitScopeUser, "admin"); err != nil || f.Failures != 1 {
+		t.Fatalf("login failure not recorded: %+v, %v", f, err)
+	}
+
+	s.login("admin")
+	if _, err := s.store.GetLoginFailure(limitScopeUser, "admin"); err == nil {
+		t.Error("successful login did not clear the failure count")
+	}
+	expectStatus(t, s.get("/admin/"), http.StatusOK)
+	if n, _ := s.store.CountActiveSessions(); n != 1 {
+		t.Fatalf("active sessions = %d, want 1", n)
+	}
+
+	expectRedirect(t, s.postForm("/admin/logout", nil), "/admin/login")
+	if n, _ := s.store.CountActiveSessions(); n != 0 {
+		t.Fatalf("active sessions after logout = %d, want 0", n)
+	}
+	expectRedirect(t, s.get("/admin/"), "/admin/login")
+}
+
+func TestSessionCookieSecure(t *testing.T) {
+	s := newTestSite(t).withAdmin("admin")
+	login := func(remote, proto string) *http.Cookie {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/admin/login", strings.NewReader("username=admin&password=password123"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Forwarded-Proto", proto)
+		req.RemoteAddr = remote
+		for _, c := range s.do(req).Result().Cookies() {
+			if c.Name == sessionCookieName {
+				return c
+			}
+		}
+		t.Fatal("no session cookie")
+		return nil
+	}
+
+	// Behind a trusted proxy that terminated TLS the cookie is Secure; a
+	// client claiming https itself doesn't get one it can't use.
+	if c := login("127.0.0.1:40000", "https"); !c.Secure {
+		t.Error("cookie behind a TLS proxy is not Secure")
+	}
+	if c := login("192.0.2.1:40000", "https"); c.Secure {
+		t.Error("untrusted X-Forwarded-Proto made the cookie Secure")
+	}
+	if c := login("127.0.0.1:40000", "http"); c.Secure {
+		t.Error("plain HTTP cookie is Secure")
+	}
+}
+
+func TestRequireAuth(t *testing.T) {
+	s := newTestSite(t).withAdmin("admin")
+	s.cookies[sessionCookieName] = &http.Cookie{Name: sessionCookieName, Value: "forged"}
+
+	for _, path := range []string{"/admin/", "/admin/settings", "/admin/reviews/new", "/admin/audit", "/admin/users"} {
+		expectRedirect(t, s.get(path), "/admin/login")
+	}
+	expectRedirect(t, s.postMultipart("/admin/reviews", map[string]string{"type": "albums", "title": "x"}), "/admin/login")
+	if n, _ := s.store.CountContent("albums"); n != 0 {
+		t.Fatal("unauthenticated request created a review")
+	}
+}
+
+func TestAdminReviews(t *testing.T) {
+	s := newTestSite(t).withAdmin("admin")
+	s.login("admin")
+
+	expectStatus(t, s.get("/admin/reviews/new"), http.StatusOK)
+
+	rec := s.postMultipart("/admin/reviews", map[string]string{"type": "films", "title": "Heat"})
+	expectStatus(t, rec, http.StatusBadRequest)
+
+	rec = s.postMultipart("/admin/reviews", map[string]string{"type": "albums", "artist": "Boards", "title": "Geogaddi", "rating": "11"})
+	expectStatus(t, rec, http.StatusOK)
+	expectBody(t, rec, "Rating must be between 0 and 10.0")
+
+	rec = s.postMultipart("/admin/reviews", map[string]string{
+		"type": "albums", "artist": "Boards", "title": "Geogaddi", "rating": "9.1", "body": "Eerie.",
+	})
+	expectRedirect(t, rec, "/admin/")
+	r, err := s.store.GetBySlug("albums", "boards-geogaddi")
+	if err != nil {
+		t.Fatalf("review not created: %v", err)
+	}
+	if r.Rating != 9.1 || r.Body != "Eerie." {
+		t.Errorf("created review = %+v", r)
+	}
+	expectBody(t, s.get("/admin/"), "Geogaddi")
+
+	// The same artist and title again gets a numbered slug.
+	s.postMultipart("/admin/reviews", map[string]string{"type": "albums", "artist": "Boards", "title": "Geogaddi", "rating": "5"})
+	if _, err := s.store.GetBySlug("albums", "boards-geogaddi-2"); err != nil {
+		t.Errorf("duplicate review did not get a numbered slug: %v", err)
+	}
+
+	id := strconv.FormatInt(r.ID, 10)
+	expectStatus(t, s.get("/admin/albums/"+id+"/edit"), http.StatusOK)
+	rec = s.postMultipart("/admin/albums/"+id, map[string]string{
+		"artist": "Boards", "title": "Music Has the Right", "rating": "9.5", "body": "Eerie.",
+	})
+	expectRedirect(t, rec, "/admin/")
+	r, err = s.store.GetByID("albums", r.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Slug != "boards-music-has-the-right" || r.Rating != 9.5 {
+		t.Errorf("updated review = %+v", r)
+	}
+	expectStatus(t, s.get("/music/albums/boards-music-has-the-right"), http.StatusOK)
+	expectStatus(t, s.postMultipart("/admin/songs/"+id, map[string]string{"artist": "a", "title": "b"}), http.StatusNotFound)
+
+	expectRedirect(t, s.postForm("/admin/albums/"+id+"/delete", nil), "/admin/")
+	if _, err := s.store.GetByID("albums", r.ID); err == nil {
+		t.Error("review not deleted")
+	}
+	expectStatus(t, s.get("/music/albums/boards-music-has-the-right"), http.StatusNotFound)
+	expectStatus(t, s.postForm("/admin/albums/"+id+"/delete", nil), http.StatusNotFound)
+
+	actions, _ := s.store.ListAuditActions()
+	if got := strings.Join(actions, ","); got != "review.create,review.delete,review.update" {
+		t.Errorf("audited actions = %s", got)
+	}
+	entries, _ := s.store.ListAudit(auditFilter{Action: "review.delete"}, 0, 0)
+	if len(entries) != 1 || entries[0].Username != "admin" || entries[0].TargetID != id {
+		t.Errorf("delete audit entries = %+v", entries)
+	}
+}
+
+func TestAdminSettings(t *testing.T) {
+	s := newTestSite(t).withAdmin("admin")
+	s.login("admin")
+
+	expectStatus(t, s.get("/admin/settings"), http.StatusOK)
+
+	rec := s.postForm("/admin/settings", url.Values{
+		SettingSiteTitle:   {"Needle Drop"},
+		SettingAccentColor: {"#336699"},
+		"not_a_setting":    {"x"},
+	})
+	expectStatus(t, rec, http.StatusOK)
+	expectBody(t, rec, "Settings saved successfully.")
+
+	settings, _ := s.store.GetAllSettings()
+	if settings[SettingSiteTitle] != "Needle Drop" || settings[SettingAccentColor] != "#336699" {
+		t.Errorf("settings = %v", settings)
+	}
+	if _, ok := settings["not_a_setting"]; ok {
+		t.Error("unknown setting was saved")
+	}
+	if settings[SettingNavBgColor] != settingDefaults[SettingNavBgColor] {
+		t.Error("omitted setting was changed")
+	}
+	expectBody(t, s.get("/"), "Needle Drop")
+
+	entries, _ := s.store.ListAudit(auditFilter{Action: "settings.update"}, 0, 0)
+	if len(entries) != 1 {
+		t.Errorf("settings audit entries = %d, want 1", len(entries))
+	}
+}
+
+func TestPasswordChangeLimited(t *testing.T) {
+	s := newTestSite(t, func(c *config) {
+		c.Login.BackoffAfter = 100
+		c.Login.LockoutThreshold = 3
+	}).withAdmin("admin")
+	s.login("admin")
+	change := func(current string) *httptest.ResponseRecorder {
+		return s.postForm("/admin/password", url.Values{
+			"current_password": {current}, "new_password": {"hunter2hunter2"}, "confirm_password": {"hunter2hunter2"},
+		})
+	}
+
+	for i := 0; i < 3; i++ {
+		expectBody(t, change("guess"+strconv.Itoa(i)), "Current password is incorrect.")
+	}
+	// Guessing through this form locks the account like failed logins do,
+	// and the right password then waits too.
+	expectBody(t, change("password123"), "This account is temporarily locked.")
+	user, _ := s.store.GetUserByUsername("admin")
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte("password123")) != nil {
+		t.Error("password changed while locked")
+	}
+	if entries, _ := s.store.ListAudit(auditFilter{Action: "user.lockout"}, 0, 0); len(entries) != 1 {
+		t.Errorf("lockout audit entries = %d, want 1", len(entries))
+	}
+}
+
+func TestHealthChecksBeforeHostRouting(t *testing.T) {
+	router := newHostRouter()
+	var apps []*application
+	for _, name := range []string{"rock", "jazz"} {
+		cfg := defaultConfig()
+		cfg.siteName = name
+		cfg.UploadDir = filepath.Join(t.TempDir(), "uploads")
+		os.Mkdir(cfg.UploadDir, 0o755)
+		uploads, err := cfg.newStorage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		app := newApplication(cfg, newMemStore(), uploads)
+		apps = append(apps, app)
+		router.add([]string{name + ".example.com"}, app.routes())
+	}
+	h := healthChecks(apps, router)
+	get := func(host, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Host = host
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	expectStatus(t, get("203.0.113.7:8080", "/"), http.StatusMisdirectedRequest)
+	expectStatus(t, get("203.0.113.7:8080", "/healthz"), http.StatusOK)
+	expectStatus(t, get("203.0.113.7:8080", "/readyz"), http.StatusOK)
+
+	// One site's storage going away fails readiness for the whole server.
+	os.Remove(apps[1].cfg.UploadDir)
+	expectStatus(t, get("203.0.113.7:8080", "/healthz"), http.StatusOK)
+	rec := get("203.0.113.7:8080", "/readyz")
+	expectStatus(t, rec, http.StatusServiceUnavailable)
+	expectBody(t, rec, "jazz: upload storage unavailable")
+}
+
+func TestAuditCSVFormulas(t *testing.T) {
+	s := newTestSite(t).withAdmin("admin")
+	s.store.InsertAudit(&AuditEntry{CreatedAt: time.Now(), Username: "@admin", Action: "review.update",
+		TargetType: "review", TargetID: "-1", Before: "=HYPERLINK(\"http://evil.example\")", After: "+1", IP: "192.0.2.1"})
+	s.login("admin")
+
+	rec := s.get("/admin/audit.csv")
+	expectStatus(t, rec, http.StatusOK)
+	rows, err := csv.NewReader(rec.Body).ReadAll()
+	if err != nil || len(rows) != 2 {
+		t.Fatalf("rows = %q, %v", rows, err)
+	}
+	want := []string{"'@admin", "review.update", "review", "'-1", "'=HYPERLINK(\"http://evil.example\")", "'+1", "192.0.2.1"}
+	if got := rows[1][1:]; !slices.Equal(got, want) {
+		t.Errorf("row = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var nonceAttr = regexp.MustCompile(`<style nonce="([^"]+)">`)
+
+// pageNonce checks that the page's inline style carries the nonce its
+// policy allows, and returns it.
+func pageNonce(t *testing.T, rec *httptest.ResponseRecorder) string {
+	t.Helper()
+	m := nonceAttr.FindStringSubmatch(rec.Body.String())
+	if m == nil {
+		t.Fatalf("inline style has no nonce:\n%s", rec.Body)
+	}
+	if csp := rec.Header().Get("Content-Security-Policy"); !strings.Contains(csp, "style-src 'self' 'nonce-"+m[1]+"'") {
+		t.Fatalf("CSP %q doesn't allow the page's nonce %q", csp, m[1])
+	}
+	return m[1]
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	s := newTestSite(t).withAdmin("admin")
+	rec := s.get("/")
+	for header, want := range map[string]string{
+		"X-Content-Type-Options": "nosniff",
+		"X-Frame-Options":        "SAMEORIGIN",
+		"Referrer-Policy":        "strict-origin-when-cross-origin",
+	} {
+		if got := rec.Header().Get(header); got != want {
+			t.Errorf("%s = %q, want %q", header, got, want)
+		}
+	}
+	if !strings.Contains(rec.Header().Get("Permissions-Policy"), "camera=()") {
+		t.Errorf("Permissions-Policy = %q", rec.Header().Get("Permissions-Policy"))
+	}
+	csp := rec.Header().Get("Content-Security-Policy")
+	for _, want := range []string{"default-src 'self'", "font-src 'self'", "img-src 'self'", "frame-src 'self';", "object-src 'none'"} {
+		if !strings.Contains(csp, want) {
+			t.Errorf("CSP %q lacks %q", csp, want)
+		}
+	}
+	if strings.Contains(csp, "unsafe-inline") || strings.Contains(csp, "https:") || strings.Contains(csp, "*") {
+		t.Errorf("CSP is too loose: %q", csp)
+	}
+	if pageNonce(t, rec) == pageNonce(t, s.get("/")) {
+		t.Error("two requests got the same nonce")
+	}
+
+	// The review form's script runs under the nonce too.
+	s.login("admin")
+	rec = s.get("/admin/reviews/new")
+	expectBody(t, rec, `<script nonce="`+pageNonce(t, rec)+`">`)
+	if strings.Contains(rec.Body.String(), "onclick=") {
+		t.Error("review form still has inline event handlers")
+	}
+
+	// Covers redirect to the bucket, so it must be allowed as an image source.
+	bucket, err := newS3Storage(s3Config{Endpoint: "https://s3.example.com", Bucket: "covers"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &application{cfg: defaultConfig(), uploads: bucket}
+	app.cfg.Storage.Serve = "redirect"
+	if csp := app.contentSecurityPolicy("n", nil); !strings.Contains(csp, "img-src 'self' https://covers.s3.example.com;") {
+		t.Errorf("redirect CSP = %q", csp)
+	}
+}
+
+func TestNonceWithPageCache(t *testing.T) {
+	s := newTestSite(t, func(c *config) { c.Cache.Pages = true }).withAdmin("admin")
+	first := s.get("/")
+	second := s.get("/")
+	if pageNonce(t, first) == pageNonce(t, second) {
+		t.Error("cached page replayed its nonce")
+	}
+
+	// A 304 must not replace the policy the browser's copy came with.
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("If-None-Match", second.Header().Get("ETag"))
+	rec := s.do(req)
+	expectStatus(t, rec, http.StatusNotModified)
+	if csp := rec.Header().Get("Content-Security-Policy"); csp != "" {
+		t.Errorf("304 carries CSP %q", csp)
+	}
+}
+
+func TestEmbedOrigins(t *testing.T) {
+	s := newTestSite(t).withAdmin("admin")
+	s.login("admin")
+
+	rec := s.postForm("/admin/settings", url.Values{
+		SettingEmbedOrigins: {"https://www.YouTube-nocookie.com/\r\nhttps://w.soundcloud.com"},
+	})
+	expectBody(t, rec, "Settings saved successfully.")
+	csp := s.get("/").Header().Get("Content-Security-Policy")
+	if !strings.Contains(csp, "frame-src 'self' https://www.youtube-nocookie.com https://w.soundcloud.com;") {
+		t.Errorf("CSP = %q", csp)
+	}
+
+	for _, bad := range []string{"http://example.com", "https://example.com/path", "*", "https://a.com;script-src", "'unsafe-inline'"} {
+		rec := s.postForm("/admin/settings", url.Values{SettingEmbedOrigins: {bad}})
+		expectBody(t, rec, "alert-error")
+		if settings, _ := s.store.GetAllSettings(); settings[SettingEmbedOrigins] != "https://www.youtube-nocookie.com\nhttps://w.soundcloud.com" {
+			t.Errorf("%q changed embed_origins to %q", bad, settings[SettingEmbedOrigins])
+		}
+	}
+
+	// Clearing the field removes them.
+	s.postForm("/admin/settings", url.Values{SettingEmbedOrigins: {""}})
+	if csp := s.get("/").Header().Get("Content-Security-Policy"); !strings.Contains(csp, "frame-src 'self';") {
+		t.Errorf("CSP after clearing = %q", csp)
+	}
+}
@@ -67,11 +67,20 @@ echo "Ditchfork $TAG installed to $INSTALL_DIR/$BINARY_NAME"
 # ── Update path: if already running as a service, restart and exit ────────────
 
 SERVICE_FILE="/etc/systemd/system/ditchfork.service"
+SOCKET_FILE="/etc/systemd/system/ditchfork.socket"
 
 if command -v systemctl > /dev/null 2>&1 && [ -f "$SERVICE_FILE" ]; then
   echo "Existing service detected — restarting..."
+  # In-flight requests are allowed to finish. With the socket unit, systemd
+  # also holds new connections until the new binary is up.
   sudo systemctl restart ditchfork
   echo "Done. Ditchfork $TAG is running."
+  if [ ! -f "$SOCKET_FILE" ]; then
+    echo ""
+    echo "Tip: this install predates socket activation, so visitors may see"
+    echo "connection errors during upgrades. See 'Keeping it running' in the"
+    echo "README to add $SOCKET_FILE."
+  fi
   exit 0
 fi
 
@@ -94,11 +103,24 @@ if command -v systemctl > /dev/null 2>&1; then
     sudo mkdir -p "$DATA_DIR"
     sudo chown ditchfork:ditchfork "$DATA_DIR"
 
-    # Write service file
+    # Write socket and service files. systemd owns the listening socket, so
+    # restarts queue connections instead of refusing them.
+    sudo tee "$SOCKET_FILE" > /dev/null << EOF
+[Unit]
+Description=Ditchfork music blog socket
+
+[Socket]
+ListenStream=8080
+
+[Install]
+WantedBy=sockets.target
+EOF
+
     sudo tee "$SERVICE_FILE" > /dev/null << EOF
 [Unit]
 Description=Ditchfork music blog
 After=network.target
+Requires=ditchfork.socket
 
 [Service]
 ExecStart=$INSTALL_DIR/$BINARY_NAME
@@ -113,6 +135,7 @@ WantedBy=multi-user.target
 EOF
 
     sudo systemctl daemon-reload
+    sudo systemctl enable --now ditchfork.socket
     sudo systemctl enable --now ditchfork
 
     echo ""
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Login failures are counted in SQLite under two scopes: the client IP, which
+// gets an exponential cooldown, and the attempted username, which is locked
+// outright once it crosses the threshold. Counters survive restarts, and the
+// per-username scope slows down guessing spread across many IPs.
+const (
+	limitScopeIP   = "ip"
+	limitScopeUser = "user"
+)
+
+type loginPolicy struct {
+	BackoffAfter     int           // IP failures before the cooldown starts
+	LockoutThreshold int           // username failures before the account locks
+	LockoutDuration  time.Duration // how long a locked account stays locked
+	Window           time.Duration // failures older than this are forgotten
+}
+
+var defaultLoginPolicy = loginPolicy{
+	BackoffAfter:     3,
+	LockoutThreshold: 10,
+	LockoutDuration:  15 * time.Minute,
+	Window:           30 * time.Minute,
+}
+
+type loginLimiter struct {
+	store  Store
+	policy loginPolicy
+}
+
+func newLoginLimiter(store Store, policy loginPolicy) *loginLimiter {
+	return &loginLimiter{store: store, policy: policy}
+}
+
+// runLoginFailureCleanup forgets stale counters every 30 minutes until ctx is
+// cancelled.
+func runLoginFailureCleanup(ctx context.Context, store Store, window time.Duration) {
+	ticker := time.NewTicker(30 * time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := store.CleanLoginFailures(time.Now().UTC().Add(-window)); err != nil {
+				slog.Error("login limiter cleanup", "err", err)
+			}
+		}
+	}
+}
+
+// cooldown returns how long the IP must wait, or 0 if they can try now.
+func (ll *loginLimiter) cooldown(ip string) time.Duration {
+	f, err := ll.store.GetLoginFailure(limitScopeIP, ip)
+	if err != nil || f.Failures < ll.policy.BackoffAfter {
+		return 0
+	}
+	// exponential: 1s, 2s, 4s, 8s … capped at ~8.5 min
+	shift := f.Failures - ll.policy.BackoffAfter
+	if shift > 9 {
+		shift = 9
+	}
+	wait := time.Second * (1 << shift)
+	elapsed := time.Since(f.LastFailure)
+	if elapsed >= wait {
+		return 0
+	}
+	return wait - elapsed
+}
+
+// lockedFor returns how long the username stays locked, or 0.
+func (ll *loginLimiter) lockedFor(username string) time.Duration {
+	f, err := ll.store.GetLoginFailure(limitScopeUser, username)
+	if err != nil || f.LockedUntil.IsZero() {
+		return 0
+	}
+	if wait := time.Until(f.LockedUntil); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// recordFailure counts a failed attempt against both the IP and the username.
+// It reports whether this failure locked the account.
+func (ll *loginLimiter) recordFailure(ip, username string) (bool, error) {
+	now := time.Now().UTC()
+	windowStart := now.Add(-ll.policy.Window)
+	if _, err := ll.store.RecordLoginFailure(limitScopeIP, ip, now, windowStart); err != nil {
+		return false, err
+	}
+	if username == "" {
+		return false, nil
+	}
+	failures, err := ll.store.RecordLoginFailure(limitScopeUser, username, now, windowStart)
+	if err != nil {
+		return false, err
+	}
+	if ll.policy.LockoutThreshold <= 0 || failures < ll.policy.LockoutThreshold {
+		return false, nil
+	}
+	if err := ll.store.LockLogin(limitScopeUser, username, now.Add(ll.policy.LockoutDuration)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (ll *loginLimiter) reset(ip, username string) {
+	ll.store.ClearLoginFailures(limitScopeIP, ip)
+	ll.store.ClearLoginFailures(limitScopeUser, username)
+}
+
+// unlock clears a username's lock and failure count.
+func (ll *loginLimiter) unlock(username string) error {
+	return ll.store.ClearLoginFailures(limitScopeUser, username)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLockoutStartsCountOver(t *testing.T) {
+	db := newTestDB(t, filepath.Join(t.TempDir(), "site.db"))
+	defer db.Close()
+	mem := newMemStore()
+	for name, tc := range map[string]struct {
+		store  Store
+		expire func()
+	}{
+		"sql": {newSQLStore(db), func() {
+			db.Exec(`UPDATE login_failures SET locked_until = ?`, time.Now().UTC().Add(-time.Second))
+		}},
+		"mem": {mem, func() {
+			for _, f := range mem.failures {
+				f.LockedUntil = time.Now().Add(-time.Second)
+			}
+		}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ll := newLoginLimiter(tc.store, loginPolicy{LockoutThreshold: 3, LockoutDuration: time.Minute, Window: time.Hour})
+			fail := func() bool {
+				t.Helper()
+				locked, err := ll.recordFailure("192.0.2.1", "miles")
+				if err != nil {
+					t.Fatal(err)
+				}
+				return locked
+			}
+
+			for i := 1; i <= 3; i++ {
+				if locked := fail(); locked != (i == 3) {
+					t.Fatalf("failure %d: locked = %v", i, locked)
+				}
+			}
+			if ll.lockedFor("miles") == 0 {
+				t.Fatal("not locked")
+			}
+
+			// Once the lock runs out, it takes the full threshold again.
+			tc.expire()
+			if ll.lockedFor("miles") != 0 {
+				t.Fatal("still locked")
+			}
+			for i := 1; i <= 3; i++ {
+				if locked := fail(); locked != (i == 3) {
+					t.Errorf("failure %d after the lock: locked = %v", i, locked)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const requestInfoContextKey contextKey = "request"
+
+// requestInfo follows a request through the middleware. The user is filled in
+// by requireAuth, further down the chain, so it's a pointer the access log can
+// read once the handler returns.
+type requestInfo struct {
+	id   string
+	user string
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestLogger returns the default logger tagged with the request's ID, so
+// every line a handler logs can be matched to its access log entry.
+func requestLogger(r *http.Request) *slog.Logger {
+	if info, ok := r.Context().Value(requestInfoContextKey).(*requestInfo); ok {
+		return slog.With("request_id", info.id)
+	}
+	return slog.Default()
+}
+
+// setRequestUser records the logged-in user for the access log.
+func setRequestUser(r *http.Request, username string) {
+	if info, ok := r.Context().Value(requestInfoContextKey).(*requestInfo); ok {
+		info.user = username
+	}
+}
+
+// statusRecorder captures what the handler wrote.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	n, err := sr.ResponseWriter.Write(b)
+	sr.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (sr *statusRecorder) Unwrap() http.ResponseWriter { return sr.ResponseWriter }
+
+// accessLog assigns each request an ID, returned in X-Request-ID, and logs one
+// line per request to logger. A nil logger only assigns IDs.
+func accessLog(logger *slog.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		info := &requestInfo{id: newRequestID()}
+		w.Header().Set("X-Request-ID", info.id)
+		rec := &statusRecorder{ResponseWriter: w}
+		r = r.WithContext(context.WithValue(r.Context(), requestInfoContextKey, info))
+
+		next.ServeHTTP(rec, r)
+
+		if logger == nil {
+			return
+		}
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		logger.LogAttrs(r.Context(), slog.LevelInfo, "request",
+			slog.String("request_id", info.id),
+			slog.String("method", r.Method),
+			slog.String("path", loggedURI(r.URL)),
+			slog.Int("status", rec.status),
+			slog.Int64("bytes", rec.bytes),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("ip", clientIP(r)),
+			slog.String("user", info.user),
+		)
+	})
+}
+
+// loggedQueryParams are the query parameters whose values are logged; the
+// rest are redacted, as they may carry something a visitor pasted by mistake.
+var loggedQueryParams = map[string]bool{"tab": true, "page": true, "reset": true}
+
+// loggedURI is the request URI as the access log shows it: password reset
+// tokens and unknown query values are replaced with "REDACTED". The log sits
+// outside base_path, so the reset path may come after it.
+func loggedURI(u *url.URL) string {
+	path := u.EscapedPath()
+	if i := strings.Index(path, "/admin/reset/"); i >= 0 {
+		path = path[:i] + "/admin/reset/REDACTED"
+	}
+	if u.RawQuery == "" {
+		return path
+	}
+	query, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return path + "?REDACTED"
+	}
+	for name, values := range query {
+		if !loggedQueryParams[name] {
+			for i := range values {
+				values[i] = "REDACTED"
+			}
+		}
+	}
+	return path + "?" + query.Encode()
+}
+
+// openAccessLog returns the access logger described by the config and the file
+// behind it, if any. The logger is nil when the access log is off.
+func (c *config) openAccessLog() (*slog.Logger, io.Closer, error) {
+	switch c.AccessLog.Path {
+	case "":
+		return nil, nil, nil
+	case "stderr":
+		return slog.Default(), nil, nil
+	}
+	f, err := openRotatingFile(c.AccessLog.Path, int64(c.AccessLog.MaxSize), c.AccessLog.MaxBackups)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The file gets every request regardless of log_level.
+	return slog.New(c.logHandler(f, slog.LevelInfo)), f, nil
+}
+
+// rotatingFile is an append-only log file that is renamed to path.1 (and
+// path.1 to path.2, and so on) once it reaches maxSize. A maxSize of 0 never
+// rotates.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f, rf.size = f, fi.Size()
+	return nil
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			// Keep logging to the current file rather than losing lines.
+			fmt.Fprintf(os.Stderr, "access log rotation failed: %v\n", err)
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *rotatingFile) rotate() error {
+	if err := rf.f.Close(); err != nil {
+		return err
+	}
+	if rf.maxBackups > 0 {
+		for i := rf.maxBackups - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+		}
+		if err := os.Rename(rf.path, rf.path+".1"); err != nil {
+			rf.open()
+			return err
+		}
+	} else if err := os.Remove(rf.path); err != nil {
+		rf.open()
+		return err
+	}
+	return rf.open()
+}
+
+func (rf *rotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.f.Close()
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAccessLogRedacts(t *testing.T) {
+	var buf bytes.Buffer
+	h := accessLog(slog.New(slog.NewJSONHandler(&buf, nil)), http.NotFoundHandler())
+
+	for _, tc := range []struct{ uri, want string }{
+		{"/admin/reset/s3cr3t-t0ken", "/admin/reset/REDACTED"},
+		{"/blog/admin/reset/s3cr3t-t0ken?x=1", "/blog/admin/reset/REDACTED?x=REDACTED"},
+		{"/?tab=singles&page=2", "/?page=2&tab=singles"},
+		{"/music/albums/geogaddi?token=s3cr3t-t0ken&tab=albums", "/music/albums/geogaddi?tab=albums&token=REDACTED"},
+		{"/?%zz=s3cr3t-t0ken", "/?REDACTED"},
+	} {
+		buf.Reset()
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, tc.uri, nil))
+		if strings.Contains(buf.String(), "s3cr3t") {
+			t.Errorf("GET %s logged the secret: %s", tc.uri, buf.String())
+		}
+		var entry struct{ Path string }
+		if err := json.Unmarshal(buf.Bytes(), &entry); err != nil || entry.Path != tc.want {
+			t.Errorf("GET %s logged path %q (%v), want %q", tc.uri, entry.Path, err, tc.want)
+		}
+	}
+}
@@ -1,18 +1,17 @@
 package main
 
 import (
-	"database/sql"
+	"bytes"
 	"embed"
-	"flag"
+	"errors"
 	"fmt"
 	"html/template"
 	"io/fs"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"slices"
 	"time"
-
-	"golang.org/x/crypto/bcrypt"
 )
 
 //go:embed all:templates
@@ -22,120 +21,141 @@ var templateFS embed.FS
 var staticFS embed.FS
 
 type application struct {
-	db        *sql.DB
-	templates map[string]*template.Template
-	uploadDir string
+	db        *database // nil in tests, which only use store
+	store     Store
+	themes    *themeSet
+	cfg       *config
+	uploads   storage
+	pages     *pageCache // nil unless cache.pages is on
+	cards     *cardCache
+	accessLog *slog.Logger // nil when the access log is off
+
+	// canonical turns a site path into the URL search engines should index.
+	// It is nil when no public URL is configured.
+	canonical func(path string) string
 }
 
-func (app *application) render(w http.ResponseWriter, name string, data map[string]any) {
-	tmpl, ok := app.templates[name]
-	if !ok {
-		log.Printf("template %s not found", name)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
-	}
+func (app *application) render(w http.ResponseWriter, r *http.Request, name string, data map[string]any) {
 	if data == nil {
 		data = make(map[string]any)
 	}
 	data["Year"] = time.Now().Year()
-	if _, ok := data["Settings"]; !ok {
-		settings, _ := dbGetAllSettings(app.db)
+	data["Nonce"] = requestNonce(r)
+	settings, ok := data["Settings"].(map[string]string)
+	if !ok {
+		settings, _ = app.store.GetAllSettings()
 		data["Settings"] = settings
 	}
-
-	if err := tmpl.ExecuteTemplate(w, "base", data); err != nil {
-		log.Printf("template error (%s): %v", name, err)
+	theme := app.theme(settings)
+	tmpl, ok := theme.templates[name]
+	if !ok {
+		slog.Error("template not found", "template", name)
+		metrics.templateErrors.add(1, name)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
 	}
-}
 
-func main() {
-	initAdmin := flag.String("init-admin", "", "Create admin user with given username:password and exit")
-	flag.Parse()
-
-	port := envOr("DITCHFORK_PORT", "8080")
-	dbPath := envOr("DITCHFORK_DB_PATH", "./ditchfork.db")
-	uploadDir := envOr("DITCHFORK_UPLOAD_DIR", "./uploads")
-
-	if err := os.MkdirAll(uploadDir, 0755); err != nil {
-		log.Fatalf("create upload dir: %v", err)
+	// Render fully before writing, so a template error is a clean 500 rather
+	// than half a page (which the page cache would then keep). A theme's page
+	// that fails gets another go with the built-in one.
+	var buf bytes.Buffer
+	err := tmpl.ExecuteTemplate(&buf, "base", data)
+	if err != nil && theme != app.themes.builtin {
+		slog.Error("render theme template", "theme", theme.ID, "template", name, "err", err)
+		metrics.templateErrors.add(1, name)
+		buf.Reset()
+		err = app.themes.builtin.templates[name].ExecuteTemplate(&buf, "base", data)
 	}
-
-	db, err := openDB(dbPath)
 	if err != nil {
-		log.Fatalf("open db: %v", err)
+		slog.Error("render template", "template", name, "err", err)
+		metrics.templateErrors.add(1, name)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
 	}
-	defer db.Close()
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	buf.WriteTo(w)
+}
 
-	if err := migrate(db); err != nil {
-		log.Fatalf("migrate: %v", err)
+// cached serves a public page through the page cache when it is on.
+func (app *application) cached(h http.HandlerFunc) http.HandlerFunc {
+	if app.pages == nil {
+		return h
 	}
+	return app.pages.wrap(h)
+}
 
-	if *initAdmin != "" {
-		handleInitAdmin(db, *initAdmin)
-		return
+// siteName labels the site in logs and metrics.
+func (app *application) siteName() string {
+	if app.cfg.siteName == "" {
+		return "default"
 	}
+	return app.cfg.siteName
+}
 
-	templates := parseTemplates()
+// url prefixes an absolute site path with the configured base path.
+func (app *application) url(path string) string {
+	return app.cfg.BasePath + path
+}
 
-	app := &application{
-		db:        db,
-		templates: templates,
-		uploadDir: uploadDir,
+// canonicalURL returns the canonical URL of a public page, or "" without a
+// configured public URL.
+func (app *application) canonicalURL(path string) string {
+	if app.canonical == nil {
+		return ""
 	}
+	return app.canonical(path)
+}
 
-	pub := newPublicHandler(app)
-	auth := newAuthHandler(app)
-	adm := newAdminHandler(app)
-	setup := newSetupHandler(app)
-
-	mux := http.NewServeMux()
-
-	// Static files (embedded)
-	staticSub, _ := fs.Sub(staticFS, "static")
-	mux.Handle("GET /static/", http.StripPrefix("/static/", http.FileServer(http.FS(staticSub))))
-
-	// Uploaded images (filesystem)
-	mux.Handle("GET /uploads/", http.StripPrefix("/uploads/", http.FileServer(http.Dir(uploadDir))))
-
-	// Setup routes
-	mux.HandleFunc("GET /setup", setup.handleSetupForm)
-	mux.HandleFunc("POST /setup", setup.handleSetup)
-
-	// Public routes
-	mux.HandleFunc("GET /{$}", pub.handleHome)
-	mux.HandleFunc("GET /music/{category}/{slug}", pub.handleReview)
-
-	// Auth routes
-	mux.HandleFunc("GET /admin/login", auth.handleLoginForm)
-	mux.HandleFunc("POST /admin/login", auth.handleLogin)
-	mux.HandleFunc("POST /admin/logout", auth.requireAuth(auth.handleLogout))
-
-	// Admin routes (all require auth)
-	mux.HandleFunc("GET /admin/{$}", auth.requireAuth(adm.handleDashboard))
-	mux.HandleFunc("GET /admin/reviews/new", auth.requireAuth(adm.handleNewForm))
-	mux.HandleFunc("POST /admin/reviews", auth.requireAuth(adm.handleCreate))
-	mux.HandleFunc("GET /admin/{type}/{id}/edit", auth.requireAuth(adm.handleEditForm))
-	mux.HandleFunc("POST /admin/{type}/{id}", auth.requireAuth(adm.handleUpdate))
-	mux.HandleFunc("POST /admin/{type}/{id}/delete", auth.requireAuth(adm.handleDelete))
-
-	// Settings
-	mux.HandleFunc("GET /admin/settings", auth.requireAuth(adm.handleSettings))
-	mux.HandleFunc("POST /admin/settings", auth.requireAuth(adm.handleSettingsSave))
+// absoluteURL returns an absolute URL for a site path: the canonical one, or
+// failing that one built from the request. It is "" when neither is known,
+// as in export-static without --base-url.
+func (app *application) absoluteURL(r *http.Request, path string) string {
+	if u := app.canonicalURL(path); u != "" {
+		return u
+	}
+	if r.Host == "" {
+		return ""
+	}
+	return requestOrigin(r) + app.url(path)
+}
 
-	startSessionCleanup(db)
+// requestOrigin is the scheme and host the client used.
+func requestOrigin(r *http.Request) string {
+	if isHTTPS(r) {
+		return "https://" + r.Host
+	}
+	return "http://" + r.Host
+}
 
-	handler := setupGuard(db, mux)
+// redirect sends a 303 to a site path, respecting the base path.
+func (app *application) redirect(w http.ResponseWriter, r *http.Request, path string) {
+	http.Redirect(w, r, app.url(path), http.StatusSeeOther)
+}
 
-	addr := ":" + port
-	log.Printf("ditchfork starting on http://localhost%s", addr)
-	if err := http.ListenAndServe(addr, handler); err != nil {
-		log.Fatalf("server: %v", err)
-	}
+func main() {
+	os.Exit(runCLI(os.Args[1:]))
 }
 
-func parseTemplates() map[string]*template.Template {
-	funcMap := template.FuncMap{
+// templateFuncs are the functions templates call, with link turning site
+// paths into URLs and a holding the static files. Public pages build each
+// link with a single call, so export-static can map whole paths to files.
+func templateFuncs(link func(path string) string, a *staticAssets) template.FuncMap {
+	return template.FuncMap{
+		"url":      link,
+		"asset":    func(name string) string { return link(a.path(name)) },
+		"hasAsset": a.has,
+		"reviewURL": func(table, slug string) string {
+			segment := table
+			if ct, ok := contentTypeMap[table]; ok {
+				segment = ct.URLPath
+			}
+			return link("/music/" + segment + "/" + slug)
+		},
+		"tabURL":    func(table string) string { return link("/?tab=" + table) },
+		"uploadURL": func(key string) string { return link("/uploads/" + key) },
+		"fontCSS": func(settings map[string]string) template.CSS {
+			return fontCSS(settings, func(name string) string { return link(a.path(name)) }, link)
+		},
 		"safeHTML": func(s string) template.HTML { return template.HTML(s) },
 		"typeLabel": func(table string) string {
 			if ct, ok := contentTypeMap[table]; ok {
@@ -176,58 +196,35 @@ func parseTemplates() map[string]*template.Template {
 			return table == "articles"
 		},
 	}
-
-	pages := []string{
-		"templates/home.html",
-		"templates/review.html",
-		"templates/admin/login.html",
-		"templates/admin/dashboard.html",
-		"templates/admin/form.html",
-		"templates/admin/settings.html",
-		"templates/setup.html",
-	}
-
-	templates := make(map[string]*template.Template)
-	for _, page := range pages {
-		tmpl := template.Must(
-			template.New("").Funcs(funcMap).ParseFS(templateFS, "templates/base.html", page),
-		)
-		name := page[len("templates/"):]
-		templates[name] = tmpl
-	}
-	return templates
 }
 
-func handleInitAdmin(db *sql.DB, creds string) {
-	parts := splitOnce(creds, ":")
-	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
-		log.Fatal("--init-admin expects username:password")
-	}
-
-	hash, err := bcrypt.GenerateFromPassword([]byte(parts[1]), bcrypt.DefaultCost)
-	if err != nil {
-		log.Fatalf("hash password: %v", err)
-	}
-
-	if err := dbCreateUser(db, parts[0], string(hash)); err != nil {
-		log.Fatalf("create user: %v", err)
-	}
-
-	fmt.Printf("admin user '%s' created successfully\n", parts[0])
+// pageTemplates are the pages the site renders. Each is parsed together with
+// base.html and the partials in templates/partials/, and a theme may replace
+// any of them.
+var pageTemplates = []string{
+	"home.html",
+	"review.html",
+	"admin/login.html",
+	"admin/dashboard.html",
+	"admin/form.html",
+	"admin/settings.html",
+	"admin/sessions.html",
+	"admin/password.html",
+	"admin/users.html",
+	"admin/reset.html",
+	"admin/audit.html",
+	"setup.html",
 }
 
-func splitOnce(s, sep string) []string {
-	for i := 0; i < len(s); i++ {
-		if s[i] == sep[0] {
-			return []string{s[:i], s[i+1:]}
-		}
+// parsePage parses one page from fsys, which is laid out like templateFS.
+func parsePage(fsys fs.FS, funcs template.FuncMap, page string, partials []string) (*template.Template, error) {
+	files := append(slices.Clone(partials), "templates/base.html", "templates/"+page)
+	tmpl, err := template.New("").Funcs(funcs).ParseFS(fsys, files...)
+	if err != nil {
+		return nil, err
 	}
-	return []string{s}
-}
-
-func envOr(key, fallback string) string {
-	if v := os.Getenv(key); v != "" {
-		return v
+	if tmpl.Lookup("base") == nil {
+		return nil, errors.New(`base.html does not define "base"`)
 	}
-	return fallback
+	return tmpl, nil
 }
@@ -0,0 +1,581 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memStore is an in-memory Store for handler tests. Missing rows come back as
+// sql.ErrNoRows, like they do from sqlStore.
+type memStore struct {
+	mu       sync.Mutex
+	nextID   int64
+	reviews  map[string][]Review
+	users    []User
+	sessions []Session
+	resets   map[string]memReset // by token hash
+	failures map[string]*LoginFailure
+	audit    []AuditEntry
+	settings map[string]string
+}
+
+type memReset struct {
+	userID    int64
+	expiresAt time.Time
+}
+
+var _ Store = (*memStore)(nil)
+
+func newMemStore() *memStore {
+	return &memStore{
+		reviews:  make(map[string][]Review),
+		resets:   make(map[string]memReset),
+		failures: make(map[string]*LoginFailure),
+		settings: make(map[string]string),
+	}
+}
+
+func (m *memStore) id() int64 {
+	m.nextID++
+	return m.nextID
+}
+
+func (m *memStore) Ping(ctx context.Context) error { return nil }
+
+// Reviews
+
+func checkTable(table string) error {
+	if !validTable(table) {
+		return fmt.Errorf("invalid table: %s", table)
+	}
+	return nil
+}
+
+func newestFirst(reviews []Review) []Review {
+	sort.SliceStable(reviews, func(i, j int) bool {
+		if !reviews[i].CreatedAt.Equal(reviews[j].CreatedAt) {
+			return reviews[i].CreatedAt.After(reviews[j].CreatedAt)
+		}
+		return reviews[i].ID > reviews[j].ID
+	})
+	return reviews
+}
+
+func (m *memStore) GetFeed() ([]Review, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var all []Review
+	for _, ct := range contentTypeList {
+		all = append(all, m.reviews[ct.Table]...)
+	}
+	return newestFirst(all), nil
+}
+
+func (m *memStore) GetByTable(table string) ([]Review, error) {
+	if err := checkTable(table); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return newestFirst(append([]Review(nil), m.reviews[table]...)), nil
+}
+
+func (m *memStore) find(table string, match func(*Review) bool) *Review {
+	for i := range m.reviews[table] {
+		if match(&m.reviews[table][i]) {
+			return &m.reviews[table][i]
+		}
+	}
+	return nil
+}
+
+func (m *memStore) GetBySlug(table, slug string) (*Review, error) {
+	if err := checkTable(table); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r := m.find(table, func(r *Review) bool { return r.Slug == slug })
+	if r == nil {
+		return nil, sql.ErrNoRows
+	}
+	c := *r
+	return &c, nil
+}
+
+func (m *memStore) GetByID(table string, id int64) (*Review, error) {
+	if err := checkTable(table); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r := m.find(table, func(r *Review) bool { return r.ID == id })
+	if r == nil {
+		return nil, sql.ErrNoRows
+	}
+	c := *r
+	return &c, nil
+}
+
+func (m *memStore) CreateReview(table string, r *Review) (int64, error) {
+	now := time.Now().UTC()
+	c := *r
+	c.CreatedAt, c.UpdatedAt = now, now
+	if err := m.ImportReview(table, &c); err != nil {
+		return 0, err
+	}
+	return m.nextID, nil
+}
+
+func (m *memStore) UpdateReview(table string, r *Review) error {
+	if err := checkTable(table); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if existing := m.find(table, func(e *Review) bool { return e.ID == r.ID }); existing != nil {
+		created := existing.CreatedAt
+		*existing = *r
+		existing.Type = table
+		existing.CreatedAt = created
+		existing.UpdatedAt = time.Now().UTC()
+	}
+	return nil
+}
+
+func (m *memStore) ImportReview(table string, r *Review) error {
+	if err := checkTable(table); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.find(table, func(e *Review) bool { return e.Slug == r.Slug }) != nil {
+		return fmt.Errorf("UNIQUE constraint failed: %s.slug", table)
+	}
+	c := *r
+	c.ID = m.id()
+	c.Type = table
+	m.reviews[table] = append(m.reviews[table], c)
+	return nil
+}
+
+func (m *memStore) DeleteReview(table string, id int64) error {
+	if err := checkTable(table); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	kept := m.reviews[table][:0]
+	for _, r := range m.reviews[table] {
+		if r.ID != id {
+			kept = append(kept, r)
+		}
+	}
+	m.reviews[table] = kept
+	return nil
+}
+
+func (m *memStore) CountContent(table string) (int, error) {
+	if err := checkTable(table); err != nil {
+		return 0, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.reviews[table]), nil
+}
+
+func (m *memStore) SlugExists(table, slug string) (bool, error) {
+	return m.SlugExistsExcluding(table, slug, 0)
+}
+
+func (m *memStore) SlugExistsExcluding(table, slug string, excludeID int64) (bool, error) {
+	if err := checkTable(table); err != nil {
+		return false, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.find(table, func(r *Review) bool { return r.Slug == slug && r.ID != excludeID }) != nil, nil
+}
+
+// Users
+
+func (m *memStore) HasUsers() (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.users) > 0, nil
+}
+
+func (m *memStore) user(match func(*User) bool) (*User, error) {
+	for _, u := range m.users {
+		if match(&u) {
+			return &u, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *memStore) GetUserByUsername(username string) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.user(func(u *User) bool { return u.Username == username })
+}
+
+func (m *memStore) GetUserByID(id int64) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.user(func(u *User) bool { return u.ID == id })
+}
+
+func (m *memStore) ListUsers() ([]User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	users := append([]User(nil), m.users...)
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users, nil
+}
+
+func (m *memStore) CreateUser(username, passwordHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, err := m.user(func(u *User) bool { return u.Username == username }); err == nil {
+		return fmt.Errorf("UNIQUE constraint failed: users.username")
+	}
+	m.users = append(m.users, User{ID: m.id(), Username: username, PasswordHash: passwordHash})
+	return nil
+}
+
+func (m *memStore) DeleteUser(id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deleteSessions(func(s *Session) bool { return s.UserID == id })
+	m.deleteResets(id)
+	kept := m.users[:0]
+	for _, u := range m.users {
+		if u.ID != id {
+			kept = append(kept, u)
+		}
+	}
+	m.users = kept
+	return nil
+}
+
+func (m *memStore) SetUserPassword(userID int64, passwordHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.setPassword(userID, passwordHash)
+	return nil
+}
+
+func (m *memStore) setPassword(userID int64, passwordHash string) {
+	for i := range m.users {
+		if m.users[i].ID == userID {
+			m.users[i].PasswordHash = passwordHash
+		}
+	}
+	m.deleteSessions(func(s *Session) bool { return s.UserID == userID })
+}
+
+// Sessions
+
+func (m *memStore) CreateSession(s *Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s.ID = m.id()
+	m.sessions = append(m.sessions, *s)
+	return nil
+}
+
+// withUsername fills in the joined username, dropping sessions whose user
+// is gone as the SQL join would.
+func (m *memStore) withUsername(s Session) (Session, bool) {
+	u, err := m.user(func(u *User) bool { return u.ID == s.UserID })
+	if err != nil {
+		return s, false
+	}
+	s.Username = u.Username
+	return s, true
+}
+
+func (m *memStore) GetSession(tokenHash string) (*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, s := range m.sessions {
+		if s.TokenHash == tokenHash {
+			if s, ok := m.withUsername(s); ok {
+				return &s, nil
+			}
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *memStore) ListSessions() ([]Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now().UTC()
+	var sessions []Session
+	for _, s := range m.sessions {
+		if s.ExpiresAt.After(now) {
+			if s, ok := m.withUsername(s); ok {
+				sessions = append(sessions, s)
+			}
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].LastSeenAt.After(sessions[j].LastSeenAt) })
+	return sessions, nil
+}
+
+func (m *memStore) TouchSession(id int64, seen time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.sessions {
+		if m.sessions[i].ID == id {
+			m.sessions[i].LastSeenAt = seen
+		}
+	}
+	return nil
+}
+
+func (m *memStore) deleteSessions(match func(*Session) bool) {
+	kept := m.sessions[:0]
+	for _, s := range m.sessions {
+		if !match(&s) {
+			kept = append(kept, s)
+		}
+	}
+	m.sessions = kept
+}
+
+func (m *memStore) DeleteSession(tokenHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deleteSessions(func(s *Session) bool { return s.TokenHash == tokenHash })
+	return nil
+}
+
+func (m *memStore) DeleteSessionByID(id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deleteSessions(func(s *Session) bool { return s.ID == id })
+	return nil
+}
+
+func (m *memStore) DeleteUserSessions(userID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deleteSessions(func(s *Session) bool { return s.UserID == userID })
+	return nil
+}
+
+func (m *memStore) CountActiveSessions() (int, error) {
+	sessions, err := m.ListSessions()
+	return len(sessions), err
+}
+
+func (m *memStore) CleanExpiredSessions() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now().UTC()
+	m.deleteSessions(func(s *Session) bool { return s.ExpiresAt.Before(now) })
+	return nil
+}
+
+// Password resets
+
+func (m *memStore) deleteResets(userID int64) {
+	for token, r := range m.resets {
+		if r.userID == userID {
+			delete(m.resets, token)
+		}
+	}
+}
+
+func (m *memStore) CreatePasswordReset(userID int64, tokenHash string, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deleteResets(userID)
+	m.resets[tokenHash] = memReset{userID, expiresAt}
+	return nil
+}
+
+func (m *memStore) resetUser(tokenHash string) (*User, error) {
+	r, ok := m.resets[tokenHash]
+	if !ok || !r.expiresAt.After(time.Now()) {
+		return nil, sql.ErrNoRows
+	}
+	return m.user(func(u *User) bool { return u.ID == r.userID })
+}
+
+func (m *memStore) GetPasswordResetUser(tokenHash string) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.resetUser(tokenHash)
+}
+
+func (m *memStore) UsePasswordReset(tokenHash, passwordHash string) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, err := m.resetUser(tokenHash)
+	if err != nil {
+		return nil, err
+	}
+	m.deleteResets(u.ID)
+	m.setPassword(u.ID, passwordHash)
+	u.PasswordHash = passwordHash
+	return u, nil
+}
+
+func (m *memStore) CleanExpiredPasswordResets() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for token, r := range m.resets {
+		if r.expiresAt.Before(now) {
+			delete(m.resets, token)
+		}
+	}
+	return nil
+}
+
+// Login throttling
+
+func (m *memStore) GetLoginFailure(scope, key string) (*LoginFailure, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.failures[scope+"\x00"+key]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	c := *f
+	return &c, nil
+}
+
+func (m *memStore) RecordLoginFailure(scope, key string, now, windowStart time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.failures[scope+"\x00"+key]
+	if !ok {
+		f = &LoginFailure{Scope: scope, Key: key}
+		m.failures[scope+"\x00"+key] = f
+	}
+	if f.LastFailure.Before(windowStart) {
+		f.Failures = 0
+	}
+	f.Failures++
+	f.LastFailure = now
+	return f.Failures, nil
+}
+
+func (m *memStore) LockLogin(scope, key string, until time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if f, ok := m.failures[scope+"\x00"+key]; ok {
+		f.LockedUntil = until
+		f.Failures = 0
+	}
+	return nil
+}
+
+func (m *memStore) ClearLoginFailures(scope, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.failures, scope+"\x00"+key)
+	return nil
+}
+
+func (m *memStore) GetLockedUsers() (map[string]time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	locked := make(map[string]time.Time)
+	for _, f := range m.failures {
+		if f.Scope == limitScopeUser && f.LockedUntil.After(time.Now()) {
+			locked[f.Key] = f.LockedUntil
+		}
+	}
+	return locked, nil
+}
+
+func (m *memStore) CleanLoginFailures(before time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for k, f := range m.failures {
+		if f.LastFailure.Before(before) && f.LockedUntil.Before(now) {
+			delete(m.failures, k)
+		}
+	}
+	return nil
+}
+
+// Audit log
+
+func (m *memStore) InsertAudit(e *AuditEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := *e
+	c.ID = m.id()
+	m.audit = append(m.audit, c)
+	return nil
+}
+
+func (m *memStore) ListAudit(f auditFilter, limit, offset int) ([]AuditEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var entries []AuditEntry
+	for i := len(m.audit) - 1; i >= 0; i-- {
+		e := m.audit[i]
+		if (f.Username != "" && e.Username != f.Username) ||
+			(f.Action != "" && e.Action != f.Action) ||
+			(f.TargetType != "" && e.TargetType != f.TargetType) ||
+			(!f.From.IsZero() && e.CreatedAt.Before(f.From)) ||
+			(!f.To.IsZero() && !e.CreatedAt.Before(f.To)) {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	if limit > 0 {
+		entries = entries[min(offset, len(entries)):min(offset+limit, len(entries))]
+	}
+	return entries, nil
+}
+
+func (m *memStore) ListAuditActions() ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	seen := make(map[string]bool)
+	var actions []string
+	for _, e := range m.audit {
+		if !seen[e.Action] {
+			seen[e.Action] = true
+			actions = append(actions, e.Action)
+		}
+	}
+	sort.Strings(actions)
+	return actions, nil
+}
+
+// Settings
+
+func (m *memStore) GetAllSettings() (map[string]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	settings := make(map[string]string)
+	for k, v := range settingDefaults {
+		settings[k] = v
+	}
+	for k, v := range m.settings {
+		settings[k] = v
+	}
+	return settings, nil
+}
+
+func (m *memStore) UpdateSetting(key, value string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.settings[key] = value
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import "time"
+
+// Link previews and search engines read a page's meta tags (OpenGraph,
+// Twitter) and its schema.org structured data as JSON-LD. Both need
+// absolute URLs; see application.absoluteURL.
+
+// reviewStructuredData describes a review to search engines: a Review of a
+// MusicAlbum or MusicRecording with its rating, or a NewsArticle.
+func reviewStructuredData(review *Review, ct *ContentType, siteTitle, pageURL, imageURL string) map[string]any {
+	site := map[string]any{"@type": "Organization", "name": siteTitle}
+	data := map[string]any{
+		"@context":      "https://schema.org",
+		"author":        site,
+		"publisher":     site,
+		"datePublished": review.CreatedAt.UTC().Format(time.RFC3339),
+		"dateModified":  review.UpdatedAt.UTC().Format(time.RFC3339),
+	}
+	if pageURL != "" {
+		data["url"] = pageURL
+	}
+	if review.Subheader != "" {
+		data["description"] = review.Subheader
+	}
+
+	if review.Type == "articles" {
+		data["@type"] = "NewsArticle"
+		data["headline"] = review.Title
+		if imageURL != "" {
+			data["image"] = []string{imageURL}
+		}
+		if pageURL != "" {
+			data["mainEntityOfPage"] = pageURL
+		}
+		return data
+	}
+
+	item := map[string]any{"@type": "MusicAlbum", "name": review.Title}
+	if review.Type == "songs" {
+		item["@type"] = "MusicRecording"
+	}
+	if review.Artist != "" {
+		item["byArtist"] = map[string]any{"@type": "MusicGroup", "name": review.Artist}
+	}
+	if imageURL != "" {
+		item["image"] = imageURL
+	}
+	data["@type"] = "Review"
+	data["name"] = reviewHeadline(review)
+	data["itemReviewed"] = item
+	data["reviewRating"] = map[string]any{
+		"@type":       "Rating",
+		"ratingValue": review.Rating,
+		"bestRating":  ct.MaxRating,
+		"worstRating": 0,
+	}
+	return data
+}
+
+// reviewHeadline is "Artist — Title", or the title alone.
+func reviewHeadline(review *Review) string {
+	if review.Artist == "" {
+		return review.Title
+	}
+	return review.Artist + " — " + review.Title
+}
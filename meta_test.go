@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+// structuredData decodes a page's JSON-LD.
+func structuredData(t *testing.T, body string) map[string]any {
+	t.Helper()
+	m := regexp.MustCompile(`(?s)<script type="application/ld\+json">(.*?)</script>`).FindStringSubmatch(body)
+	if m == nil {
+		t.Fatal("no JSON-LD on the page")
+	}
+	var data map[string]any
+	if err := json.Unmarshal([]byte(m[1]), &data); err != nil {
+		t.Fatalf("JSON-LD: %v\n%s", err, m[1])
+	}
+	return data
+}
+
+func TestReviewMeta(t *testing.T) {
+	s := newTestSite(t, func(c *config) { c.PublicURL = "https://example.com/reviews" }).withAdmin("admin")
+	s.store.CreateReview("albums", &Review{Slug: "boards-geogaddi", Artist: "Boards", Title: "Geogaddi",
+		Subheader: "Haunted </script> tapes", Rating: 9.1, CoverPath: "2024/06/geogaddi.jpg"})
+	s.store.CreateReview("songs", &Review{Slug: "rival-hold", Artist: "Rival", Title: "Hold", Rating: 6})
+	s.store.CreateReview("articles", &Review{Slug: "tour-news", Title: "Tour news", ArticleType: "News"})
+
+	rec := s.get("/music/albums/boards-geogaddi")
+	for _, want := range []string{
+		`<meta property="og:title" content="Boards — Geogaddi">`,
+		`<meta property="og:description" content="Haunted &lt;/script&gt; tapes">`,
+		`<meta property="og:url" content="https://example.com/reviews/music/albums/boards-geogaddi">`,
+		`<meta property="og:image" content="https://example.com/reviews/cards/albums/boards-geogaddi.png">`,
+		`<meta name="twitter:card" content="summary_large_image">`,
+	} {
+		expectBody(t, rec, want)
+	}
+	data := structuredData(t, rec.Body.String())
+	item, _ := data["itemReviewed"].(map[string]any)
+	rating, _ := data["reviewRating"].(map[string]any)
+	if data["@type"] != "Review" || item["@type"] != "MusicAlbum" || item["name"] != "Geogaddi" {
+		t.Errorf("album structured data: %v", data)
+	}
+	if item["image"] != "https://example.com/reviews/uploads/2024/06/geogaddi.jpg" {
+		t.Errorf("itemReviewed image = %v", item["image"])
+	}
+	if rating["ratingValue"] != 9.1 || rating["bestRating"] != 10.0 {
+		t.Errorf("reviewRating = %v", rating)
+	}
+	if data["description"] != "Haunted </script> tapes" {
+		t.Errorf("description = %v", data["description"])
+	}
+
+	// Without a cover, the card stands in for it.
+	rec = s.get("/music/songs/rival-hold")
+	expectBody(t, rec, `<meta name="twitter:image" content="https://example.com/reviews/cards/songs/rival-hold.png">`)
+	if item, _ := structuredData(t, rec.Body.String())["itemReviewed"].(map[string]any); item["@type"] != "MusicRecording" {
+		t.Errorf("song itemReviewed = %v", item)
+	}
+
+	data = structuredData(t, s.get("/music/articles/tour-news").Body.String())
+	if data["@type"] != "NewsArticle" || data["headline"] != "Tour news" || data["reviewRating"] != nil {
+		t.Errorf("article structured data: %v", data)
+	}
+}
+
+func TestMetaWithoutPublicURL(t *testing.T) {
+	s := newTestSite(t, func(c *config) { c.Cache.Pages = true }).withAdmin("admin")
+	s.store.CreateReview("albums", &Review{Slug: "boards-geogaddi", Artist: "Boards", Title: "Geogaddi", Rating: 9.1})
+
+	// Absolute URLs come from the request, and the page cache keeps each
+	// host's copy apart.
+	expectBody(t, s.get("/"), `<meta property="og:url" content="http://example.com/">`)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Host = "other.example"
+	expectBody(t, s.do(req), `<meta property="og:url" content="http://other.example/">`)
+	expectBody(t, s.get("/music/albums/boards-geogaddi"), `content="http://example.com/music/albums/boards-geogaddi"`)
+
+	// The scheme a proxy reports is believed only from a trusted proxy.
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Forwarded-Proto", "https")
+	expectBody(t, s.do(req), `<meta property="og:url" content="http://example.com/">`)
+	req.RemoteAddr = "127.0.0.1:40000"
+	expectBody(t, s.do(req), `<meta property="og:url" content="https://example.com/">`)
+}
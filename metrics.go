@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics are kept in memory and written in the Prometheus text format by
+// hand; the handful of families here don't justify the client library.
+
+// durationBuckets are upper bounds in seconds, shared by request and query
+// histograms.
+var durationBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// counterVec is a counter family keyed by label values.
+type counterVec struct {
+	mu     sync.Mutex
+	labels []string
+	values map[string]float64
+}
+
+func newCounterVec(labels ...string) *counterVec {
+	return &counterVec{labels: labels, values: make(map[string]float64)}
+}
+
+func (c *counterVec) add(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	c.mu.Lock()
+	c.values[key] += v
+	c.mu.Unlock()
+}
+
+// histogramVec is a histogram family keyed by label values.
+type histogramVec struct {
+	mu     sync.Mutex
+	labels []string
+	series map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(labels ...string) *histogramVec {
+	return &histogramVec{labels: labels, series: make(map[string]*histogram)}
+}
+
+func (h *histogramVec) observe(d time.Duration, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	secs := d.Seconds()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(durationBuckets))}
+		h.series[key] = s
+	}
+	if i := sort.SearchFloat64s(durationBuckets, secs); i < len(durationBuckets) {
+		s.counts[i]++
+	}
+	s.count++
+	s.sum += secs
+}
+
+type metricsRegistry struct {
+	mu    sync.Mutex
+	sites []metricsSite // databases to read gauges from at scrape time
+
+	requests        *counterVec
+	requestDuration *histogramVec
+	templateErrors  *counterVec
+	queryDuration   *histogramVec
+	uploadBytes     *counterVec
+	cacheHits       *counterVec
+	cacheMisses     *counterVec
+}
+
+// metrics is process-wide: the database driver reports into it as well as
+// the HTTP handlers.
+var metrics = &metricsRegistry{
+	requests:        newCounterVec("site", "method", "route", "status"),
+	requestDuration: newHistogramVec("site", "method", "route"),
+	templateErrors:  newCounterVec("template"),
+	queryDuration:   newHistogramVec("statement"),
+	uploadBytes:     newCounterVec(),
+	cacheHits:       newCounterVec("site", "cache"),
+	cacheMisses:     newCounterVec("site", "cache"),
+}
+
+type metricsSite struct {
+	name  string
+	store Store
+}
+
+// addSite registers a site's database for the session and content gauges.
+func (m *metricsRegistry) addSite(name string, store Store) {
+	m.mu.Lock()
+	m.sites = append(m.sites, metricsSite{name, store})
+	m.mu.Unlock()
+}
+
+// instrument records requests by the mux pattern that matched them, so
+// /music/albums/foo and /music/albums/bar share a series.
+func (m *metricsRegistry) instrument(site string, mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = "unmatched"
+		}
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		m.requests.add(1, site, r.Method, route, strconv.Itoa(rec.status))
+		m.requestDuration.observe(time.Since(start), site, r.Method, route)
+	})
+}
+
+// handler serves the metrics page. If token is set, scrapers must send it as
+// a bearer token.
+func (m *metricsRegistry) handler(token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token != "" {
+			got, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		m.write(w)
+	})
+}
+
+func (m *metricsRegistry) write(w io.Writer) {
+	writeCounter(w, "ditchfork_http_requests_total", "HTTP requests by route pattern and status.", m.requests)
+	writeHistogram(w, "ditchfork_http_request_duration_seconds", "HTTP request latency by route pattern.", m.requestDuration)
+	writeCounter(w, "ditchfork_template_render_errors_total", "Pages that failed to render.", m.templateErrors)
+	writeHistogram(w, "ditchfork_db_query_duration_seconds", "Database statement latency by statement type.", m.queryDuration)
+	writeCounter(w, "ditchfork_upload_bytes_total", "Bytes of cover images uploaded.", m.uploadBytes)
+	writeCounter(w, "ditchfork_cache_hits_total", "Lookups answered from memory, by cache.", m.cacheHits)
+	writeCounter(w, "ditchfork_cache_misses_total", "Lookups that went to the database or re-rendered, by cache.", m.cacheMisses)
+
+	// Gauges that live in the database are read at scrape time.
+	m.mu.Lock()
+	sites := m.sites
+	m.mu.Unlock()
+	fmt.Fprintf(w, "# HELP ditchfork_active_sessions Admin sessions that have not expired.\n")
+	fmt.Fprintf(w, "# TYPE ditchfork_active_sessions gauge\n")
+	for _, s := range sites {
+		if n, err := s.store.CountActiveSessions(); err == nil {
+			fmt.Fprintf(w, "ditchfork_active_sessions{site=%q} %d\n", s.name, n)
+		}
+	}
+	fmt.Fprintf(w, "# HELP ditchfork_content_items Published entries by type.\n")
+	fmt.Fprintf(w, "# TYPE ditchfork_content_items gauge\n")
+	for _, s := range sites {
+		for _, ct := range contentTypeList {
+			if n, err := s.store.CountContent(ct.Table); err == nil {
+				fmt.Fprintf(w, "ditchfork_content_items{site=%q,type=%q} %d\n", s.name, ct.Table, n)
+			}
+		}
+	}
+}
+
+func writeCounter(w io.Writer, name, help string, c *counterVec) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.labels) == 0 && len(c.values) == 0 {
+		fmt.Fprintf(w, "%s 0\n", name)
+		return
+	}
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", name, labelString(c.labels, key, ""), formatFloat(c.values[key]))
+	}
+}
+
+func writeHistogram(w io.Writer, name, help string, h *histogramVec) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		var cumulative uint64
+		for i, le := range durationBuckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name, labelString(h.labels, key, formatFloat(le)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, labelString(h.labels, key, "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", name, labelString(h.labels, key, ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", name, labelString(h.labels, key, ""), s.count)
+	}
+}
+
+// labelString renders {a="x",b="y"} from label names and a joined key, with
+// an optional le label for histogram buckets.
+func labelString(names []string, key, le string) string {
+	var parts []string
+	if len(names) > 0 {
+		for i, v := range strings.Split(key, "\xff") {
+			parts = append(parts, fmt.Sprintf("%s=%q", names[i], v))
+		}
+	}
+	if le != "" {
+		parts = append(parts, fmt.Sprintf("le=%q", le))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Health checks
+
+// handleHealthz reports whether the process is up and can reach its database.
+func (app *application) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, app.checkHealth(r, false))
+}
+
+// handleReadyz additionally checks that uploads can be saved.
+func (app *application) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, app.checkHealth(r, true))
+}
+
+// checkHealth returns what is wrong with the site, if anything; ready adds
+// the upload storage to the database.
+func (app *application) checkHealth(r *http.Request, ready bool) []string {
+	var failed []string
+	if err := app.store.Ping(r.Context()); err != nil {
+		requestLogger(r).Error("health check: database", "site", app.siteName(), "err", err)
+		failed = append(failed, "database unavailable")
+	}
+	if ready {
+		if err := app.uploads.Check(r.Context()); err != nil {
+			requestLogger(r).Error("health check: upload storage", "site", app.siteName(), "err", err)
+			failed = append(failed, "upload storage unavailable")
+		}
+	}
+	return failed
+}
+
+func writeHealth(w http.ResponseWriter, failed []string) {
+	if len(failed) > 0 {
+		http.Error(w, strings.Join(failed, "\n"), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// healthChecks answers /healthz and /readyz ahead of host routing, for all
+// sites together, so a probe that addresses the server by IP isn't turned
+// away as an unknown site.
+func healthChecks(apps []*application, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead ||
+			r.URL.Path != "/healthz" && r.URL.Path != "/readyz" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var failed []string
+		for _, app := range apps {
+			for _, problem := range app.checkHealth(r, r.URL.Path == "/readyz") {
+				if len(apps) > 1 {
+					problem = app.siteName() + ": " + problem
+				}
+				failed = append(failed, problem)
+			}
+		}
+		writeHealth(w, failed)
+	})
+}
+
+// Database instrumentation
+
+// timedDriver wraps a database driver so every statement's latency is
+// recorded, labelled by its leading keyword (select, insert, ...).
+type timedDriver struct{ driver.Driver }
+
+func (d timedDriver) Open(name string) (driver.Conn, error) {
+	c, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &timedConn{c}, nil
+}
+
+// timedConn forwards the optional driver interfaces database/sql looks for;
+// returning driver.ErrSkip makes it fall back to Prepare.
+type timedConn struct{ driver.Conn }
+
+func (c *timedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	ec, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	defer observeQuery(time.Now(), query)
+	return ec.ExecContext(ctx, query, args)
+}
+
+func (c *timedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	qc, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	defer observeQuery(time.Now(), query)
+	return qc.QueryContext(ctx, query, args)
+}
+
+func (c *timedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if pc, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return pc.PrepareContext(ctx, query)
+	}
+	return c.Conn.Prepare(query)
+}
+
+func (c *timedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if bc, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return bc.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c *timedConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *timedConn) ResetSession(ctx context.Context) error {
+	if sr, ok := c.Conn.(driver.SessionResetter); ok {
+		return sr.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *timedConn) IsValid() bool {
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+func observeQuery(start time.Time, query string) {
+	stmt := "other"
+	if fields := strings.Fields(query); len(fields) > 0 {
+		stmt = strings.ToLower(fields[0])
+	}
+	switch stmt {
+	case "select", "insert", "update", "delete", "with", "pragma", "create", "drop", "alter", "vacuum", "begin", "commit", "rollback":
+	default:
+		stmt = "other"
+	}
+	metrics.queryDuration.observe(time.Since(start), stmt)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// cmdMigrateDB copies every table from the configured database into an empty
+// one, typically to move a site from SQLite to PostgreSQL. It runs in a single
+// transaction on the target, so a failed copy leaves it empty.
+func cmdMigrateDB(env *cliEnv, args []string) int {
+	if len(args) != 1 {
+		return usageError("usage: ditchfork migrate-db <target>")
+	}
+	target := args[0]
+	if target == env.cfg.DBPath {
+		return usageError("the target is the configured database")
+	}
+
+	dst, err := openDB(target)
+	if err != nil {
+		return fail("%v", err)
+	}
+	defer dst.Close()
+	if err := migrate(dst); err != nil {
+		return fail("migrate %s: %v", redactDSN(target), err)
+	}
+	for _, t := range dbTables {
+		if t == "settings" {
+			continue // seeded with defaults, replaced below
+		}
+		var n int
+		if err := dst.QueryRow(`SELECT COUNT(*) FROM ` + t).Scan(&n); err != nil {
+			return fail("%s: %v", t, err)
+		}
+		if n > 0 {
+			return fail("%s already has rows in %s; migrate-db needs an empty database", redactDSN(target), t)
+		}
+	}
+
+	tx, err := dst.Begin()
+	if err != nil {
+		return fail("%v", err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM settings`); err != nil {
+		return fail("settings: %v", err)
+	}
+	for _, t := range dbTables {
+		n, err := copyTable(env.db, tx, t)
+		if err != nil {
+			return fail("copy %s: %v", t, err)
+		}
+		fmt.Printf("%-16s %d rows\n", t, n)
+	}
+	if dst.dialect == postgresDialect {
+		// Rows kept their ids, so move each sequence past the highest one.
+		for _, t := range []string{"albums", "songs", "articles", "users", "sessions", "audit_log"} {
+			if _, err := tx.Exec(fmt.Sprintf(
+				`SELECT setval(pg_get_serial_sequence('%s', 'id'), COALESCE(MAX(id), 0) + 1, false) FROM %s`, t, t)); err != nil {
+				return fail("reset %s id sequence: %v", t, err)
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fail("commit: %v", err)
+	}
+	fmt.Printf("copied to %s; point db_path at it and restart\n", redactDSN(target))
+	return exitOK
+}
+
+// copyTable inserts every row of table in src into dst, ids included.
+func copyTable(src *database, dst *dbTx, table string) (int, error) {
+	rows, err := src.Query(`SELECT * FROM ` + table)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+	insert := fmt.Sprintf(`INSERT INTO %s (%s) VALUES (%s)`, table,
+		strings.Join(cols, ", "), strings.TrimSuffix(strings.Repeat("?, ", len(cols)), ", "))
+
+	values := make([]any, len(cols))
+	ptrs := make([]any, len(cols))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	n := 0
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return n, err
+		}
+		if _, err := dst.Exec(insert, values...); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, rows.Err()
+}
@@ -24,9 +24,38 @@ type User struct {
 }
 
 type Session struct {
-	Token     string
-	UserID    int64
-	ExpiresAt time.Time
+	ID         int64
+	TokenHash  string // sha256 of the cookie value; the raw token is never stored
+	UserID     int64
+	Username   string // joined from users for listings
+	IP         string
+	UserAgent  string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	ExpiresAt  time.Time
+}
+
+// LoginFailure is a persisted failed-login counter for one IP or username.
+type LoginFailure struct {
+	Scope       string // "ip" or "user"
+	Key         string
+	Failures    int
+	LastFailure time.Time
+	LockedUntil time.Time // zero unless the key is locked
+}
+
+// AuditEntry is one row of the append-only audit log.
+type AuditEntry struct {
+	ID         int64
+	CreatedAt  time.Time
+	UserID     int64  // 0 for actions not taken by a logged-in user
+	Username   string // copied at write time so entries survive user deletion
+	Action     string // e.g. "review.update", "user.lockout"
+	TargetType string
+	TargetID   string
+	Before     string
+	After      string
+	IP         string
 }
 
 // Content type configuration
@@ -64,28 +93,51 @@ var validArticleTypes = []string{"News", "Opinion", "List"}
 
 // Settings keys and defaults
 const (
-	SettingSiteTitle   = "site_title"
-	SettingNavBgColor  = "nav_bg_color"
-	SettingPageBgColor = "page_bg_color"
-	SettingAccentColor = "accent_color"
-	SettingTextColor   = "text_color"
-	SettingBrandColor  = "brand_color"
+	SettingSiteTitle    = "site_title"
+	SettingNavBgColor   = "nav_bg_color"
+	SettingPageBgColor  = "page_bg_color"
+	SettingAccentColor  = "accent_color"
+	SettingTextColor    = "text_color"
+	SettingBrandColor   = "brand_color"
+	SettingRobotsTxt    = "robots_txt"
+	SettingFontPairing  = "font_pairing"
+	SettingEmbedOrigins = "embed_origins"
+	SettingTheme        = "theme"
+
+	// Storage keys of custom fonts, set by uploading them in Settings
+	SettingFontBrandFile = "font_brand_file"
+	SettingFontSansFile  = "font_sans_file"
 )
 
 var settingDefaults = map[string]string{
-	SettingSiteTitle:   "Ditchfork",
-	SettingNavBgColor:  "#111111",
-	SettingPageBgColor: "#ffffff",
-	SettingAccentColor: "#d62828",
-	SettingTextColor:   "#111111",
-	SettingBrandColor:  "#ffffff",
+	SettingSiteTitle:    "Ditchfork",
+	SettingNavBgColor:   "#111111",
+	SettingPageBgColor:  "#ffffff",
+	SettingAccentColor:  "#d62828",
+	SettingTextColor:    "#111111",
+	SettingBrandColor:   "#ffffff",
+	SettingRobotsTxt:    "",
+	SettingFontPairing:  "grotesk-lora",
+	SettingEmbedOrigins: "",
+	SettingTheme:        defaultTheme,
 }
 
 var allowedSettingKeys = map[string]bool{
-	SettingSiteTitle:   true,
-	SettingNavBgColor:  true,
-	SettingPageBgColor: true,
-	SettingAccentColor: true,
-	SettingTextColor:   true,
-	SettingBrandColor:  true,
+	SettingSiteTitle:    true,
+	SettingNavBgColor:   true,
+	SettingPageBgColor:  true,
+	SettingAccentColor:  true,
+	SettingTextColor:    true,
+	SettingBrandColor:   true,
+	SettingRobotsTxt:    true,
+	SettingFontPairing:  true,
+	SettingEmbedOrigins: true,
+	SettingTheme:        true,
+}
+
+// optionalSettingKeys may be saved empty. Other settings left blank in the
+// form keep their value.
+var optionalSettingKeys = map[string]bool{
+	SettingRobotsTxt:    true,
+	SettingEmbedOrigins: true,
 }
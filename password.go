@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	minPasswordLength = 8
+
+	// passwordResetLifetime is how long an admin-issued reset link stays valid.
+	passwordResetLifetime = 24 * time.Hour
+)
+
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// validateNewPassword returns a user-facing error message, or "" if the
+// password and its confirmation are acceptable.
+func validateNewPassword(password, confirm string) string {
+	if len(password) < minPasswordLength {
+		return "Password must be at least 8 characters."
+	}
+	if password != confirm {
+		return "Passwords do not match."
+	}
+	return ""
+}
+
+func (h *authHandler) handlePasswordForm(w http.ResponseWriter, r *http.Request) {
+	h.app.render(w, r, "admin/password.html", nil)
+}
+
+func (h *authHandler) handlePasswordChange(w http.ResponseWriter, r *http.Request) {
+	session := currentSession(r)
+	renderErr := func(msg string) {
+		h.app.render(w, r, "admin/password.html", map[string]any{"Error": msg})
+	}
+
+	user, err := h.store.GetUserByID(session.UserID)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// The current password is guessed at just like a login, so it counts
+	// towards the same limits.
+	ip := clientIP(r)
+	if msg := h.throttled(r, ip, user.Username); msg != "" {
+		renderErr(msg)
+		return
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(r.FormValue("current_password"))); err != nil {
+		h.loginFailed(r, ip, user.Username, "bad current password")
+		renderErr("Current password is incorrect.")
+		return
+	}
+	h.limiter.reset(ip, user.Username)
+
+	password := r.FormValue("new_password")
+	if msg := validateNewPassword(password, r.FormValue("confirm_password")); msg != "" {
+		renderErr(msg)
+		return
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Revokes every session, including this one; start a fresh one so the
+	// user stays logged in on the device they changed it from.
+	if err := h.store.SetUserPassword(user.ID, hash); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	requestLogger(r).Info("password changed", "ip", clientIP(r), "user", user.Username)
+	h.app.audit(r, "user.password_change", "user", user.Username, "", "")
+
+	if err := h.startSession(w, r, user); err != nil {
+		h.app.redirect(w, r, "/admin/login")
+		return
+	}
+	h.app.render(w, r, "admin/password.html", map[string]any{
+		"Success": "Password changed. All other devices have been logged out.",
+	})
+}
+
+func (h *authHandler) handleResetForm(w http.ResponseWriter, r *http.Request) {
+	user, err := h.store.GetPasswordResetUser(hashToken(r.PathValue("token")))
+	if err != nil {
+		h.app.render(w, r, "admin/reset.html", map[string]any{"Invalid": true})
+		return
+	}
+	h.app.render(w, r, "admin/reset.html", map[string]any{
+		"Username": user.Username,
+		"Token":    r.PathValue("token"),
+	})
+}
+
+func (h *authHandler) handleReset(w http.ResponseWriter, r *http.Request) {
+	token := r.PathValue("token")
+	tokenHash := hashToken(token)
+
+	user, err := h.store.GetPasswordResetUser(tokenHash)
+	if err != nil {
+		h.app.render(w, r, "admin/reset.html", map[string]any{"Invalid": true})
+		return
+	}
+
+	password := r.FormValue("new_password")
+	if msg := validateNewPassword(password, r.FormValue("confirm_password")); msg != "" {
+		h.app.render(w, r, "admin/reset.html", map[string]any{
+			"Username": user.Username,
+			"Token":    token,
+			"Error":    msg,
+		})
+		return
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if _, err := h.store.UsePasswordReset(tokenHash, hash); err != nil {
+		h.app.render(w, r, "admin/reset.html", map[string]any{"Invalid": true})
+		return
+	}
+	requestLogger(r).Info("password reset", "ip", clientIP(r), "user", user.Username)
+	h.app.audit(r, "user.password_reset", "user", user.Username, "", "via reset link")
+
+	h.app.redirect(w, r, "/admin/login?reset=1")
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// defaultTrustedProxies trusts a reverse proxy on the same machine, which is
+// the common Caddy/nginx setup. Forwarding headers from anyone else are ignored.
+const defaultTrustedProxies = "127.0.0.0/8,::1/128"
+
+const (
+	clientIPContextKey contextKey = "client_ip"
+	schemeContextKey   contextKey = "scheme"
+)
+
+type trustedProxies []netip.Prefix
+
+// parseTrustedProxies parses a comma-separated list of CIDRs or bare IPs.
+// "none" trusts nobody, so forwarding headers are always ignored.
+func parseTrustedProxies(s string) (trustedProxies, error) {
+	var tp trustedProxies
+	if strings.TrimSpace(s) == "none" {
+		return tp, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if !strings.Contains(part, "/") {
+			addr, err := netip.ParseAddr(part)
+			if err != nil {
+				return nil, fmt.Errorf("trusted proxy %q: %w", part, err)
+			}
+			addr = addr.Unmap()
+			tp = append(tp, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(part)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q: %w", part, err)
+		}
+		tp = append(tp, prefix.Masked())
+	}
+	return tp, nil
+}
+
+func (tp trustedProxies) contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range tp {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve returns the client IP for r. Forwarding headers are only consulted
+// when the direct peer is a trusted proxy, and the hop list is walked from the
+// right: the first address that isn't itself a trusted proxy is the client.
+// Everything to the left of it was supplied by the client and can be forged.
+func (tp trustedProxies) resolve(r *http.Request) string {
+	peer, ok := parseHost(r.RemoteAddr)
+	if !ok {
+		return r.RemoteAddr
+	}
+	if !tp.contains(peer) {
+		return peer.String()
+	}
+
+	hops := forwardedFor(r.Header)
+	if len(hops) == 0 {
+		if real, ok := parseHost(r.Header.Get("X-Real-IP")); ok {
+			return real.String()
+		}
+		return peer.String()
+	}
+
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, ok := parseHost(hops[i])
+		if !ok {
+			// A trusted proxy wrote something we can't use (e.g. "unknown");
+			// the last address we could verify is the best we have.
+			break
+		}
+		client = addr
+		if !tp.contains(addr) {
+			break
+		}
+	}
+	return client.String()
+}
+
+// scheme returns "https" or "http" for the connection the client made. A
+// trusted proxy that terminates TLS says so with Forwarded proto= or
+// X-Forwarded-Proto; from anyone else those headers are ignored. Of several
+// values the last is used, since the nearest proxy added it.
+func (tp trustedProxies) scheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	if peer, ok := parseHost(r.RemoteAddr); !ok || !tp.contains(peer) {
+		return "http"
+	}
+	var proto string
+	if values := r.Header.Values("Forwarded"); len(values) > 0 {
+		for _, elem := range strings.Split(strings.Join(values, ","), ",") {
+			for _, pair := range strings.Split(elem, ";") {
+				k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(k, "proto") {
+					proto = strings.Trim(v, `"`)
+				}
+			}
+		}
+	} else {
+		for _, v := range r.Header.Values("X-Forwarded-Proto") {
+			for _, p := range strings.Split(v, ",") {
+				proto = strings.TrimSpace(p)
+			}
+		}
+	}
+	if strings.EqualFold(proto, "https") {
+		return "https"
+	}
+	return "http"
+}
+
+// forwardedFor returns the hop addresses from the Forwarded header (RFC 7239),
+// falling back to X-Forwarded-For. Multiple header lines are concatenated.
+func forwardedFor(h http.Header) []string {
+	var hops []string
+	if values := h.Values("Forwarded"); len(values) > 0 {
+		for _, elem := range strings.Split(strings.Join(values, ","), ",") {
+			for _, pair := range strings.Split(elem, ";") {
+				k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(k, "for") {
+					hops = append(hops, strings.Trim(v, `"`))
+				}
+			}
+		}
+		return hops
+	}
+	for _, v := range h.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(v, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	return hops
+}
+
+// parseHost parses an IP that may carry a port and/or IPv6 brackets.
+func parseHost(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return netip.Addr{}, false
+	}
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	addr, err := netip.ParseAddr(strings.Trim(s, "[]"))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// realIP resolves the client IP and scheme once per request so logging, rate
+// limiting, links and cookies agree on who the client is and how they
+// connected.
+func realIP(tp trustedProxies, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), clientIPContextKey, tp.resolve(r))
+		ctx = context.WithValue(ctx, schemeContextKey, tp.scheme(r))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// isHTTPS reports whether the client connected over TLS, to us or to a
+// trusted proxy, as resolved by realIP.
+func isHTTPS(r *http.Request) bool {
+	if scheme, ok := r.Context().Value(schemeContextKey).(string); ok {
+		return scheme == "https"
+	}
+	return r.TLS != nil
+}
+
+// clientIP returns the address resolved by realIP, or the direct peer.
+func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPContextKey).(string); ok {
+		return ip
+	}
+	if addr, ok := parseHost(r.RemoteAddr); ok {
+		return addr.String()
+	}
+	return r.RemoteAddr
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// routes builds the site's handler: every route, wrapped in the middleware
+// that applies to all of them.
+func (app *application) routes() http.Handler {
+	pub := newPublicHandler(app)
+	auth := newAuthHandler(app)
+	adm := newAdminHandler(app)
+	setup := newSetupHandler(app)
+
+	mux := http.NewServeMux()
+
+	// Static files (embedded or the theme's, fingerprinted)
+	mux.HandleFunc("GET /static/{file...}", app.handleStatic)
+
+	// Uploaded images (local disk or object storage)
+	mux.HandleFunc("GET /uploads/{key...}", app.handleUploadFile)
+
+	// Setup routes
+	mux.HandleFunc("GET /setup", setup.handleSetupForm)
+	mux.HandleFunc("POST /setup", setup.handleSetup)
+
+	// Public routes
+	mux.HandleFunc("GET /{$}", app.cached(pub.handleHome))
+	mux.HandleFunc("GET /music/{category}/{slug}", app.cached(pub.handleReview))
+	mux.HandleFunc("GET /cards/{category}/{file}", pub.handleCard)
+
+	// For search engines
+	mux.HandleFunc("GET /sitemap.xml", pub.handleSitemap)
+	mux.HandleFunc("GET /sitemaps/{file}", pub.handleSitemapFile)
+	mux.HandleFunc("GET /robots.txt", pub.handleRobots)
+
+	// Auth routes
+	mux.HandleFunc("GET /admin/login", auth.handleLoginForm)
+	mux.HandleFunc("POST /admin/login", auth.handleLogin)
+	mux.HandleFunc("POST /admin/logout", auth.requireAuth(auth.handleLogout))
+	mux.HandleFunc("GET /admin/sessions", auth.requireAuth(auth.handleSessions))
+	mux.HandleFunc("POST /admin/sessions/{id}/revoke", auth.requireAuth(auth.handleRevokeSession))
+	mux.HandleFunc("POST /admin/sessions/revoke-all", auth.requireAuth(auth.handleRevokeAll))
+	mux.HandleFunc("GET /admin/password", auth.requireAuth(auth.handlePasswordForm))
+	mux.HandleFunc("POST /admin/password", auth.requireAuth(auth.handlePasswordChange))
+	mux.HandleFunc("GET /admin/users", auth.requireAuth(auth.handleUsers))
+	mux.HandleFunc("POST /admin/users/{id}/reset-link", auth.requireAuth(auth.handleCreateResetLink))
+	mux.HandleFunc("POST /admin/users/{id}/unlock", auth.requireAuth(auth.handleUnlockUser))
+	mux.HandleFunc("GET /admin/reset/{token}", auth.handleResetForm)
+	mux.HandleFunc("POST /admin/reset/{token}", auth.handleReset)
+
+	// Admin routes (all require auth)
+	mux.HandleFunc("GET /admin/{$}", auth.requireAuth(adm.handleDashboard))
+	mux.HandleFunc("GET /admin/reviews/new", auth.requireAuth(adm.handleNewForm))
+	mux.HandleFunc("POST /admin/reviews", auth.requireAuth(adm.handleCreate))
+	mux.HandleFunc("GET /admin/{type}/{id}/edit", auth.requireAuth(adm.handleEditForm))
+	mux.HandleFunc("POST /admin/{type}/{id}", auth.requireAuth(adm.handleUpdate))
+	mux.HandleFunc("POST /admin/{type}/{id}/delete", auth.requireAuth(adm.handleDelete))
+
+	// Settings
+	mux.HandleFunc("GET /admin/settings", auth.requireAuth(adm.handleSettings))
+	mux.HandleFunc("POST /admin/settings", auth.requireAuth(adm.handleSettingsSave))
+
+	// Health checks, and metrics unless they have their own listener
+	mux.HandleFunc("GET /healthz", app.handleHealthz)
+	mux.HandleFunc("GET /readyz", app.handleReadyz)
+	if app.cfg.Metrics.Token != "" && app.cfg.Metrics.Listen == "" {
+		mux.Handle("GET /metrics", metrics.handler(app.cfg.Metrics.Token))
+	}
+
+	// Audit log
+	mux.HandleFunc("GET /admin/audit", auth.requireAuth(adm.handleAudit))
+	mux.HandleFunc("GET /admin/audit.csv", auth.requireAuth(adm.handleAuditCSV))
+
+	proxies, _ := parseTrustedProxies(strings.Join(app.cfg.TrustedProxies, ","))
+	var h http.Handler = metrics.instrument(app.siteName(), mux, setupGuard(app, mux))
+	h = app.securityHeaders(h)
+	if base := app.cfg.BasePath; base != "" {
+		h = mountAt(base, h)
+	}
+	return realIP(proxies, accessLog(app.accessLog, compress(h)))
+}
+
+// newApplication sets up a site around its store, putting the caches in front.
+func newApplication(cfg *config, store Store, uploads storage) *application {
+	app := &application{
+		themes:  newThemeSet(cfg.ThemesDir, func(path string) string { return cfg.BasePath + path }),
+		cfg:     cfg,
+		uploads: uploads,
+		cards:   &cardCache{dir: cfg.Cache.CardDir},
+	}
+	cached := newCachedStore(store, app.siteName(), cfg.Cache.TTL.Duration)
+	if cfg.Cache.Pages {
+		app.pages = newPageCache(app.siteName(), cfg.Cache.TTL.Duration, cfg.Cache.MaxPages, cfg.PublicURL == "")
+		cached.onChange = app.pages.clear
+	}
+	app.store = cached
+	if cfg.PublicURL != "" {
+		app.canonical = func(path string) string { return cfg.PublicURL + path }
+	}
+	return app
+}
+
+// mountAt serves h under base, e.g. example.com/reviews/, and redirects the
+// bare prefix to it. Everything else is a 404.
+func mountAt(base string, h http.Handler) http.Handler {
+	stripped := http.StripPrefix(base, h)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == base {
+			http.Redirect(w, r, base+"/", http.StatusMovedPermanently)
+			return
+		}
+		if !strings.HasPrefix(r.URL.Path, base+"/") {
+			http.NotFound(w, r)
+			return
+		}
+		stripped.ServeHTTP(w, r)
+	})
+}
+
+// Server timeouts. Reads get a generous limit because cover uploads come in
+// over slow connections; the header timeout is what guards against slowloris.
+const (
+	readHeaderTimeout = 10 * time.Second
+	readTimeout       = 5 * time.Minute
+	writeTimeout      = 5 * time.Minute
+	idleTimeout       = 2 * time.Minute
+)
+
+func cmdServe(env *cliEnv, args []string) int {
+	if len(args) != 0 {
+		return usageError("serve takes no arguments")
+	}
+	cfg := env.cfg
+
+	accessLogger, accessLogFile, err := cfg.openAccessLog()
+	if err != nil {
+		return fail("access log: %v", err)
+	}
+	if accessLogFile != nil {
+		defer accessLogFile.Close()
+	}
+
+	// Each site is a separate application with its own database. A single
+	// site without [[sites]] answers every Host.
+	var apps []*application
+	defer func() {
+		for _, app := range apps {
+			// Fold the WAL back into the main file so the database is
+			// self-contained when the process is gone (backups, upgrades).
+			if app.db.dialect == sqliteDialect {
+				if _, err := app.db.Exec(`PRAGMA wal_checkpoint(TRUNCATE)`); err != nil {
+					slog.Error("wal checkpoint", "site", app.siteName(), "err", err)
+				}
+			}
+			app.db.Close()
+		}
+	}()
+	router := newHostRouter()
+	for _, siteCfg := range cfg.siteConfigs() {
+		db, err := openSiteDB(siteCfg)
+		if err != nil {
+			return fail("site %s: %v", siteCfg.siteName, err)
+		}
+		uploads, err := siteCfg.newStorage()
+		if err != nil {
+			db.Close()
+			return fail("site %s: storage: %v", siteCfg.siteName, err)
+		}
+		// Object storage may just be slow to come up; /readyz keeps reporting it.
+		if err := uploads.Check(context.Background()); err != nil {
+			slog.Warn("upload storage is not usable yet", "site", siteCfg.siteName, "storage", uploads, "err", err)
+		}
+		app := newApplication(siteCfg, newSQLStore(db), uploads)
+		app.db = db
+		app.accessLog = accessLogger
+		apps = append(apps, app)
+		metrics.addSite(app.siteName(), app.store)
+
+		hosts := siteCfg.siteHosts
+		if len(cfg.Sites) == 0 {
+			hosts = []string{"*"}
+		}
+		if err := router.add(hosts, app.routes()); err != nil {
+			return fail("site %s: %v", siteCfg.siteName, err)
+		}
+		if len(cfg.Sites) > 0 {
+			slog.Info("site loaded", "site", siteCfg.siteName, "hosts", hosts, "db", redactDSN(siteCfg.DBPath))
+		}
+	}
+	srv := newServer(hsts(cfg.TLS.HSTSMaxAge.Duration, healthChecks(apps, router)))
+
+	inherited, err := systemdListeners()
+	if err != nil {
+		return fail("listen: %v", err)
+	}
+	ln, err := listenOn(inherited, 0, cfg.Listen)
+	if err != nil {
+		return fail("listen: %v", err)
+	}
+	servers := []*http.Server{srv}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	var workers []func(context.Context)
+	for _, app := range apps {
+		store := app.store
+		workers = append(workers,
+			func(ctx context.Context) { runSessionCleanup(ctx, store) },
+			func(ctx context.Context) { runLoginFailureCleanup(ctx, store, cfg.loginPolicy().Window) },
+		)
+	}
+
+	scheme := "http"
+	if cfg.TLS.enabled() {
+		certs, err := newCertReloader(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		if err != nil {
+			return fail("tls: %v", err)
+		}
+		srv.TLSConfig = certs.tlsConfig()
+		ln = tls.NewListener(ln, srv.TLSConfig)
+		workers = append(workers, certs.watch)
+		scheme = "https"
+	}
+
+	serveErr := make(chan error, 3)
+	if cfg.TLS.RedirectFrom != "" {
+		redirectLn, err := listenOn(inherited, 1, cfg.TLS.RedirectFrom)
+		if err != nil {
+			return fail("listen: %v", err)
+		}
+		redirect := newServer(redirectToHTTPS(ln.Addr().String()))
+		servers = append(servers, redirect)
+		go func() { serveErr <- redirect.Serve(redirectLn) }()
+		slog.Info("redirecting to https", "addr", redirectLn.Addr().String())
+	}
+
+	if cfg.Metrics.Listen != "" {
+		metricsLn, err := net.Listen("tcp", cfg.Metrics.Listen)
+		if err != nil {
+			return fail("listen: %v", err)
+		}
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("GET /metrics", metrics.handler(cfg.Metrics.Token))
+		metricsSrv := newServer(metricsMux)
+		servers = append(servers, metricsSrv)
+		go func() { serveErr <- metricsSrv.Serve(metricsLn) }()
+		slog.Info("serving metrics", "addr", metricsLn.Addr().String())
+	}
+
+	var wg sync.WaitGroup
+	for _, run := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			run(ctx)
+		}()
+	}
+
+	go func() { serveErr <- srv.Serve(ln) }()
+	slog.Info("ditchfork starting", "addr", scheme+"://"+ln.Addr().String(), "socket_activated", inherited != nil)
+
+	status := exitOK
+	select {
+	case err := <-serveErr:
+		slog.Error("server", "err", err)
+		status = exitFailure
+	case <-ctx.Done():
+		slog.Info("shutting down, waiting for requests to finish", "timeout", cfg.ShutdownTimeout.Duration)
+	}
+	stop()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout.Duration)
+	defer cancel()
+	for _, s := range servers {
+		if err := s.Shutdown(shutdownCtx); err != nil {
+			slog.Warn("shutdown incomplete, closing remaining connections", "err", err)
+			s.Close()
+		}
+	}
+	wg.Wait()
+	slog.Info("stopped")
+	return status
+}
+
+func newServer(h http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           h,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+	}
+}
+
+// systemdListeners returns the sockets passed in by systemd socket activation,
+// or nil if there are none. With systemd holding the socket, restarts never
+// refuse connections: clients queue while the new process starts.
+func systemdListeners() ([]net.Listener, error) {
+	pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	fds, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if pid != os.Getpid() || fds < 1 {
+		return nil, nil
+	}
+	// Don't leak the variables to child processes.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	const firstFD = 3 // SD_LISTEN_FDS_START
+	lns := make([]net.Listener, 0, fds)
+	for i := 0; i < fds; i++ {
+		f := os.NewFile(uintptr(firstFD+i), "systemd-socket")
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("systemd socket %d: %w", i, err)
+		}
+		lns = append(lns, ln)
+	}
+	return lns, nil
+}
+
+// listenOn uses the i-th socket from systemd when there is one (the first for
+// the site, the second for the HTTPS redirect), otherwise listens on addr.
+func listenOn(inherited []net.Listener, i int, addr string) (net.Listener, error) {
+	if i < len(inherited) {
+		return inherited[i], nil
+	}
+	return net.Listen("tcp", addr)
+}
@@ -1,35 +1,32 @@
 package main
 
 import (
-	"database/sql"
 	"net/http"
 	"strings"
-
-	"golang.org/x/crypto/bcrypt"
 )
 
 type setupHandler struct {
-	db  *sql.DB
-	app *application
+	store Store
+	app   *application
 }
 
 func newSetupHandler(app *application) *setupHandler {
-	return &setupHandler{db: app.db, app: app}
+	return &setupHandler{store: app.store, app: app}
 }
 
 func (h *setupHandler) handleSetupForm(w http.ResponseWriter, r *http.Request) {
-	hasUsers, _ := dbHasUsers(h.db)
+	hasUsers, _ := h.store.HasUsers()
 	if hasUsers {
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		h.app.redirect(w, r, "/")
 		return
 	}
-	h.app.render(w, "setup.html", nil)
+	h.app.render(w, r, "setup.html", nil)
 }
 
 func (h *setupHandler) handleSetup(w http.ResponseWriter, r *http.Request) {
-	hasUsers, _ := dbHasUsers(h.db)
+	hasUsers, _ := h.store.HasUsers()
 	if hasUsers {
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		h.app.redirect(w, r, "/")
 		return
 	}
 
@@ -38,43 +35,45 @@ func (h *setupHandler) handleSetup(w http.ResponseWriter, r *http.Request) {
 	siteTitle := strings.TrimSpace(r.FormValue("site_title"))
 
 	if username == "" {
-		h.app.render(w, "setup.html", map[string]any{"Error": "Username is required."})
+		h.app.render(w, r, "setup.html", map[string]any{"Error": "Username is required."})
 		return
 	}
-	if len(password) < 8 {
-		h.app.render(w, "setup.html", map[string]any{"Error": "Password must be at least 8 characters."})
+	if len(password) < minPasswordLength {
+		h.app.render(w, r, "setup.html", map[string]any{"Error": "Password must be at least 8 characters."})
 		return
 	}
 
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	hash, err := hashPassword(password)
 	if err != nil {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	if err := dbCreateUser(h.db, username, string(hash)); err != nil {
-		h.app.render(w, "setup.html", map[string]any{"Error": "Could not create user. Username may already exist."})
+	if err := h.store.CreateUser(username, hash); err != nil {
+		h.app.render(w, r, "setup.html", map[string]any{"Error": "Could not create user. Username may already exist."})
 		return
 	}
+	h.app.audit(r, "user.create", "user", username, "", "first user, via setup")
 
 	if siteTitle != "" {
-		dbUpdateSetting(h.db, SettingSiteTitle, siteTitle)
+		h.store.UpdateSetting(SettingSiteTitle, siteTitle)
 	}
 
-	http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
+	h.app.redirect(w, r, "/admin/login")
 }
 
 // setupGuard redirects all non-static, non-setup routes to /setup if no users exist.
-func setupGuard(db *sql.DB, next http.Handler) http.Handler {
+func setupGuard(app *application, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		path := r.URL.Path
-		if strings.HasPrefix(path, "/static/") || strings.HasPrefix(path, "/setup") {
+		if strings.HasPrefix(path, "/static/") || strings.HasPrefix(path, "/setup") ||
+			path == "/healthz" || path == "/readyz" || path == "/metrics" {
 			next.ServeHTTP(w, r)
 			return
 		}
-		hasUsers, _ := dbHasUsers(db)
+		hasUsers, _ := app.store.HasUsers()
 		if !hasUsers {
-			http.Redirect(w, r, "/setup", http.StatusSeeOther)
+			app.redirect(w, r, "/setup")
 			return
 		}
 		next.ServeHTTP(w, r)
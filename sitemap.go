@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sitemapPageSize is the most URLs one sitemap file holds; the protocol
+// allows 50,000. Past that, /sitemap.xml becomes an index of numbered files
+// under /sitemaps/.
+var sitemapPageSize = 50000
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+// sitemapURLs lists every public page, with link making each path absolute.
+// Listings are last modified when their newest review was.
+func sitemapURLs(reviews []Review, link func(path string) string) []sitemapURL {
+	var newest time.Time
+	newestOf := make(map[string]time.Time)
+	for _, r := range reviews {
+		if r.UpdatedAt.After(newest) {
+			newest = r.UpdatedAt
+		}
+		if r.UpdatedAt.After(newestOf[r.Type]) {
+			newestOf[r.Type] = r.UpdatedAt
+		}
+	}
+	urls := []sitemapURL{{Loc: link("/"), LastMod: sitemapTime(newest)}}
+	for _, ct := range contentTypeList {
+		urls = append(urls, sitemapURL{Loc: link("/?tab=" + ct.Table), LastMod: sitemapTime(newestOf[ct.Table])})
+	}
+	for _, r := range reviews {
+		urls = append(urls, sitemapURL{
+			Loc:     link("/music/" + contentTypeMap[r.Type].URLPath + "/" + r.Slug),
+			LastMod: sitemapTime(r.UpdatedAt),
+		})
+	}
+	return urls
+}
+
+func sitemapTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// sitemapPages is how many files the sitemap is split into.
+func sitemapPages(urls []sitemapURL) int {
+	return (len(urls) + sitemapPageSize - 1) / sitemapPageSize
+}
+
+// sitemapPage returns the URLs in numbered file n, counting from 1.
+func sitemapPage(urls []sitemapURL, n int) []sitemapURL {
+	start := (n - 1) * sitemapPageSize
+	return urls[start:min(start+sitemapPageSize, len(urls))]
+}
+
+func writeSitemap(w io.Writer, urls []sitemapURL) error {
+	return writeSitemapXML(w, struct {
+		XMLName xml.Name     `xml:"urlset"`
+		NS      string       `xml:"xmlns,attr"`
+		URLs    []sitemapURL `xml:"url"`
+	}{NS: sitemapNS, URLs: urls})
+}
+
+// writeSitemapIndex lists the numbered sitemap files, with link making each
+// path absolute.
+func writeSitemapIndex(w io.Writer, urls []sitemapURL, link func(path string) string) error {
+	var files []sitemapURL
+	for n := 1; n <= sitemapPages(urls); n++ {
+		var lastMod string
+		for _, u := range sitemapPage(urls, n) {
+			lastMod = max(lastMod, u.LastMod) // RFC 3339 in UTC sorts as text
+		}
+		files = append(files, sitemapURL{Loc: link(sitemapFile(n)), LastMod: lastMod})
+	}
+	return writeSitemapXML(w, struct {
+		XMLName  xml.Name     `xml:"sitemapindex"`
+		NS       string       `xml:"xmlns,attr"`
+		Sitemaps []sitemapURL `xml:"sitemap"`
+	}{NS: sitemapNS, Sitemaps: files})
+}
+
+const sitemapNS = "http://www.sitemaps.org/schemas/sitemap/0.9"
+
+func sitemapFile(n int) string {
+	return "/sitemaps/" + strconv.Itoa(n) + ".xml"
+}
+
+func writeSitemapXML(w io.Writer, v any) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// robotsTxt keeps crawlers out of the admin, adds the site's own rules and
+// points to the sitemap. Extra rules without a User-agent line of their own
+// join the group for every crawler.
+func robotsTxt(settings map[string]string, admin, sitemap string) string {
+	var b strings.Builder
+	b.WriteString("User-agent: *\n")
+	fmt.Fprintf(&b, "Disallow: %s\n", admin)
+	if extra := strings.TrimSpace(strings.ReplaceAll(settings[SettingRobotsTxt], "\r\n", "\n")); extra != "" {
+		b.WriteString(extra + "\n")
+	}
+	fmt.Fprintf(&b, "\nSitemap: %s\n", sitemap)
+	return b.String()
+}
+
+// handleSitemap serves the whole sitemap, or an index of its files once it
+// outgrows one.
+func (h *publicHandler) handleSitemap(w http.ResponseWriter, r *http.Request) {
+	urls, ok := h.sitemap(w, r)
+	if !ok {
+		return
+	}
+	link := func(path string) string { return h.app.absoluteURL(r, path) }
+	if sitemapPages(urls) > 1 {
+		h.writeXML(w, r, func(w io.Writer) error { return writeSitemapIndex(w, urls, link) })
+		return
+	}
+	h.writeXML(w, r, func(w io.Writer) error { return writeSitemap(w, urls) })
+}
+
+func (h *publicHandler) handleSitemapFile(w http.ResponseWriter, r *http.Request) {
+	n, err := strconv.Atoi(strings.TrimSuffix(r.PathValue("file"), ".xml"))
+	if err != nil || !strings.HasSuffix(r.PathValue("file"), ".xml") {
+		http.NotFound(w, r)
+		return
+	}
+	urls, ok := h.sitemap(w, r)
+	if !ok {
+		return
+	}
+	if pages := sitemapPages(urls); pages < 2 || n < 1 || n > pages {
+		http.NotFound(w, r)
+		return
+	}
+	h.writeXML(w, r, func(w io.Writer) error { return writeSitemap(w, sitemapPage(urls, n)) })
+}
+
+// sitemap lists the site's URLs, answering the request itself if they
+// can't be read or the client's copy is current.
+func (h *publicHandler) sitemap(w http.ResponseWriter, r *http.Request) ([]sitemapURL, bool) {
+	reviews, err := h.store.GetFeed()
+	if err != nil {
+		requestLogger(r).Error("sitemap: get reviews", "err", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return nil, false
+	}
+	urls := sitemapURLs(reviews, func(path string) string { return h.app.absoluteURL(r, path) })
+	parts := []string{h.app.absoluteURL(r, "/")}
+	for _, rv := range reviews {
+		parts = append(parts, rv.Type, strconv.FormatInt(rv.ID, 10), rv.UpdatedAt.Format(time.RFC3339Nano))
+	}
+	if setValidators(w, r, pageETag(nil, parts...), time.Time{}) {
+		return nil, false
+	}
+	return urls, true
+}
+
+func (h *publicHandler) writeXML(w http.ResponseWriter, r *http.Request, write func(io.Writer) error) {
+	var buf strings.Builder
+	if err := write(&buf); err != nil {
+		requestLogger(r).Error("sitemap: encode", "err", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	io.WriteString(w, buf.String())
+}
+
+func (h *publicHandler) handleRobots(w http.ResponseWriter, r *http.Request) {
+	settings, _ := h.store.GetAllSettings()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, robotsTxt(settings, h.app.url("/admin/"), h.app.absoluteURL(r, "/sitemap.xml")))
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestSitemap(t *testing.T) {
+	s := newTestSite(t, func(c *config) { c.PublicURL = "https://example.com/reviews" }).withAdmin("admin")
+	s.store.CreateReview("albums", &Review{Slug: "boards-geogaddi", Artist: "Boards", Title: "Geogaddi", Rating: 9.1})
+	s.store.CreateReview("songs", &Review{Slug: "rival-hold", Artist: "Rival", Title: "Hold", Rating: 6})
+
+	rec := s.get("/sitemap.xml")
+	expectStatus(t, rec, http.StatusOK)
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/xml") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	for _, want := range []string{"<urlset", "<loc>https://example.com/reviews/</loc>",
+		"<loc>https://example.com/reviews/?tab=albums</loc>",
+		"<loc>https://example.com/reviews/music/albums/boards-geogaddi</loc>",
+		"<loc>https://example.com/reviews/music/songs/rival-hold</loc>", "<lastmod>"} {
+		expectBody(t, rec, want)
+	}
+	expectStatus(t, s.getWith("/sitemap.xml", map[string]string{"If-None-Match": rec.Header().Get("ETag")}), http.StatusNotModified)
+	expectStatus(t, s.get("/sitemaps/1.xml"), http.StatusNotFound)
+
+	// Past the page size it becomes an index: 1 home + 3 tabs + 2 reviews.
+	defer func(n int) { sitemapPageSize = n }(sitemapPageSize)
+	sitemapPageSize = 4
+	rec = s.get("/sitemap.xml")
+	expectBody(t, rec, "<sitemapindex")
+	expectBody(t, rec, "<loc>https://example.com/reviews/sitemaps/2.xml</loc>")
+	if strings.Contains(rec.Body.String(), "sitemaps/3.xml") {
+		t.Error("index lists a third file")
+	}
+	expectBody(t, s.get("/sitemaps/1.xml"), "<loc>https://example.com/reviews/</loc>")
+	expectBody(t, s.get("/sitemaps/2.xml"), "rival-hold")
+	for _, path := range []string{"/sitemaps/0.xml", "/sitemaps/3.xml", "/sitemaps/2", "/sitemaps/x.xml"} {
+		expectStatus(t, s.get(path), http.StatusNotFound)
+	}
+}
+
+func TestRobots(t *testing.T) {
+	s := newTestSite(t).withAdmin("admin")
+
+	rec := s.get("/robots.txt")
+	expectStatus(t, rec, http.StatusOK)
+	expectBody(t, rec, "User-agent: *\nDisallow: /admin/\n")
+	// Without a public URL the sitemap is found from the request.
+	expectBody(t, rec, "Sitemap: http://example.com/sitemap.xml")
+
+	s.login("admin")
+	s.postForm("/admin/settings", url.Values{SettingRobotsTxt: {"Disallow: /music/songs/\r\n\r\nUser-agent: GPTBot\r\nDisallow: /"}})
+	expectBody(t, s.get("/robots.txt"), "Disallow: /admin/\nDisallow: /music/songs/\n\nUser-agent: GPTBot\nDisallow: /\n")
+
+	// Other settings left out of the form don't clear it, but an empty field does.
+	s.postForm("/admin/settings", url.Values{SettingSiteTitle: {"Needle Drop"}})
+	expectBody(t, s.get("/robots.txt"), "GPTBot")
+	s.postForm("/admin/settings", url.Values{SettingRobotsTxt: {""}})
+	if strings.Contains(s.get("/robots.txt").Body.String(), "GPTBot") {
+		t.Error("extra rules not cleared")
+	}
+}
+
+func TestCanonicalLinks(t *testing.T) {
+	s := newTestSite(t).withAdmin("admin")
+	s.store.CreateReview("albums", &Review{Slug: "boards-geogaddi", Artist: "Boards", Title: "Geogaddi", Rating: 9.1})
+	if strings.Contains(s.get("/").Body.String(), `rel="canonical"`) {
+		t.Error("canonical link without a public URL")
+	}
+
+	s = newTestSite(t, func(c *config) { c.PublicURL = "https://example.com" }).withAdmin("admin")
+	s.store.CreateReview("albums", &Review{Slug: "boards-geogaddi", Artist: "Boards", Title: "Geogaddi", Rating: 9.1})
+	for path, want := range map[string]string{
+		"/":                             "https://example.com/",
+		"/?tab=all":                     "https://example.com/",
+		"/?tab=albums&utm_source=feed":  "https://example.com/?tab=albums",
+		"/music/albums/boards-geogaddi": "https://example.com/music/albums/boards-geogaddi",
+	} {
+		expectBody(t, s.get(path), `<link rel="canonical" href="`+want+`">`)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// siteConfig is one [[sites]] entry: a separate blog with its own database,
+// uploads, settings and users, picked by the request's Host header. Every
+// other setting is shared by all sites.
+type siteConfig struct {
+	Name      string   `toml:"name"`
+	Hosts     []string `toml:"hosts"` // "*" catches hosts no other site claims
+	DBPath    string   `toml:"db_path"`
+	UploadDir string   `toml:"upload_dir"` // with s3 storage, files go under <prefix><name>/ instead
+	BasePath  string   `toml:"base_path"`
+	PublicURL string   `toml:"public_url"`
+}
+
+// siteConfigs returns one config per site, each with the site's paths filled
+// in. Without [[sites]] the top-level settings are the only site.
+func (c *config) siteConfigs() []*config {
+	if len(c.Sites) == 0 {
+		return []*config{c}
+	}
+	out := make([]*config, 0, len(c.Sites))
+	for _, s := range c.Sites {
+		out = append(out, c.withSite(s))
+	}
+	return out
+}
+
+func (c *config) withSite(s siteConfig) *config {
+	sc := *c
+	sc.Sites = nil
+	sc.siteName = s.Name
+	sc.siteHosts = s.Hosts
+	sc.DBPath = s.DBPath
+	sc.UploadDir = s.UploadDir
+	sc.BasePath = s.BasePath
+	sc.PublicURL = s.PublicURL
+	// Sites share a bucket, each under its own prefix, and the card
+	// directory, each in its own subdirectory.
+	sc.Storage.S3.Prefix = c.Storage.S3.Prefix + s.Name + "/"
+	sc.Cache.CardDir = filepath.Join(c.Cache.CardDir, s.Name)
+	return &sc
+}
+
+// forSite picks the site a CLI command works on. name may only be empty when
+// there is at most one site.
+func (c *config) forSite(name string) (*config, error) {
+	if len(c.Sites) == 0 {
+		if name != "" {
+			return nil, fmt.Errorf("--site %s: no [[sites]] are configured", name)
+		}
+		return c, nil
+	}
+	if name == "" {
+		if len(c.Sites) == 1 {
+			return c.withSite(c.Sites[0]), nil
+		}
+		names := make([]string, len(c.Sites))
+		for i, s := range c.Sites {
+			names[i] = s.Name
+		}
+		return nil, fmt.Errorf("several sites are configured; choose one with --site (%s)", strings.Join(names, ", "))
+	}
+	for _, s := range c.Sites {
+		if s.Name == name {
+			return c.withSite(s), nil
+		}
+	}
+	return nil, fmt.Errorf("--site %s: no such site", name)
+}
+
+func (c *config) validateSites() []error {
+	var errs []error
+	names := make(map[string]bool)
+	hosts := make(map[string]string)
+	dbs := make(map[string]string)
+	for i, s := range c.Sites {
+		label := fmt.Sprintf("sites[%d]", i)
+		if s.Name == "" {
+			errs = append(errs, fmt.Errorf("%s: name is required", label))
+			continue
+		}
+		label = fmt.Sprintf("sites %q", s.Name)
+		if names[s.Name] {
+			errs = append(errs, fmt.Errorf("%s: name is used twice", label))
+		}
+		names[s.Name] = true
+		if len(s.Hosts) == 0 {
+			errs = append(errs, fmt.Errorf("%s: hosts is required", label))
+		}
+		for _, h := range s.Hosts {
+			h = strings.ToLower(h)
+			if other, ok := hosts[h]; ok {
+				errs = append(errs, fmt.Errorf("%s: host %s is already used by %q", label, h, other))
+			}
+			hosts[h] = s.Name
+		}
+		if s.DBPath == "" {
+			errs = append(errs, fmt.Errorf("%s: db_path is required", label))
+		}
+		if s.UploadDir == "" && c.Storage.Backend == "local" {
+			errs = append(errs, fmt.Errorf("%s: upload_dir is required with local storage", label))
+		}
+		if other, ok := dbs[s.DBPath]; ok && s.DBPath != "" {
+			errs = append(errs, fmt.Errorf("%s: db_path is already used by %q", label, other))
+		}
+		dbs[s.DBPath] = s.Name
+		if err := validateBasePath(s.BasePath); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", label, err))
+		}
+		if err := validatePublicURL(s.PublicURL); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", label, err))
+		}
+	}
+	return errs
+}
+
+func validateBasePath(p string) error {
+	if p != "" && (!strings.HasPrefix(p, "/") || strings.HasSuffix(p, "/")) {
+		return fmt.Errorf("base_path %q must start with / and not end with one, e.g. /reviews", p)
+	}
+	return nil
+}
+
+// validatePublicURL checks a public_url: absolute, and without a trailing
+// slash, query or fragment so paths can be appended to it.
+func validatePublicURL(s string) error {
+	if s == "" {
+		return nil
+	}
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+		strings.HasSuffix(s, "/") || u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("public_url %q must be an http:// or https:// address not ending in /, e.g. https://example.com/reviews", s)
+	}
+	return nil
+}
+
+// hostRouter sends each request to the site that claims its Host.
+type hostRouter struct {
+	sites    map[string]http.Handler
+	fallback http.Handler // the "*" site, if any
+}
+
+func newHostRouter() *hostRouter {
+	return &hostRouter{sites: make(map[string]http.Handler)}
+}
+
+func (hr *hostRouter) add(hosts []string, h http.Handler) error {
+	for _, host := range hosts {
+		if host == "*" {
+			hr.fallback = h
+			continue
+		}
+		host = strings.ToLower(host)
+		if _, ok := hr.sites[host]; ok {
+			return errors.New("host " + host + " is claimed twice")
+		}
+		hr.sites[host] = h
+	}
+	return nil
+}
+
+func (hr *hostRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := strings.ToLower(r.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if h, ok := hr.sites[host]; ok {
+		h.ServeHTTP(w, r)
+		return
+	}
+	if hr.fallback != nil {
+		hr.fallback.ServeHTTP(w, r)
+		return
+	}
+	http.Error(w, "Unknown site", http.StatusMisdirectedRequest)
+}
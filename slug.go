@@ -1,7 +1,6 @@
 package main
 
 import (
-	"database/sql"
 	"fmt"
 	"regexp"
 	"strings"
@@ -23,16 +22,16 @@ func generateSlug(artist, title string) string {
 	return s
 }
 
-func uniqueSlug(db *sql.DB, table, artist, title string, excludeID int64) (string, error) {
+func uniqueSlug(store Store, table, artist, title string, excludeID int64) (string, error) {
 	base := generateSlug(artist, title)
 	slug := base
 	for i := 2; ; i++ {
 		var exists bool
 		var err error
 		if excludeID > 0 {
-			exists, err = dbSlugExistsExcluding(db, table, slug, excludeID)
+			exists, err = store.SlugExistsExcluding(table, slug, excludeID)
 		} else {
-			exists, err = dbSlugExists(db, table, slug)
+			exists, err = store.SlugExists(table, slug)
 		}
 		if err != nil {
 			return "", err
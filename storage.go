@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// storage holds uploaded files. Keys are slash-separated paths relative to the
+// storage root, e.g. "2024/06/1718000000000000000.jpg", and are what reviews
+// store in cover_path.
+type storage interface {
+	Put(ctx context.Context, key string, r io.Reader, contentType string) error
+	// Open returns fs.ErrNotExist for a missing key.
+	Open(ctx context.Context, key string) (io.ReadCloser, objectInfo, error)
+	Delete(ctx context.Context, key string) error
+	List(ctx context.Context) ([]string, error)
+	// Check reports whether files can currently be saved.
+	Check(ctx context.Context) error
+}
+
+// urlSigner is implemented by backends that can hand out temporary URLs, so
+// browsers fetch files from the backend directly.
+type urlSigner interface {
+	SignedURL(key string, expiry time.Duration) (string, error)
+	// Origin is where signed URLs point, e.g. https://bucket.s3.amazonaws.com.
+	Origin() string
+}
+
+type objectInfo struct {
+	Size        int64
+	ModTime     time.Time
+	ContentType string
+	ETag        string
+}
+
+// newStorage returns the backend named in the config.
+func (c *config) newStorage() (storage, error) {
+	return c.storageBackend(c.Storage.Backend)
+}
+
+// storageBackend builds the named backend from this config's settings, so
+// "storage migrate" can open one that isn't the active backend.
+func (c *config) storageBackend(name string) (storage, error) {
+	switch name {
+	case "local":
+		return &localStorage{dir: c.UploadDir}, nil
+	case "s3":
+		return newS3Storage(c.Storage.S3)
+	}
+	return nil, fmt.Errorf("unknown storage backend %q (local or s3)", name)
+}
+
+func (c *config) validateStorage() []error {
+	var errs []error
+	st := c.Storage
+	switch st.Backend {
+	case "local":
+		if st.Serve == "redirect" {
+			errs = append(errs, errors.New("storage.serve: redirect needs the s3 backend"))
+		}
+	case "s3":
+		s3 := st.S3
+		if s3.Endpoint == "" || s3.Bucket == "" || s3.Region == "" {
+			errs = append(errs, errors.New("storage.s3: endpoint, region and bucket are required"))
+		} else if _, err := newS3Storage(s3); err != nil {
+			errs = append(errs, fmt.Errorf("storage.s3: %w", err))
+		}
+		if s3.AccessKey == "" || s3.SecretKey == "" {
+			errs = append(errs, errors.New("storage.s3: access_key and secret_key are required"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("storage.backend: %q is not local or s3", st.Backend))
+	}
+	if st.Serve != "proxy" && st.Serve != "redirect" {
+		errs = append(errs, fmt.Errorf("storage.serve: %q is not proxy or redirect", st.Serve))
+	}
+	if st.URLExpiry.Duration < time.Minute || st.URLExpiry.Duration > 7*24*time.Hour {
+		errs = append(errs, errors.New("storage.url_expiry: must be between 1m and 168h"))
+	}
+	return errs
+}
+
+// localStorage keeps files under a directory on disk.
+type localStorage struct {
+	dir string
+}
+
+func (s *localStorage) String() string { return s.dir }
+
+func (s *localStorage) path(key string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(key))
+}
+
+// Put writes to a temporary file first, so a failed upload never leaves a
+// partial file under the real name.
+func (s *localStorage) Put(ctx context.Context, key string, r io.Reader, contentType string) error {
+	p := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(p), ".upload-*")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	os.Chmod(f.Name(), 0644)
+	return os.Rename(f.Name(), p)
+}
+
+func (s *localStorage) Open(ctx context.Context, key string) (io.ReadCloser, objectInfo, error) {
+	f, err := os.Open(s.path(key))
+	if err != nil {
+		return nil, objectInfo{}, err
+	}
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		f.Close()
+		return nil, objectInfo{}, fs.ErrNotExist
+	}
+	return f, objectInfo{Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+func (s *localStorage) Delete(ctx context.Context, key string) error {
+	return os.Remove(s.path(key))
+}
+
+func (s *localStorage) List(ctx context.Context) ([]string, error) {
+	var keys []string
+	err := filepath.WalkDir(s.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(s.dir, p)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, filepath.ToSlash(rel))
+		return nil
+	})
+	return keys, err
+}
+
+func (s *localStorage) Check(ctx context.Context) error {
+	f, err := os.CreateTemp(s.dir, ".check-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// handleUploadFile serves /uploads/{key...}, either by redirecting to a signed
+// URL or by streaming the file through this process.
+func (app *application) handleUploadFile(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if !fs.ValidPath(key) || key == "." {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Fonts are streamed even then: browsers load them with CORS, which a
+	// bucket on another origin would have to allow.
+	if signer, ok := app.uploads.(urlSigner); ok && app.cfg.Storage.Serve == "redirect" && !strings.HasPrefix(key, "fonts/") {
+		expiry := app.cfg.Storage.URLExpiry.Duration
+		u, err := signer.SignedURL(key, expiry)
+		if err != nil {
+			requestLogger(r).Error("sign upload URL", "key", key, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		// Let browsers reuse the redirect for a while, but not past the
+		// signature's expiry.
+		w.Header().Set("Cache-Control", "private, max-age="+strconv.Itoa(int(expiry.Seconds()/2)))
+		http.Redirect(w, r, u, http.StatusFound)
+		return
+	}
+
+	body, info, err := app.uploads.Open(r.Context(), key)
+	if errors.Is(err, fs.ErrNotExist) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		requestLogger(r).Error("open upload", "key", key, "err", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer body.Close()
+
+	if info.ContentType != "" {
+		w.Header().Set("Content-Type", info.ContentType)
+	}
+	if info.ETag != "" {
+		w.Header().Set("ETag", info.ETag)
+	}
+	// Local files can seek, which gets range and conditional requests for free.
+	if rs, ok := body.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, key, info.ModTime, rs)
+		return
+	}
+	if info.ETag != "" && r.Header.Get("If-None-Match") == info.ETag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if !info.ModTime.IsZero() {
+		w.Header().Set("Last-Modified", info.ModTime.UTC().Format(http.TimeFormat))
+	}
+	if info.Size >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	}
+	io.Copy(w, body)
+}
+
+// ---------- storage command ----------
+
+func cmdStorage(env *cliEnv, args []string) int {
+	if len(args) == 0 || args[0] != "migrate" {
+		return usageError("usage: ditchfork storage migrate [--delete] <from> <to>")
+	}
+	fs := flag.NewFlagSet("storage migrate", flag.ContinueOnError)
+	del := fs.Bool("delete", false, "remove each file from the source once it is copied")
+	if err := fs.Parse(args[1:]); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() != 2 || fs.Arg(0) == fs.Arg(1) {
+		return usageError("usage: ditchfork storage migrate [--delete] <from> <to>  (local or s3)")
+	}
+	from, err := env.cfg.storageBackend(fs.Arg(0))
+	if err != nil {
+		return usageError("%v", err)
+	}
+	to, err := env.cfg.storageBackend(fs.Arg(1))
+	if err != nil {
+		return usageError("%v", err)
+	}
+	return migrateStorage(context.Background(), from, to, *del)
+}
+
+// migrateStorage copies every file in from that to doesn't already have.
+// It can be re-run after a failure; finished files are skipped.
+func migrateStorage(ctx context.Context, from, to storage, del bool) int {
+	keys, err := from.List(ctx)
+	if err != nil {
+		return fail("list %v: %v", from, err)
+	}
+	existing, err := to.List(ctx)
+	if err != nil {
+		return fail("list %v: %v", to, err)
+	}
+	have := make(map[string]bool, len(existing))
+	for _, k := range existing {
+		have[k] = true
+	}
+
+	copied, skipped, failed := 0, 0, 0
+	for _, key := range keys {
+		if !have[key] {
+			if err := copyObject(ctx, from, to, key); err != nil {
+				fmt.Fprintf(os.Stderr, "ditchfork: %s: %v\n", key, err)
+				failed++
+				continue
+			}
+			copied++
+		} else {
+			skipped++
+			// A file that was already there may not be this one; only the
+			// source is sure to be right, so it stays unless they match.
+			if del {
+				if same, err := sameObject(ctx, from, to, key); err != nil || !same {
+					if err == nil {
+						err = fmt.Errorf("differs from the copy in %v", to)
+					}
+					fmt.Fprintf(os.Stderr, "ditchfork: keeping %s: %v\n", key, err)
+					continue
+				}
+			}
+		}
+		if del {
+			if err := from.Delete(ctx, key); err != nil {
+				fmt.Fprintf(os.Stderr, "ditchfork: delete %s: %v\n", key, err)
+			}
+		}
+	}
+	fmt.Printf("%d copied, %d already present, %d failed (%v -> %v)\n", copied, skipped, failed, from, to)
+	if failed > 0 {
+		return exitFailure
+	}
+	return exitOK
+}
+
+func copyObject(ctx context.Context, from, to storage, key string) error {
+	body, info, err := from.Open(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	contentType := info.ContentType
+	if contentType == "" {
+		contentType = contentTypeByExt(key)
+	}
+	return to.Put(ctx, key, body, contentType)
+}
+
+// sameObject reports whether key has the same contents in both backends.
+func sameObject(ctx context.Context, a, b storage, key string) (bool, error) {
+	var sums [2][sha256.Size]byte
+	for i, s := range []storage{a, b} {
+		body, _, err := s.Open(ctx, key)
+		if err != nil {
+			return false, err
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, body)
+		body.Close()
+		if err != nil {
+			return false, err
+		}
+		h.Sum(sums[i][:0])
+	}
+	return sums[0] == sums[1], nil
+}
+
+// contentTypeByExt covers the image and font types admins can upload.
+func contentTypeByExt(key string) string {
+	if ct, ok := fontContentTypes[filepath.Ext(key)]; ok {
+		return ct
+	}
+	switch filepath.Ext(key) {
+	case ".jpg", ".jpeg":
+		return "image/jpeg"
+	case ".png":
+		return "image/png"
+	case ".webp":
+		return "image/webp"
+	}
+	return "application/octet-stream"
+}
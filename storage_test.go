@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUploadKeys(t *testing.T) {
+	var dir string
+	s := newTestSite(t, func(c *config) { dir = c.UploadDir }).withAdmin("admin")
+	uploads := &localStorage{dir: dir}
+	uploads.Put(context.Background(), "2024/06/cover.png", strings.NewReader("png"), "image/png")
+	if err := os.WriteFile(filepath.Join(filepath.Dir(dir), "secret.txt"), []byte("secret"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := s.get("/uploads/2024/06/cover.png")
+	expectStatus(t, rec, http.StatusOK)
+	expectBody(t, rec, "png")
+
+	// Nothing outside upload_dir can be reached, however the path is spelled.
+	for _, path := range []string{
+		"/uploads/..%2Fsecret.txt",
+		"/uploads/%2e%2e/secret.txt",
+		"/uploads/2024/..%2F..%2Fsecret.txt",
+		"/uploads/2024%2F..%2F..%2Fsecret.txt",
+		"/uploads/.",
+		"/uploads/",
+	} {
+		rec := s.get(path)
+		if rec.Code == http.StatusOK || strings.Contains(rec.Body.String(), "secret") {
+			t.Errorf("GET %s = %d:\n%s", path, rec.Code, rec.Body)
+		}
+	}
+	expectStatus(t, s.get("/uploads/2024/06/missing.png"), http.StatusNotFound)
+}
+
+func TestUploadsFromS3(t *testing.T) {
+	fake, s3cfg := newFakeS3(t, "covers")
+	fake.objects["2024/06/cover.png"] = fakeObject{[]byte("png"), "image/png"}
+	fake.objects["fonts/1.woff2"] = fakeObject{[]byte("wOF2"), "font/woff2"}
+	withS3 := func(serve string) func(*config) {
+		return func(c *config) {
+			c.Storage.Backend = "s3"
+			c.Storage.Serve = serve
+			c.Storage.URLExpiry = duration{10 * time.Minute}
+			c.Storage.S3 = s3cfg
+		}
+	}
+
+	// Proxied, files come through the site with the bucket's validators.
+	s := newTestSite(t, withS3("proxy")).withAdmin("admin")
+	rec := s.get("/uploads/2024/06/cover.png")
+	expectStatus(t, rec, http.StatusOK)
+	expectBody(t, rec, "png")
+	if ct := rec.Header().Get("Content-Type"); ct != "image/png" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	etag := rec.Header().Get("ETag")
+	expectStatus(t, s.getWith("/uploads/2024/06/cover.png", map[string]string{"If-None-Match": etag}), http.StatusNotModified)
+	expectStatus(t, s.get("/uploads/2024/06/missing.png"), http.StatusNotFound)
+
+	// Redirected, browsers are sent to a signed URL they may reuse for half
+	// its lifetime...
+	s = newTestSite(t, withS3("redirect")).withAdmin("admin")
+	rec = s.get("/uploads/2024/06/cover.png")
+	expectStatus(t, rec, http.StatusFound)
+	loc := rec.Header().Get("Location")
+	if !strings.HasPrefix(loc, s3cfg.Endpoint+"/covers/2024/06/cover.png?") || !strings.Contains(loc, "X-Amz-Signature=") ||
+		!strings.Contains(loc, "X-Amz-Expires=600") {
+		t.Errorf("Location = %q", loc)
+	}
+	if cc := rec.Header().Get("Cache-Control"); cc != "private, max-age=300" {
+		t.Errorf("Cache-Control = %q", cc)
+	}
+	// ...except for fonts, which are streamed to avoid CORS.
+	rec = s.get("/uploads/fonts/1.woff2")
+	expectStatus(t, rec, http.StatusOK)
+	expectBody(t, rec, "wOF2")
+	// Bad keys are refused before anything is signed.
+	expectStatus(t, s.get("/uploads/..%2Fsecret.txt"), http.StatusNotFound)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// Store is everything the handlers and commands read and write. sqlStore
+// implements it over SQLite or PostgreSQL; the tests use an in-memory one.
+type Store interface {
+	Ping(ctx context.Context) error
+
+	// Reviews, by content table (albums, songs, articles)
+	GetFeed() ([]Review, error)
+	GetByTable(table string) ([]Review, error)
+	GetBySlug(table, slug string) (*Review, error)
+	GetByID(table string, id int64) (*Review, error)
+	CreateReview(table string, r *Review) (int64, error)
+	UpdateReview(table string, r *Review) error
+	ImportReview(table string, r *Review) error
+	DeleteReview(table string, id int64) error
+	CountContent(table string) (int, error)
+	SlugExists(table, slug string) (bool, error)
+	SlugExistsExcluding(table, slug string, excludeID int64) (bool, error)
+
+	// Users
+	HasUsers() (bool, error)
+	GetUserByUsername(username string) (*User, error)
+	GetUserByID(id int64) (*User, error)
+	ListUsers() ([]User, error)
+	CreateUser(username, passwordHash string) error
+	DeleteUser(id int64) error
+	SetUserPassword(userID int64, passwordHash string) error
+
+	// Sessions
+	CreateSession(s *Session) error
+	GetSession(tokenHash string) (*Session, error)
+	ListSessions() ([]Session, error)
+	TouchSession(id int64, seen time.Time) error
+	DeleteSession(tokenHash string) error
+	DeleteSessionByID(id int64) error
+	DeleteUserSessions(userID int64) error
+	CountActiveSessions() (int, error)
+	CleanExpiredSessions() error
+
+	// Password resets
+	CreatePasswordReset(userID int64, tokenHash string, expiresAt time.Time) error
+	GetPasswordResetUser(tokenHash string) (*User, error)
+	UsePasswordReset(tokenHash, passwordHash string) (*User, error)
+	CleanExpiredPasswordResets() error
+
+	// Login throttling
+	GetLoginFailure(scope, key string) (*LoginFailure, error)
+	RecordLoginFailure(scope, key string, now, windowStart time.Time) (int, error)
+	LockLogin(scope, key string, until time.Time) error
+	ClearLoginFailures(scope, key string) error
+	GetLockedUsers() (map[string]time.Time, error)
+	CleanLoginFailures(before time.Time) error
+
+	// Audit log
+	InsertAudit(e *AuditEntry) error
+	ListAudit(f auditFilter, limit, offset int) ([]AuditEntry, error)
+	ListAuditActions() ([]string, error)
+
+	// Settings
+	GetAllSettings() (map[string]string, error)
+	UpdateSetting(key, value string) error
+}
+
+// sqlStore is the Store backed by a real database. Functions that only make
+// sense for SQL, like backups and migrations, take the *database directly.
+type sqlStore struct {
+	db *database
+}
+
+func newSQLStore(db *database) *sqlStore {
+	return &sqlStore{db: db}
+}
+
+func (st *sqlStore) Ping(ctx context.Context) error {
+	return st.db.PingContext(ctx)
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/BurntSushi/toml"
+)
+
+// A theme restyles the site without touching Go code. It is a directory
+// holding a theme.toml and any of:
+//
+//	templates/<page>             replaces one of pageTemplates, or base.html
+//	templates/partials/*.html    replaces or adds to the shared {{define}}s
+//	static/<file>                replaces or adds to the static files
+//
+// Anything a theme leaves out comes from the built-in templates and static
+// files. Themes are bundled from themes/ in the source tree or read from
+// themes_dir, where one may also replace a bundled theme of the same name.
+// A page whose override fails to parse or to render falls back to the
+// built-in page.
+
+//go:embed all:themes
+var bundledThemeFS embed.FS
+
+// defaultTheme is the built-in look, which has no overrides.
+const defaultTheme = "classic"
+
+// themeInfo is a theme's theme.toml.
+type themeInfo struct {
+	Name        string `toml:"name"`
+	Description string `toml:"description"`
+	Author      string `toml:"author"`
+	Version     string `toml:"version"`
+}
+
+type theme struct {
+	ID      string // directory name, kept in the theme setting
+	Info    themeInfo
+	Bundled bool     // compiled in rather than read from themes_dir
+	Errors  []string // overrides that failed and were replaced by the built-in pages
+
+	templates map[string]*template.Template
+	assets    *staticAssets
+	version   string // changes with the theme's files; part of page ETags
+}
+
+// themeSet loads themes on first use and keeps them until reload, so edits
+// to a theme on disk show up once Settings are saved.
+type themeSet struct {
+	dir     string // themes_dir, or "" for bundled themes only
+	link    func(path string) string
+	builtin *theme
+
+	mu     sync.Mutex
+	loaded map[string]*theme
+}
+
+func newThemeSet(dir string, link func(path string) string) *themeSet {
+	ts := &themeSet{dir: dir, link: link, loaded: make(map[string]*theme)}
+	classic, _ := fs.Sub(bundledThemeFS, "themes/"+defaultTheme)
+	info, _ := readThemeInfo(classic, defaultTheme)
+	ts.builtin = &theme{
+		ID:        defaultTheme,
+		Info:      info,
+		Bundled:   true,
+		templates: make(map[string]*template.Template),
+		assets:    assets,
+		version:   siteVersion,
+	}
+	funcs := templateFuncs(link, assets)
+	partials := themePartials(templateFS)
+	for _, page := range pageTemplates {
+		ts.builtin.templates[page] = template.Must(parsePage(templateFS, funcs, page, partials))
+	}
+	return ts
+}
+
+// theme is the theme the settings pick, or the built-in one.
+func (app *application) theme(settings map[string]string) *theme {
+	return app.themes.get(settings[SettingTheme])
+}
+
+var themeIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// get returns the theme named id, loading it if needed. Unknown themes are
+// the built-in one.
+func (ts *themeSet) get(id string) *theme {
+	if !themeIDPattern.MatchString(id) {
+		return ts.builtin
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if t, ok := ts.loaded[id]; ok {
+		return t
+	}
+	fsys, bundled := ts.source(id)
+	if fsys == nil {
+		return ts.builtin
+	}
+	t := ts.load(id, fsys, bundled)
+	ts.loaded[id] = t
+	return t
+}
+
+// reload forgets the loaded themes, so they are read again on next use.
+func (ts *themeSet) reload() {
+	ts.mu.Lock()
+	clear(ts.loaded)
+	ts.mu.Unlock()
+}
+
+// source finds a theme's files, preferring themes_dir to the bundled ones.
+func (ts *themeSet) source(id string) (fs.FS, bool) {
+	if ts.dir != "" {
+		if info, err := os.Stat(filepath.Join(ts.dir, id)); err == nil && info.IsDir() {
+			return os.DirFS(filepath.Join(ts.dir, id)), false
+		}
+	}
+	if _, err := fs.Stat(bundledThemeFS, "themes/"+id); err == nil {
+		sub, _ := fs.Sub(bundledThemeFS, "themes/"+id)
+		return sub, true
+	}
+	return nil, false
+}
+
+func (ts *themeSet) load(id string, fsys fs.FS, bundled bool) *theme {
+	t := &theme{ID: id, Bundled: bundled, templates: make(map[string]*template.Template)}
+	fail := func(what string, err error) {
+		slog.Error("theme", "theme", id, "file", what, "err", err)
+		t.Errors = append(t.Errors, fmt.Sprintf("%s: %v", what, err))
+	}
+
+	info, err := readThemeInfo(fsys, id)
+	if err != nil {
+		fail("theme.toml", err)
+	}
+	t.Info = info
+
+	t.assets = assets.overlay(fsys)
+	src := overlayFS{upper: fsys, lower: templateFS}
+	funcs := templateFuncs(ts.link, t.assets)
+	partials := themePartials(fsys, templateFS)
+	for _, page := range pageTemplates {
+		tmpl, err := parsePage(src, funcs, page, partials)
+		if err != nil {
+			fail("templates/"+page, err)
+			tmpl = ts.builtin.templates[page]
+		}
+		t.templates[page] = tmpl
+	}
+	t.version = themeVersion(fsys)
+	return t
+}
+
+// list describes every theme Settings offers: the default first, then by
+// name.
+func (ts *themeSet) list() []*theme {
+	ids := map[string]bool{defaultTheme: true}
+	if entries, err := fs.ReadDir(bundledThemeFS, "themes"); err == nil {
+		for _, e := range entries {
+			ids[e.Name()] = true
+		}
+	}
+	if ts.dir != "" {
+		if entries, err := os.ReadDir(ts.dir); err == nil {
+			for _, e := range entries {
+				if e.IsDir() && themeIDPattern.MatchString(e.Name()) {
+					ids[e.Name()] = true
+				}
+			}
+		}
+	}
+	var themes []*theme
+	for id := range ids {
+		themes = append(themes, ts.get(id))
+	}
+	slices.SortFunc(themes, func(a, b *theme) int {
+		switch {
+		case a.ID == defaultTheme:
+			return -1
+		case b.ID == defaultTheme:
+			return 1
+		}
+		return strings.Compare(strings.ToLower(a.Info.Name), strings.ToLower(b.Info.Name))
+	})
+	return themes
+}
+
+// exists reports whether id names a theme, so the theme setting can't be
+// saved with a typo.
+func (ts *themeSet) exists(id string) bool {
+	if id == defaultTheme {
+		return true
+	}
+	if !themeIDPattern.MatchString(id) {
+		return false
+	}
+	fsys, _ := ts.source(id)
+	return fsys != nil
+}
+
+// readThemeInfo reads theme.toml. A theme without one is named after its
+// directory.
+func readThemeInfo(fsys fs.FS, id string) (themeInfo, error) {
+	info := themeInfo{Name: id}
+	data, err := fs.ReadFile(fsys, "theme.toml")
+	if errors.Is(err, fs.ErrNotExist) {
+		return info, nil
+	}
+	if err == nil {
+		err = toml.Unmarshal(data, &info)
+	}
+	if info.Name == "" {
+		info.Name = id
+	}
+	return info, err
+}
+
+// themePartials lists the partials in every fsys, each name once.
+func themePartials(fsyss ...fs.FS) []string {
+	var names []string
+	for _, fsys := range fsyss {
+		found, _ := fs.Glob(fsys, "templates/partials/*.html")
+		names = append(names, found...)
+	}
+	slices.Sort(names)
+	return slices.Compact(names)
+}
+
+// themeVersion hashes every file in a theme.
+func themeVersion(fsys fs.FS) string {
+	h := sha256.New()
+	h.Write([]byte(siteVersion))
+	fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			data, _ := fs.ReadFile(fsys, name)
+			h.Write([]byte(name))
+			h.Write(data)
+		}
+		return nil
+	})
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// overlayFS opens files from upper, or from lower when upper has none.
+type overlayFS struct {
+	upper, lower fs.FS
+}
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	if f, err := o.upper.Open(name); err == nil {
+		return f, nil
+	}
+	return o.lower.Open(name)
+}
+
+// overlay returns a copy of a with the files under static/ in fsys added,
+// replacing any of the same name.
+func (a *staticAssets) overlay(fsys fs.FS) *staticAssets {
+	if _, err := fs.Stat(fsys, "static"); err != nil {
+		return a
+	}
+	over := loadAssets(fsys, "static")
+	merged := &staticAssets{files: maps.Clone(a.files), names: maps.Clone(a.names)}
+	for name, fingerprinted := range over.names {
+		merged.names[name] = fingerprinted
+		merged.files[name] = over.files[name]
+		merged.files[fingerprinted] = over.files[fingerprinted]
+	}
+	return merged
+}
+
+// has reports whether a static file exists, so base.html links a theme's
+// theme.css only when there is one.
+func (a *staticAssets) has(name string) bool {
+	_, ok := a.names[path.Clean(name)]
+	return ok
+}
+
+// handleStatic serves the static files of the current theme.
+func (app *application) handleStatic(w http.ResponseWriter, r *http.Request) {
+	settings, _ := app.store.GetAllSettings()
+	app.theme(settings).assets.ServeHTTP(w, r)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTheme puts files, keyed by slash-separated path, into dir/id.
+func writeTheme(t *testing.T, dir, id string, files map[string]string) {
+	t.Helper()
+	for name, data := range files {
+		p := filepath.Join(dir, id, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBundledThemes(t *testing.T) {
+	s := newTestSite(t).withAdmin("admin")
+	s.store.CreateReview("albums", &Review{Slug: "boards-geogaddi", Artist: "Boards", Title: "Geogaddi", Rating: 9.1})
+	s.login("admin")
+
+	rec := s.get("/admin/settings")
+	for _, want := range []string{`<option value="classic" selected>Classic 1.0</option>`, `value="broadsheet"`, `value="compact"`} {
+		expectBody(t, rec, want)
+	}
+	if strings.Contains(s.get("/").Body.String(), "theme.css") {
+		t.Error("classic theme links a theme.css")
+	}
+
+	expectBody(t, s.postForm("/admin/settings", url.Values{SettingTheme: {"broadsheet"}}), "Settings saved successfully.")
+	rec = s.get("/music/albums/boards-geogaddi")
+	expectBody(t, rec, `class="broadsheet-header"`)
+	expectBody(t, rec, `/static/theme.`)
+	expectBody(t, s.get("/"), `class="album-card`)
+
+	s.postForm("/admin/settings", url.Values{SettingTheme: {"compact"}})
+	expectBody(t, s.get("/"), `class="compact-row`)
+	if strings.Contains(s.get("/music/albums/boards-geogaddi").Body.String(), "broadsheet") {
+		t.Error("compact theme kept broadsheet's review page")
+	}
+
+	for _, bad := range []string{"nope", "../compact", "Compact", ""} {
+		s.postForm("/admin/settings", url.Values{SettingTheme: {bad}})
+		if settings, _ := s.store.GetAllSettings(); settings[SettingTheme] != "compact" {
+			t.Errorf("%q changed the theme to %q", bad, settings[SettingTheme])
+		}
+	}
+}
+
+func TestThemeFromDisk(t *testing.T) {
+	dir := t.TempDir()
+	writeTheme(t, dir, "night", map[string]string{
+		"theme.toml":            "name = \"Night\"\ndescription = \"Dark pages.\"\nauthor = \"Jo\"\nversion = \"0.3\"\n",
+		"templates/review.html": `{{define "title"}}{{.Review.Title}}{{end}}{{define "content"}}<h1 class="night">{{.Review.Title}}</h1>{{end}}`,
+		"static/style.css":      "body { background: black; }",
+	})
+	s := newTestSite(t, func(c *config) { c.ThemesDir = dir }).withAdmin("admin")
+	s.store.CreateReview("albums", &Review{Slug: "boards-geogaddi", Artist: "Boards", Title: "Geogaddi", Rating: 9.1})
+	s.login("admin")
+
+	rec := s.postForm("/admin/settings", url.Values{SettingTheme: {"night"}})
+	expectBody(t, rec, "Night 0.3 (from themes directory)")
+	expectBody(t, rec, "Dark pages. By Jo.")
+	expectBody(t, s.get("/music/albums/boards-geogaddi"), `<h1 class="night">Geogaddi</h1>`)
+
+	// The theme's style.css replaces the built-in one, under its own fingerprint.
+	home := s.get("/").Body.String()
+	if strings.Contains(home, assets.path("style.css")) {
+		t.Fatal("home page links the built-in style.css")
+	}
+	expectBody(t, s.get("/static/style.css"), "background: black")
+
+	// Edits on disk show up once Settings are saved.
+	etag := s.get("/").Header().Get("ETag")
+	writeTheme(t, dir, "night", map[string]string{
+		"templates/review.html": `{{define "title"}}{{.Review.Title}}{{end}}{{define "content"}}<h1 class="night-2">{{.Review.Title}}</h1>{{end}}`,
+	})
+	expectBody(t, s.get("/music/albums/boards-geogaddi"), `class="night"`)
+	s.postForm("/admin/settings", url.Values{SettingTheme: {"night"}})
+	expectBody(t, s.get("/music/albums/boards-geogaddi"), `class="night-2"`)
+	if s.get("/").Header().Get("ETag") == etag {
+		t.Error("ETag unchanged after the theme changed")
+	}
+}
+
+func TestBrokenThemeFallsBack(t *testing.T) {
+	dir := t.TempDir()
+	writeTheme(t, dir, "broken", map[string]string{
+		"templates/review.html": `{{define "content"}}{{if}}{{end}}`,
+		"templates/home.html":   `{{define "content"}}{{template "missing" .}}{{end}}`,
+	})
+	s := newTestSite(t, func(c *config) { c.ThemesDir = dir }).withAdmin("admin")
+	s.store.CreateReview("albums", &Review{Slug: "boards-geogaddi", Artist: "Boards", Title: "Geogaddi", Rating: 9.1})
+	s.login("admin")
+
+	// A template that doesn't parse is reported in Settings.
+	rec := s.postForm("/admin/settings", url.Values{SettingTheme: {"broken"}})
+	expectBody(t, rec, "Parts of this theme could not be used")
+	expectBody(t, rec, "templates/review.html:")
+	expectBody(t, s.get("/music/albums/boards-geogaddi"), "Geogaddi")
+
+	// One that fails while rendering is replaced for that request.
+	expectBody(t, s.get("/"), `class="album-card`)
+}
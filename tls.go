@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// certPollInterval is how often the certificate files are checked for changes,
+// so a renewal (e.g. by certbot) is picked up without a signal.
+const certPollInterval = time.Minute
+
+// certReloader serves the configured certificate and swaps it when the files
+// change. A failed reload keeps the previous certificate.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+func (cr *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return fmt.Errorf("load certificate: %w", err)
+	}
+	cr.mu.Lock()
+	cr.cert = &cert
+	cr.modTime = cr.latestModTime()
+	cr.mu.Unlock()
+	return nil
+}
+
+// latestModTime returns the newer of the two files' modification times.
+func (cr *certReloader) latestModTime() time.Time {
+	var latest time.Time
+	for _, name := range []string{cr.certFile, cr.keyFile} {
+		if fi, err := os.Stat(name); err == nil && fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest
+}
+
+func (cr *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cert, nil
+}
+
+// watch reloads the certificate on SIGHUP or when the files change, until ctx
+// is cancelled.
+func (cr *certReloader) watch(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	ticker := time.NewTicker(certPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		case <-ticker.C:
+			cr.mu.RLock()
+			unchanged := !cr.latestModTime().After(cr.modTime)
+			cr.mu.RUnlock()
+			if unchanged {
+				continue
+			}
+		}
+		if err := cr.reload(); err != nil {
+			slog.Error("tls: reload failed, keeping the current certificate", "err", err)
+			continue
+		}
+		slog.Info("tls: certificate reloaded")
+	}
+}
+
+// tlsConfig offers HTTP/2 as well as HTTP/1.1: the server listens through
+// tls.NewListener, so ALPN only happens if the config asks for it.
+func (cr *certReloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: cr.getCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+}
+
+// redirectToHTTPS sends plain HTTP requests to the same host and path on the
+// HTTPS listener.
+func redirectToHTTPS(httpsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// hsts adds Strict-Transport-Security to responses served over TLS.
+func hsts(maxAge time.Duration, next http.Handler) http.Handler {
+	if maxAge <= 0 {
+		return next
+	}
+	value := "max-age=" + strconv.Itoa(int(maxAge.Seconds()))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil {
+			w.Header().Set("Strict-Transport-Security", value)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
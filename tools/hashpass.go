@@ -1,28 +0,0 @@
-// Standalone bcrypt hash generator.
-// Usage: go run tools/hashpass.go <password>
-//
-//go:build ignore
-
-package main
-
-import (
-	"fmt"
-	"os"
-
-	"golang.org/x/crypto/bcrypt"
-)
-
-func main() {
-	if len(os.Args) < 2 {
-		fmt.Fprintln(os.Stderr, "usage: go run tools/hashpass.go <password>")
-		os.Exit(1)
-	}
-
-	hash, err := bcrypt.GenerateFromPassword([]byte(os.Args[1]), bcrypt.DefaultCost)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "error: %v\n", err)
-		os.Exit(1)
-	}
-
-	fmt.Println(string(hash))
-}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+func (h *authHandler) handleUsers(w http.ResponseWriter, r *http.Request) {
+	h.renderUsers(w, r, nil)
+}
+
+// renderUsers renders the users page, with extra template data (e.g. a freshly
+// issued reset link) merged in.
+func (h *authHandler) renderUsers(w http.ResponseWriter, r *http.Request, extra map[string]any) {
+	users, err := h.store.ListUsers()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	locked, err := h.store.GetLockedUsers()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	data := map[string]any{
+		"Users":  users,
+		"Locked": locked,
+	}
+	for k, v := range extra {
+		data[k] = v
+	}
+	h.app.render(w, r, "admin/users.html", data)
+}
+
+// handleCreateResetLink issues a one-time password reset link for a user. The
+// link is shown to the admin once; only its hash is stored.
+func (h *authHandler) handleCreateResetLink(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	user, err := h.store.GetUserByID(id)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	tokenBytes := make([]byte, 32)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	token := hex.EncodeToString(tokenBytes)
+
+	if err := h.store.CreatePasswordReset(user.ID, hashToken(token), time.Now().UTC().Add(passwordResetLifetime)); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	requestLogger(r).Info("password reset link issued", "user", user.Username, "by", currentSession(r).Username)
+	h.app.audit(r, "user.reset_link", "user", user.Username, "", "")
+
+	h.renderUsers(w, r, map[string]any{
+		"ResetUser": user.Username,
+		"ResetLink": h.app.absoluteURL(r, "/admin/reset/"+token),
+	})
+}
+
+func (h *authHandler) handleUnlockUser(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	user, err := h.store.GetUserByID(id)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if err := h.limiter.unlock(user.Username); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	requestLogger(r).Info("account unlocked", "user", user.Username, "by", currentSession(r).Username)
+	h.app.audit(r, "user.unlock", "user", user.Username, "locked", "unlocked")
+
+	h.app.redirect(w, r, "/admin/users")
+}